@@ -0,0 +1,328 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+// BundlePathPrefix starts paths of bundle archives, so they can't be mistaken for files of the volume.
+const BundlePathPrefix = ".az-bundles/"
+
+// BundleEntry is a file packed in a bundle. Entries of all files are kept in the manifest of the bundle, so its
+// files can be indexed again with the bundle alone.
+type BundleEntry struct {
+	Path string `json:"p"`
+	// Hash is a tree hash of the file content before encoding.
+	Hash     string `json:"h"`
+	Encoding string `json:"e,omitempty"`
+	Offset   int64  `json:"o"`
+	Length   int64  `json:"l"`
+}
+
+type bundleManifest struct {
+	Files []BundleEntry `json:"files"`
+}
+
+// Bundle packs small files into a single tar archive. Content of every file is stored as is, so it can be read
+// back with a range of the archive. Members are named with hashes of their content, paths of files are kept only
+// in the manifest, which is the last member of the bundle and is encoded the same way as files. Once sealed,
+// the bundle is a file which can be uploaded.
+type Bundle struct {
+	codec    *Codec
+	path     string
+	spool    spoolFile
+	file     *os.File
+	out      io.Writer
+	counter  *countingWriter
+	entries  []BundleEntry
+	manifest BundleEntry
+	sealed   bool
+}
+
+// NewBundle starts a new bundle in a temporary file of the spool directory. It has to be closed to remove it.
+func (c *Codec) NewBundle() (*Bundle, error) {
+	spoolDir := ""
+	if c != nil {
+		spoolDir = c.spoolDir
+	}
+
+	file, err := os.CreateTemp(spoolDir, "az-bundle-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+
+	b := &Bundle{
+		codec:   c,
+		path:    fmt.Sprintf("%s%s-%s.tar", BundlePathPrefix, time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix)),
+		spool:   spoolFile{path: file.Name()},
+		file:    file,
+		counter: &countingWriter{},
+	}
+	b.out = io.MultiWriter(file, b.counter)
+
+	return b, nil
+}
+
+// Add appends content of file to the bundle and returns its position. Content is verified while it is added:
+// a file which doesn't match its hash is rejected and the bundle stays intact.
+func (b *Bundle) Add(file model.FileWithContent) (offset, length int64, err error) {
+	if b.sealed {
+		return 0, 0, errors.New("bundle is already sealed")
+	}
+
+	entry, err := b.add(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	b.entries = append(b.entries, entry)
+
+	return entry.Offset, entry.Length, nil
+}
+
+// add writes a tar member with content of file. Size of the content is known up front, so it is streamed and
+// everything written is cut off again when it doesn't match the hash.
+func (b *Bundle) add(file model.FileWithContent) (entry BundleEntry, err error) {
+	expected := file.Hash()
+	if encoded, ok := file.(model.EncodedFile); ok {
+		expected = encoded.ArchiveHash()
+	}
+	size, err := file.Size()
+	if err != nil {
+		return BundleEntry{}, err
+	}
+	content, err := file.Content()
+	if err != nil {
+		return BundleEntry{}, err
+	}
+	defer func(content io.ReadCloser) {
+		closeErr := content.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}(content)
+
+	start := b.counter.written
+	defer func() {
+		if err == nil {
+			return
+		}
+		if truncateErr := b.truncate(start); truncateErr != nil {
+			err = fmt.Errorf("failed to remove %s from bundle: %v: %w", file.Path(), err, truncateErr)
+		}
+	}()
+
+	// every member has its own writer, which keeps no state between members
+	writer := tar.NewWriter(b.out)
+	err = writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     expected,
+		Size:     size,
+		Mode:     0600,
+		ModTime:  time.Unix(0, 0),
+	})
+	if err != nil {
+		return BundleEntry{}, err
+	}
+
+	offset := b.counter.written
+	hash := newTreeHashWriter()
+	copied, err := io.Copy(io.MultiWriter(writer, hash), io.LimitReader(content, size))
+	if err != nil {
+		return BundleEntry{}, err
+	}
+	if copied != size || hash.Sum() != expected {
+		return BundleEntry{}, fmt.Errorf("%w: %s hashes to %s, expected %s", ErrContentChanged, file.Path(), hash.Sum(), expected)
+	}
+	if err := writer.Flush(); err != nil {
+		return BundleEntry{}, err
+	}
+
+	entry = BundleEntry{Path: file.Path(), Hash: file.Hash(), Offset: offset, Length: size}
+	if encoded, ok := file.(model.EncodingHolder); ok {
+		entry.Encoding = encoded.Encoding()
+	}
+
+	return entry, nil
+}
+
+func (b *Bundle) truncate(size int64) error {
+	if err := b.file.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := b.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	b.counter.written = size
+
+	return nil
+}
+
+// Seal adds the manifest and finishes the archive. Nothing can be added afterwards.
+func (b *Bundle) Seal() error {
+	if b.sealed {
+		return nil
+	}
+	b.sealed = true
+
+	err := b.addManifest()
+	if err == nil {
+		err = tar.NewWriter(b.out).Close()
+	}
+	if closeErr := b.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashOf(b.spool.path)
+	if err != nil {
+		return err
+	}
+	b.spool.hash = hash
+	b.spool.size = b.counter.written
+
+	return nil
+}
+
+func (b *Bundle) addManifest() error {
+	data, err := json.Marshal(bundleManifest{Files: b.entries})
+	if err != nil {
+		return err
+	}
+	var manifest model.FileWithContent = newManifestFile(data)
+
+	encoded, err := b.codec.Encode(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle manifest: %w", err)
+	}
+	if encoded != nil {
+		defer encoded.Close()
+		manifest = encoded
+	}
+
+	b.manifest, err = b.add(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to add bundle manifest: %w", err)
+	}
+
+	return nil
+}
+
+func hashOf(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := newTreeHashWriter()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hash.Sum(), nil
+}
+
+// Manifest returns the position and encoding of the manifest in the sealed bundle.
+func (b *Bundle) Manifest() (offset, length int64, encoding string) {
+	return b.manifest.Offset, b.manifest.Length, b.manifest.Encoding
+}
+
+// ReadBundleManifest returns entries of files listed in the manifest of a bundle.
+func (c *Codec) ReadBundleManifest(encoding string, content io.ReadCloser) (_ []BundleEntry, err error) {
+	decoded := content
+	if encoding != "" {
+		decoded, err = c.Decode(encoding, content)
+		if err != nil {
+			_ = content.Close()
+			return nil, err
+		}
+	}
+	defer decoded.Close()
+
+	manifest := bundleManifest{}
+	if err := json.NewDecoder(decoded).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %w", err)
+	}
+
+	return manifest.Files, nil
+}
+
+// manifestFile is the manifest of a bundle, encoded like other files before it is added.
+type manifestFile struct {
+	data []byte
+	hash string
+}
+
+func newManifestFile(data []byte) manifestFile {
+	hash := newTreeHashWriter()
+	_, _ = hash.Write(data)
+
+	return manifestFile{data: data, hash: hash.Sum()}
+}
+
+func (f manifestFile) Path() string {
+	return "manifest.json"
+}
+
+func (f manifestFile) Hash() string {
+	return f.hash
+}
+
+func (f manifestFile) Content() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (f manifestFile) Size() (int64, error) {
+	return int64(len(f.data)), nil
+}
+
+// Path of the bundle archive, used as its description.
+func (b *Bundle) Path() string {
+	return b.path
+}
+
+// Hash of the sealed bundle.
+func (b *Bundle) Hash() string {
+	return b.spool.hash
+}
+
+func (b *Bundle) Content() (io.ReadCloser, error) {
+	if !b.sealed {
+		return nil, errors.New("bundle is not sealed")
+	}
+
+	return os.Open(b.spool.path)
+}
+
+// Size returns the number of bytes written so far.
+func (b *Bundle) Size() (int64, error) {
+	return b.counter.written, nil
+}
+
+// Close removes content of the bundle.
+func (b *Bundle) Close() error {
+	if !b.sealed {
+		_ = b.file.Close()
+	}
+
+	return b.spool.remove()
+}
@@ -0,0 +1,305 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+const encodingSeparator = "+"
+
+// ErrContentChanged is returned when content of a file doesn't match its hash anymore.
+var ErrContentChanged = errors.New("content has changed")
+
+// Codec encodes content of files before upload and decodes it after download.
+// Content is compressed first and then encrypted. A nil Codec doesn't encode anything.
+type Codec struct {
+	key         []byte
+	spoolDir    string
+	compression string
+	level       int
+	minSaving   int
+}
+
+// NewCodec creates a Codec for options. It returns nil when encoding is disabled.
+func NewCodec(options Options) (*Codec, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	if !options.enabled() {
+		return nil, nil
+	}
+
+	codec := &Codec{
+		spoolDir:    options.SpoolDir,
+		compression: options.compression(),
+		level:       options.compressionLevel(),
+		minSaving:   options.CompressionMinSaving,
+	}
+
+	if options.EncryptionKeyFile != "" {
+		key, err := LoadKey(options.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		codec.key = key
+	}
+
+	return codec, nil
+}
+
+// Encode stores encoded content of file in a temporary file. The result has to be closed to remove it.
+// It returns nil when none of the encodings applies to the file, e.g. it is incompressible and encryption is off.
+func (c *Codec) Encode(file model.FileWithContent) (_ *EncodedFile, err error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	compress, err := c.shouldCompress(file)
+	if err != nil {
+		return nil, err
+	}
+	if !compress && c.key == nil {
+		return nil, nil
+	}
+
+	content, err := file.Content()
+	if err != nil {
+		return nil, err
+	}
+	defer func(content io.ReadCloser) {
+		closeErr := content.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}(content)
+
+	encoded := &EncodedFile{FileWithContent: file}
+	defer func() {
+		if err != nil {
+			_ = encoded.Close()
+		}
+	}()
+
+	var encodings []string
+	input := io.Reader(content)
+	inputHash := file.Hash()
+
+	if compress {
+		compressed, contentHash, err := c.spool(input, func(out io.Writer) (io.WriteCloser, error) {
+			return newCompressingWriter(out, c.level)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress: %w", err)
+		}
+		encoded.spool = compressed
+		if contentHash != file.Hash() {
+			return nil, fmt.Errorf("%w: %s hashes to %s, expected %s", ErrContentChanged, file.Path(), contentHash, file.Hash())
+		}
+
+		compressedContent, err := os.Open(compressed.path)
+		if err != nil {
+			return nil, err
+		}
+		defer compressedContent.Close()
+		input = compressedContent
+		inputHash = compressed.hash
+		encodings = append(encodings, c.compression)
+	}
+
+	if c.key != nil {
+		encrypted, plainHash, err := c.spool(input, func(out io.Writer) (io.WriteCloser, error) {
+			return newEncryptingWriter(out, c.key)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt: %w", err)
+		}
+		compressed := encoded.spool
+		encoded.spool = encrypted
+		if err := compressed.remove(); err != nil {
+			return nil, err
+		}
+		// content which changed since it was hashed must never be uploaded under its hash
+		if plainHash != inputHash {
+			return nil, fmt.Errorf("%w: %s hashes to %s, expected %s", ErrContentChanged, file.Path(), plainHash, inputHash)
+		}
+		encodings = append(encodings, EncodingAES256GCM)
+	}
+
+	encoded.encoding = strings.Join(encodings, encodingSeparator)
+
+	return encoded, nil
+}
+
+// spool writes content transformed by transform to a temporary file. It returns the file together with
+// the tree hash of content before transformation.
+func (c *Codec) spool(content io.Reader, transform func(out io.Writer) (io.WriteCloser, error)) (_ spoolFile, contentHash string, err error) {
+	file, err := os.CreateTemp(c.spoolDir, "az-archive-*")
+	if err != nil {
+		return spoolFile{}, "", fmt.Errorf("failed to create spool file: %w", err)
+	}
+	result := spoolFile{path: file.Name()}
+	defer func() {
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = result.remove()
+		}
+	}()
+
+	outputHash := newTreeHashWriter()
+	counter := &countingWriter{}
+	transformed, err := transform(io.MultiWriter(file, outputHash, counter))
+	if err != nil {
+		return spoolFile{}, "", err
+	}
+
+	inputHash := newTreeHashWriter()
+	if _, err := io.Copy(io.MultiWriter(transformed, inputHash), content); err != nil {
+		return spoolFile{}, "", err
+	}
+	if err := transformed.Close(); err != nil {
+		return spoolFile{}, "", err
+	}
+
+	result.hash = outputHash.Sum()
+	result.size = counter.written
+
+	return result, inputHash.Sum(), nil
+}
+
+func (c *Codec) encrypts() bool {
+	return c != nil && c.key != nil
+}
+
+// SealHash encrypts hash of a file, so it can be stored together with its encrypted archive without revealing
+// anything about the content.
+func (c *Codec) SealHash(hash string) (string, error) {
+	if !c.encrypts() {
+		return "", errors.New("encryption key is required to seal a hash")
+	}
+
+	return sealText(c.key, hash)
+}
+
+// OpenHash decrypts hash sealed by SealHash.
+func (c *Codec) OpenHash(sealed string) (string, error) {
+	if !c.encrypts() {
+		return "", errors.New("hash is encrypted - encryption key is required to read it")
+	}
+
+	return openText(c.key, sealed)
+}
+
+// Decode returns decoded content of an archive stored with encoding.
+func (c *Codec) Decode(encoding string, content io.ReadCloser) (io.ReadCloser, error) {
+	if encoding == "" {
+		return c.decodeUnknown(content)
+	}
+
+	encodings := strings.Split(encoding, encodingSeparator)
+	decoded := content
+	for i := len(encodings) - 1; i >= 0; i-- {
+		reader, err := c.decoder(encodings[i], decoded)
+		if err != nil {
+			return nil, err
+		}
+		decoded = decodedContent{Reader: reader, Closer: content}
+	}
+
+	return decoded, nil
+}
+
+func (c *Codec) decoder(encoding string, content io.Reader) (io.Reader, error) {
+	switch encoding {
+	case EncodingAES256GCM:
+		if c == nil || c.key == nil {
+			return nil, errors.New("archive is encrypted - encryption key is required to restore it")
+		}
+		return newDecryptingReader(content, c.key)
+	case EncodingGzip:
+		return newDecompressingReader(content)
+	default:
+		return nil, fmt.Errorf("unsupported archive encoding: %s", encoding)
+	}
+}
+
+// decodeUnknown handles archives with encoding missing in the index, e.g. when it was recovered from inventory.
+// Archives are recognized by their headers: encrypted ones only when they were encrypted with the key.
+// Everything else is returned as is.
+func (c *Codec) decodeUnknown(content io.ReadCloser) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(content)
+	var encodings []string
+
+	if c != nil && c.key != nil {
+		header, err := buffered.Peek(len(encryptionMagic) + keyIdSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if bytes.Equal(header, append(append([]byte{}, encryptionMagic...), keyId(c.key)...)) {
+			decrypted, err := newDecryptingReader(buffered, c.key)
+			if err != nil {
+				return nil, err
+			}
+			buffered = bufio.NewReader(decrypted)
+			encodings = append(encodings, EncodingAES256GCM)
+		}
+	}
+
+	compression, err := peekCompression(buffered)
+	if err != nil {
+		return nil, err
+	}
+	if compression == "" {
+		return decodedContent{Reader: buffered, Closer: content}, nil
+	}
+
+	decompressed, err := newDecompressingReader(buffered)
+	if err != nil {
+		return nil, err
+	}
+	encodings = append(encodings, compression)
+	logger.WithComponent("archive").Debugf("Recognized archive encoded with %s", strings.Join(encodings, encodingSeparator))
+
+	return decodedContent{Reader: decompressed, Closer: content}, nil
+}
+
+type spoolFile struct {
+	path string
+	hash string
+	size int64
+}
+
+func (f spoolFile) remove() error {
+	if f.path == "" {
+		return nil
+	}
+	if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+type decodedContent struct {
+	io.Reader
+	io.Closer
+}
+
+type countingWriter struct {
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	return len(p), nil
+}
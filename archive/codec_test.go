@@ -0,0 +1,431 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/glacier"
+	. "github.com/mrdunski/accumulation-zone/gomega"
+	"github.com/mrdunski/accumulation-zone/model"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type testFile struct {
+	path    string
+	hash    string
+	content []byte
+}
+
+func newTestFile(content []byte) testFile {
+	return testFile{
+		path:    "dir/file.txt",
+		hash:    fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(content)).TreeHash),
+		content: content,
+	}
+}
+
+func (f testFile) Path() string {
+	return f.path
+}
+
+func (f testFile) Hash() string {
+	return f.hash
+}
+
+func (f testFile) Content() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+func (f testFile) Size() (int64, error) {
+	return int64(len(f.content)), nil
+}
+
+func writeKey(dir, key string) string {
+	keyFile := filepath.Join(dir, "key")
+	Expect(os.WriteFile(keyFile, []byte(key), 0600)).To(Succeed())
+	return keyFile
+}
+
+func readAll(file *EncodedFile) []byte {
+	content, err := file.Content()
+	Expect(err).NotTo(HaveOccurred())
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	Expect(err).NotTo(HaveOccurred())
+	return data
+}
+
+var _ = Describe("Codec", func() {
+	const hexKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"
+	var codec *Codec
+	var spoolDir string
+
+	BeforeEach(func() {
+		spoolDir = GinkgoT().TempDir()
+		var err error
+		codec, err = NewCodec(Options{EncryptionKeyFile: writeKey(GinkgoT().TempDir(), hexKey), SpoolDir: spoolDir})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("is disabled without key", func() {
+		disabled, err := NewCodec(Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(disabled).To(BeNil())
+
+		content, err := disabled.Decode("", io.NopCloser(strings.NewReader("plain")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(io.ReadAll(content)).To(Equal([]byte("plain")))
+
+		_, err = disabled.Decode(EncodingAES256GCM, io.NopCloser(strings.NewReader("secret")))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("loads base64 key", func() {
+		key, err := LoadKey(writeKey(GinkgoT().TempDir(), "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(HaveLen(32))
+		Expect(key[31]).To(Equal(byte(31)))
+	})
+
+	It("rejects short key", func() {
+		_, err := LoadKey(writeKey(GinkgoT().TempDir(), "0001020304"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	DescribeTable("encrypts and decrypts", func(size int) {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+		file := newTestFile(content)
+
+		encoded, err := codec.Encode(file)
+		Expect(err).NotTo(HaveOccurred())
+		defer encoded.Close()
+
+		encrypted := readAll(encoded)
+		Expect(encoded.Path()).To(Equal(file.Path()))
+		Expect(encoded.Hash()).To(Equal(file.Hash()))
+		Expect(encoded.Encoding()).To(Equal(EncodingAES256GCM))
+		Expect(encoded.Size()).To(Equal(int64(len(encrypted))))
+		Expect(encoded.ArchiveHash()).To(Equal(fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(encrypted)).TreeHash)))
+		if size > 0 {
+			Expect(bytes.Contains(encrypted, content[:size/2+1])).To(BeFalse())
+		}
+
+		decoded, err := codec.Decode(encoded.Encoding(), io.NopCloser(bytes.NewReader(encrypted)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(io.ReadAll(decoded)).To(Equal(content))
+	},
+		Entry("empty file", 0),
+		Entry("small file", 100),
+		Entry("exactly one chunk", encryptionChunkSize),
+		Entry("file bigger than tree hash chunk", 3*treeHashChunkSize+17),
+	)
+
+	It("encrypts the same content with different nonces", func() {
+		file := newTestFile([]byte("some content"))
+		first, err := codec.Encode(file)
+		Expect(err).NotTo(HaveOccurred())
+		defer first.Close()
+		second, err := codec.Encode(file)
+		Expect(err).NotTo(HaveOccurred())
+		defer second.Close()
+
+		header := len(encryptionMagic) + keyIdSize
+		Expect(readAll(first)[header : header+noncePrefixSize]).NotTo(Equal(readAll(second)[header : header+noncePrefixSize]))
+		Expect(first.ArchiveHash()).NotTo(Equal(second.ArchiveHash()))
+	})
+
+	It("seals hash", func() {
+		hash := strings.Repeat("ab", 32)
+
+		sealed, err := codec.SealHash(hash)
+		Expect(err).NotTo(HaveOccurred())
+		again, err := codec.SealHash(hash)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(sealed).NotTo(ContainSubstring(hash))
+		Expect(sealed).NotTo(Equal(again))
+		Expect(codec.OpenHash(sealed)).To(Equal(hash))
+	})
+
+	It("doesn't open hash sealed with other key", func() {
+		sealed, err := codec.SealHash("hash")
+		Expect(err).NotTo(HaveOccurred())
+		other, err := NewCodec(Options{EncryptionKeyFile: writeKey(GinkgoT().TempDir(), strings.Repeat("ab", 32))})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = other.OpenHash(sealed)
+
+		Expect(err).To(WrapError(ErrWrongKey))
+	})
+
+	It("removes encoded content on close", func() {
+		encoded, err := codec.Encode(newTestFile([]byte("some content")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadDir(spoolDir)).To(HaveLen(1))
+
+		Expect(encoded.Close()).To(Succeed())
+		Expect(os.ReadDir(spoolDir)).To(BeEmpty())
+	})
+
+	It("refuses content that doesn't match hash", func() {
+		file := newTestFile([]byte("some content"))
+		file.content = []byte("changed content")
+
+		_, err := codec.Encode(file)
+
+		Expect(err).To(WrapError(ErrContentChanged))
+		Expect(os.ReadDir(spoolDir)).To(BeEmpty())
+	})
+
+	Context("with encrypted archive", func() {
+		var encrypted []byte
+
+		BeforeEach(func() {
+			encoded, err := codec.Encode(newTestFile(bytes.Repeat([]byte("secret"), 50000)))
+			Expect(err).NotTo(HaveOccurred())
+			defer encoded.Close()
+			encrypted = readAll(encoded)
+		})
+
+		decode := func(codec *Codec, data []byte) error {
+			decoded, err := codec.Decode(EncodingAES256GCM, io.NopCloser(bytes.NewReader(data)))
+			if err != nil {
+				return err
+			}
+			_, err = io.ReadAll(decoded)
+			return err
+		}
+
+		It("recognizes archive with unknown encoding", func() {
+			decoded, err := codec.Decode("", io.NopCloser(bytes.NewReader(encrypted)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(decoded)).To(Equal(bytes.Repeat([]byte("secret"), 50000)))
+
+			plain, err := codec.Decode("", io.NopCloser(strings.NewReader("AZE")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(plain)).To(Equal([]byte("AZE")))
+		})
+
+		It("detects wrong key", func() {
+			other, err := NewCodec(Options{EncryptionKeyFile: writeKey(GinkgoT().TempDir(), strings.Repeat("ab", 32))})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(decode(other, encrypted)).To(WrapError(ErrWrongKey))
+		})
+
+		It("detects truncated archive", func() {
+			Expect(decode(codec, encrypted[:encryptionChunkSize])).To(WrapError(ErrCorrupted))
+		})
+
+		It("detects truncation at chunk boundary", func() {
+			header := len(encryptionMagic) + keyIdSize + noncePrefixSize
+			Expect(decode(codec, encrypted[:header+encryptionChunkSize+16])).To(WrapError(ErrCorrupted))
+		})
+
+		It("detects modified archive", func() {
+			encrypted[len(encrypted)/2] ^= 1
+			Expect(decode(codec, encrypted)).To(WrapError(ErrCorrupted))
+		})
+	})
+})
+
+var _ = Describe("Compression", func() {
+	var codec *Codec
+	var text []byte
+
+	BeforeEach(func() {
+		var err error
+		codec, err = NewCodec(Options{Compression: EncodingGzip, CompressionMinSaving: 10})
+		Expect(err).NotTo(HaveOccurred())
+		text = bytes.Repeat([]byte("2023-01-01 12:00:00 INFO request handled in 12ms\n"), 20000)
+	})
+
+	decode := func(codec *Codec, encoding string, data []byte) []byte {
+		decoded, err := codec.Decode(encoding, io.NopCloser(bytes.NewReader(data)))
+		Expect(err).NotTo(HaveOccurred())
+		result, err := io.ReadAll(decoded)
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	It("rejects invalid level", func() {
+		_, err := NewCodec(Options{Compression: EncodingGzip, CompressionLevel: 10})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("compresses text", func() {
+		encoded, err := codec.Encode(newTestFile(text))
+		Expect(err).NotTo(HaveOccurred())
+		defer encoded.Close()
+
+		compressed := readAll(encoded)
+		Expect(encoded.Encoding()).To(Equal(EncodingGzip))
+		Expect(len(compressed)).To(BeNumerically("<", len(text)/10))
+		Expect(encoded.ArchiveHash()).To(Equal(fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(compressed)).TreeHash)))
+		Expect(decode(codec, encoded.Encoding(), compressed)).To(Equal(text))
+		Expect(decode(nil, "", compressed)).To(Equal(text))
+	})
+
+	It("skips files with compressed extension", func() {
+		file := newTestFile(text)
+		file.path = "logs/archive.tar.GZ"
+
+		Expect(codec.Encode(file)).To(BeNil())
+	})
+
+	It("skips incompressible files", func() {
+		random := make([]byte, 100000)
+		_, err := rand.Read(random)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(codec.Encode(newTestFile(random))).To(BeNil())
+	})
+
+	It("doesn't decompress plain gzip files", func() {
+		gzipped := &bytes.Buffer{}
+		writer := gzip.NewWriter(gzipped)
+		_, err := writer.Write(text)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+
+		Expect(decode(codec, "", gzipped.Bytes())).To(Equal(gzipped.Bytes()))
+	})
+
+	It("compresses before encryption", func() {
+		keyFile := writeKey(GinkgoT().TempDir(), strings.Repeat("ab", 32))
+		codec, err := NewCodec(Options{Compression: EncodingGzip, EncryptionKeyFile: keyFile, SpoolDir: GinkgoT().TempDir()})
+		Expect(err).NotTo(HaveOccurred())
+
+		encoded, err := codec.Encode(newTestFile(text))
+		Expect(err).NotTo(HaveOccurred())
+		defer encoded.Close()
+
+		encrypted := readAll(encoded)
+		Expect(encoded.Encoding()).To(Equal("gzip+aes-256-gcm"))
+		Expect(len(encrypted)).To(BeNumerically("<", len(text)/10))
+		Expect(decode(codec, encoded.Encoding(), encrypted)).To(Equal(text))
+		Expect(decode(codec, "", encrypted)).To(Equal(text))
+		Expect(os.ReadDir(codec.spoolDir)).To(HaveLen(1))
+
+		Expect(encoded.Close()).To(Succeed())
+		Expect(os.ReadDir(codec.spoolDir)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Bundle", func() {
+	It("packs files into tar archive", func() {
+		bundle, err := (&Codec{spoolDir: GinkgoT().TempDir()}).NewBundle()
+		Expect(err).NotTo(HaveOccurred())
+		defer bundle.Close()
+
+		first := newTestFile([]byte("first file"))
+		first.path = "a/first.txt"
+		changed := newTestFile([]byte("before"))
+		changed.content = []byte("after")
+		second := newTestFile([]byte("second file"))
+		second.path = "b/second.txt"
+
+		firstOffset, firstLength, err := bundle.Add(first)
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = bundle.Add(changed)
+		Expect(err).To(WrapError(ErrContentChanged))
+		secondOffset, secondLength, err := bundle.Add(second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bundle.Seal()).To(Succeed())
+
+		content, err := bundle.Content()
+		Expect(err).NotTo(HaveOccurred())
+		defer content.Close()
+		data, err := io.ReadAll(content)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bundle.Hash()).To(Equal(fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(data)).TreeHash)))
+		Expect(bundle.Path()).To(HavePrefix(BundlePathPrefix))
+		Expect(string(data[firstOffset : firstOffset+firstLength])).To(Equal("first file"))
+		Expect(string(data[secondOffset : secondOffset+secondLength])).To(Equal("second file"))
+
+		reader := tar.NewReader(bytes.NewReader(data))
+		var names []string
+		for header, err := reader.Next(); err == nil; header, err = reader.Next() {
+			names = append(names, header.Name)
+			Expect(header.ModTime.Unix()).To(BeZero())
+		}
+		Expect(names).To(HaveLen(3))
+		Expect(names[:2]).To(Equal([]string{first.hash, second.hash}))
+
+		offset, length, encoding := bundle.Manifest()
+		Expect(encoding).To(BeEmpty())
+		entries, err := (*Codec)(nil).ReadBundleManifest(encoding, io.NopCloser(bytes.NewReader(data[offset:offset+length])))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(Equal([]BundleEntry{
+			{Path: "a/first.txt", Hash: first.hash, Offset: firstOffset, Length: firstLength},
+			{Path: "b/second.txt", Hash: second.hash, Offset: secondOffset, Length: secondLength},
+		}))
+	})
+
+	It("keeps paths in encrypted manifest", func() {
+		keyFile := writeKey(GinkgoT().TempDir(), strings.Repeat("ab", 32))
+		codec, err := NewCodec(Options{EncryptionKeyFile: keyFile, SpoolDir: GinkgoT().TempDir()})
+		Expect(err).NotTo(HaveOccurred())
+		bundle, err := codec.NewBundle()
+		Expect(err).NotTo(HaveOccurred())
+		defer bundle.Close()
+
+		file := newTestFile([]byte("secret file"))
+		file.path = "private/first.txt"
+		encoded, err := codec.Encode(file)
+		Expect(err).NotTo(HaveOccurred())
+		defer encoded.Close()
+		fileOffset, fileLength, err := bundle.Add(encoded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bundle.Seal()).To(Succeed())
+
+		content, err := bundle.Content()
+		Expect(err).NotTo(HaveOccurred())
+		defer content.Close()
+		data, err := io.ReadAll(content)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).NotTo(ContainSubstring("private"))
+
+		offset, length, encoding := bundle.Manifest()
+		Expect(encoding).To(Equal(EncodingAES256GCM))
+		entries, err := codec.ReadBundleManifest(encoding, io.NopCloser(bytes.NewReader(data[offset:offset+length])))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(Equal([]BundleEntry{
+			{Path: "private/first.txt", Hash: file.hash, Encoding: EncodingAES256GCM, Offset: fileOffset, Length: fileLength},
+		}))
+	})
+})
+
+var _ = Describe("VerifyTreeHash", func() {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100000)
+
+	It("passes content matching its hash", func() {
+		file := newTestFile(content)
+
+		data, err := io.ReadAll(VerifyTreeHash(io.NopCloser(bytes.NewReader(content)), file.Hash()))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(content))
+	})
+
+	It("fails at the end of corrupted content", func() {
+		file := newTestFile(content)
+		corrupted := append([]byte{}, content...)
+		corrupted[len(corrupted)-1] = '!'
+
+		_, err := io.ReadAll(VerifyTreeHash(io.NopCloser(bytes.NewReader(corrupted)), file.Hash()))
+
+		Expect(err).To(WrapError(model.ErrTreeHashMismatch))
+	})
+})
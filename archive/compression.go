@@ -0,0 +1,137 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/mrdunski/accumulation-zone/model"
+	"github.com/mrdunski/accumulation-zone/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// EncodingGzip marks archives compressed with gzip.
+const EncodingGzip = "gzip"
+
+const (
+	gzipAlgorithm = byte(1)
+	// compression of a file is decided on its beginning
+	compressionSampleSize = 256 * 1024
+)
+
+// compressionMagic starts every compressed archive, followed by algorithm id. It makes archives recognizable
+// without the index and doesn't let plain .gz files to be mistaken for compressed archives.
+var compressionMagic = []byte("AZZ1")
+
+var (
+	compressionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: telemetry.Namespace,
+		Name:      "archive_compression_count",
+	}, []string{"result"})
+	compressedCounter            = compressionCounter.With(prometheus.Labels{"result": "compressed"})
+	skippedExtensionCounter      = compressionCounter.With(prometheus.Labels{"result": "skipped_extension"})
+	skippedIncompressibleCounter = compressionCounter.With(prometheus.Labels{"result": "skipped_ratio"})
+)
+
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true, ".epub": true, ".flac": true,
+	".gif": true, ".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".lz4": true, ".lzma": true,
+	".m4a": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".odt": true, ".ods": true, ".ogg": true,
+	".png": true, ".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true, ".xlsx": true, ".xz": true,
+	".zip": true, ".zst": true,
+}
+
+func (c *Codec) shouldCompress(file model.FileWithContent) (_ bool, err error) {
+	if c.compression == "" {
+		return false, nil
+	}
+	if compressedExtensions[strings.ToLower(path.Ext(file.Path()))] {
+		skippedExtensionCounter.Inc()
+		return false, nil
+	}
+
+	content, err := file.Content()
+	if err != nil {
+		return false, err
+	}
+	defer func(content io.ReadCloser) {
+		closeErr := content.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}(content)
+
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(content, sample)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+
+	compressed := &countingWriter{}
+	writer, err := gzip.NewWriterLevel(compressed, c.level)
+	if err != nil {
+		return false, err
+	}
+	if _, err := writer.Write(sample[:n]); err != nil {
+		return false, err
+	}
+	if err := writer.Close(); err != nil {
+		return false, err
+	}
+
+	if compressed.written*100 > int64(n)*int64(100-c.minSaving) {
+		skippedIncompressibleCounter.Inc()
+		return false, nil
+	}
+
+	compressedCounter.Inc()
+	return true, nil
+}
+
+func newCompressingWriter(out io.Writer, level int) (io.WriteCloser, error) {
+	if _, err := out.Write(append(append([]byte{}, compressionMagic...), gzipAlgorithm)); err != nil {
+		return nil, err
+	}
+
+	return gzip.NewWriterLevel(out, level)
+}
+
+func newDecompressingReader(in io.Reader) (io.Reader, error) {
+	header := make([]byte, len(compressionMagic)+1)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, fmt.Errorf("can't read compression header: %w", err)
+	}
+	if !bytes.Equal(header[:len(compressionMagic)], compressionMagic) || header[len(compressionMagic)] != gzipAlgorithm {
+		return nil, errors.New("unknown compression format")
+	}
+
+	reader, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("can't read gzip stream: %w", err)
+	}
+	reader.Multistream(false)
+
+	return reader, nil
+}
+
+// peekCompression returns compression of content when it starts with a compression header.
+func peekCompression(content *bufio.Reader) (string, error) {
+	gzipMagic := []byte{0x1f, 0x8b}
+	header, err := content.Peek(len(compressionMagic) + 1 + len(gzipMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	expected := append(append(append([]byte{}, compressionMagic...), gzipAlgorithm), gzipMagic...)
+	if bytes.Equal(header, expected) {
+		return EncodingGzip, nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,48 @@
+package archive
+
+import (
+	"io"
+	"os"
+
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+// EncodedFile is a file encoded by Codec. Path and Hash are taken from the original file,
+// Content and Size describe the encoded archive.
+type EncodedFile struct {
+	model.FileWithContent
+	spool    spoolFile
+	encoding string
+}
+
+func (f *EncodedFile) Content() (io.ReadCloser, error) {
+	return os.Open(f.spool.path)
+}
+
+func (f *EncodedFile) Size() (int64, error) {
+	return f.spool.size, nil
+}
+
+// ArchiveHash is the tree hash of encoded content.
+func (f *EncodedFile) ArchiveHash() string {
+	return f.spool.hash
+}
+
+// Encoding lists encodings in the order they were applied, e.g. gzip+aes-256-gcm.
+func (f *EncodedFile) Encoding() string {
+	return f.encoding
+}
+
+// Stat returns attributes of the original file.
+func (f *EncodedFile) Stat() (os.FileInfo, error) {
+	if original, ok := f.FileWithContent.(model.StatHolder); ok {
+		return original.Stat()
+	}
+
+	return nil, model.ErrStatUnknown
+}
+
+// Close removes encoded content.
+func (f *EncodedFile) Close() error {
+	return f.spool.remove()
+}
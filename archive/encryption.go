@@ -0,0 +1,294 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// EncodingAES256GCM marks archives encrypted with AES-256-GCM.
+const EncodingAES256GCM = "aes-256-gcm"
+
+const (
+	keySize         = 32
+	keyIdSize       = 8
+	noncePrefixSize = 7
+	// plaintext is sealed in chunks, so archives of any size can be streamed and every chunk is authenticated
+	encryptionChunkSize = 64 * 1024
+)
+
+var encryptionMagic = []byte("AZE1")
+
+var (
+	// ErrWrongKey is returned when an archive was encrypted with a different key.
+	ErrWrongKey = errors.New("archive was encrypted with a different key")
+	// ErrCorrupted is returned when encrypted content is truncated or was modified.
+	ErrCorrupted = errors.New("encrypted archive is corrupted")
+)
+
+// LoadKey reads an AES-256 key from a file. The key is expected to be hex or base64 encoded,
+// e.g. generated with `openssl rand -hex 32`.
+func LoadKey(filePath string) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("key file %s must contain %d bytes encoded as hex or base64", filePath, keySize)
+}
+
+func keyId(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("az key id"))
+	return mac.Sum(nil)[:keyIdSize]
+}
+
+// noncePrefix is random for every archive and stored in its header, so a nonce is never reused for different
+// content, even when a file changes while it is encrypted, and identical files aren't recognizable in the vault.
+func noncePrefix() ([]byte, error) {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return prefix, nil
+}
+
+// textKey is derived from the key, so short texts sealed with random nonces never share nonces with archives.
+func textKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("az text key"))
+	return mac.Sum(nil)
+}
+
+// sealText encrypts a short text, e.g. a hash stored in an archive description, with a random nonce.
+func sealText(key []byte, text string) (string, error) {
+	aead, err := newGCM(textKey(key))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(text), nil)), nil
+}
+
+func openText(key []byte, sealed string) (string, error) {
+	aead, err := newGCM(textKey(key))
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: sealed text is malformed", ErrCorrupted)
+	}
+	text, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrWrongKey
+	}
+
+	return string(text), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint64, last bool) ([]byte, error) {
+	if counter > math.MaxUint32 {
+		return nil, errors.New("content is too big to be encrypted")
+	}
+
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(counter))
+	if last {
+		return append(nonce, 1), nil
+	}
+
+	return append(nonce, 0), nil
+}
+
+// encryptingWriter writes header followed by sealed chunks. Every chunk but the last one is full,
+// the last one is marked in its nonce, so truncated archives are detected on decryption.
+// The header is authenticated together with every chunk.
+type encryptingWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	buffer  []byte
+	counter uint64
+}
+
+func newEncryptingWriter(out io.Writer, key []byte) (*encryptingWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := noncePrefix()
+	if err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, encryptionMagic...), keyId(key)...), prefix...)
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		out:    out,
+		aead:   aead,
+		header: header,
+		prefix: prefix,
+		buffer: make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := encryptionChunkSize - len(w.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buffer = append(w.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+
+		// full chunks are sealed right away, so the last chunk is always shorter and may be empty
+		if len(w.buffer) == encryptionChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close writes the last chunk. It doesn't close the underlying writer.
+func (w *encryptingWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *encryptingWriter) seal(last bool) error {
+	nonce, err := chunkNonce(w.prefix, w.counter, last)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.out.Write(w.aead.Seal(nil, nonce, w.buffer, w.header)); err != nil {
+		return err
+	}
+	w.counter++
+	w.buffer = w.buffer[:0]
+
+	return nil
+}
+
+type decryptingReader struct {
+	in        io.Reader
+	aead      cipher.AEAD
+	header    []byte
+	prefix    []byte
+	chunk     []byte
+	plaintext []byte
+	counter   uint64
+	done      bool
+}
+
+func newDecryptingReader(in io.Reader, key []byte) (*decryptingReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptionMagic)+keyIdSize+noncePrefixSize)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, fmt.Errorf("%w: can't read header: %v", ErrCorrupted, err)
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return nil, fmt.Errorf("%w: unknown format", ErrCorrupted)
+	}
+	if !bytes.Equal(header[len(encryptionMagic):len(encryptionMagic)+keyIdSize], keyId(key)) {
+		return nil, ErrWrongKey
+	}
+
+	return &decryptingReader{
+		in:     in,
+		aead:   aead,
+		header: header,
+		prefix: header[len(encryptionMagic)+keyIdSize:],
+		chunk:  make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+
+	return n, nil
+}
+
+func (r *decryptingReader) open() error {
+	n, err := io.ReadFull(r.in, r.chunk)
+	last := errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+	if err != nil && !last {
+		return err
+	}
+	if n < r.aead.Overhead() {
+		return fmt.Errorf("%w: unexpected end of content", ErrCorrupted)
+	}
+
+	nonce, err := chunkNonce(r.prefix, r.counter, last)
+	if err != nil {
+		return err
+	}
+	plaintext, err := r.aead.Open(r.chunk[:0], nonce, r.chunk[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d can't be decrypted", ErrCorrupted, r.counter)
+	}
+
+	r.plaintext = plaintext
+	r.counter++
+	r.done = last
+
+	return nil
+}
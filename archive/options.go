@@ -0,0 +1,51 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+)
+
+const compressionNone = "none"
+
+type Options struct {
+	EncryptionKeyFile    string `env:"ENCRYPTION_KEY_FILE" help:"File with 256-bit key (hex or base64 encoded) used to encrypt archives before upload. Archives can't be restored without it - keep a copy outside of the backup." optional:"" type:"path" group:"Archive"`
+	Compression          string `env:"COMPRESSION" help:"Compression of archives before upload. Already compressed files are uploaded as they are." enum:"none,gzip" default:"none" group:"Archive"`
+	CompressionLevel     int    `env:"COMPRESSION_LEVEL" help:"Compression level from 1 (fastest) to 9 (smallest archives)." default:"6" group:"Archive"`
+	CompressionMinSaving int    `env:"COMPRESSION_MIN_SAVING" help:"Files are uploaded uncompressed when a sample of their content shrinks by less than this percent." default:"10" group:"Archive"`
+	SpoolDir             string `env:"SPOOL_DIR" help:"Directory where encoded archives are kept until they are uploaded. Defaults to system temporary directory." optional:"" type:"path" group:"Archive"`
+}
+
+func (o Options) validate() error {
+	if o.CompressionLevel != 0 && (o.CompressionLevel < gzip.BestSpeed || o.CompressionLevel > gzip.BestCompression) {
+		return fmt.Errorf("invalid compression level %d: must be between %d and %d", o.CompressionLevel, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if o.CompressionMinSaving < 0 || o.CompressionMinSaving > 100 {
+		return fmt.Errorf("invalid compression min saving %d: must be a percent", o.CompressionMinSaving)
+	}
+	switch o.compression() {
+	case "", EncodingGzip:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression: %s", o.Compression)
+	}
+}
+
+func (o Options) enabled() bool {
+	return o.EncryptionKeyFile != "" || o.compression() != ""
+}
+
+func (o Options) compression() string {
+	if o.Compression == compressionNone {
+		return ""
+	}
+
+	return o.Compression
+}
+
+func (o Options) compressionLevel() int {
+	if o.CompressionLevel == 0 {
+		return gzip.DefaultCompression
+	}
+
+	return o.CompressionLevel
+}
@@ -0,0 +1,83 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+const treeHashChunkSize = 1024 * 1024
+
+// treeHashWriter computes Glacier tree hash of everything written to it.
+type treeHashWriter struct {
+	hashes  [][]byte
+	current hash.Hash
+	filled  int
+}
+
+func newTreeHashWriter() *treeHashWriter {
+	return &treeHashWriter{current: sha256.New()}
+}
+
+func (w *treeHashWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := treeHashChunkSize - w.filled
+		if n > len(p) {
+			n = len(p)
+		}
+		w.current.Write(p[:n])
+		w.filled += n
+		p = p[n:]
+
+		if w.filled == treeHashChunkSize {
+			w.hashes = append(w.hashes, w.current.Sum(nil))
+			w.current.Reset()
+			w.filled = 0
+		}
+	}
+
+	return written, nil
+}
+
+// Sum returns hex encoded tree hash. It is empty when nothing was written, the same way as for empty files.
+func (w *treeHashWriter) Sum() string {
+	hashes := w.hashes
+	if w.filled > 0 {
+		hashes = append(hashes, w.current.Sum(nil))
+	}
+	if len(hashes) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", glacier.ComputeTreeHash(hashes))
+}
+
+// verifyingReader checks the tree hash of content once it is read to the end.
+type verifyingReader struct {
+	io.ReadCloser
+	hash     *treeHashWriter
+	expected string
+}
+
+// VerifyTreeHash returns content which fails with model.ErrTreeHashMismatch instead of io.EOF, when everything
+// read from it doesn't match expected tree hash.
+func VerifyTreeHash(content io.ReadCloser, expected string) io.ReadCloser {
+	return &verifyingReader{ReadCloser: content, hash: newTreeHashWriter(), expected: expected}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	_, _ = r.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := r.hash.Sum(); sum != r.expected {
+			return n, fmt.Errorf("%w: content hashes to %s, expected %s", model.ErrTreeHashMismatch, sum, r.expected)
+		}
+	}
+
+	return n, err
+}
@@ -2,12 +2,14 @@ package commit
 
 import (
 	"fmt"
+	"github.com/mrdunski/accumulation-zone/index"
 	"github.com/mrdunski/accumulation-zone/logger"
 	"github.com/mrdunski/accumulation-zone/volume"
 )
 
 type Cmd struct {
 	volume.Volume
+	index.DeletionLimits
 	IUnderstandConsequencesOfForceCommit bool `required:"" hidden:""`
 }
 
@@ -17,6 +19,9 @@ func (c Cmd) Run() error {
 	if err != nil {
 		return err
 	}
+	if err := idx.GuardDeletions(changes.Deletions, c.DeletionLimits); err != nil {
+		return err
+	}
 	for _, change := range changes.Deletions {
 		err := idx.CommitDelete(change.ChangeId(), change)
 		if err != nil {
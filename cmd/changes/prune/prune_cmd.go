@@ -0,0 +1,45 @@
+package prune
+
+import (
+	"fmt"
+
+	"github.com/mrdunski/accumulation-zone/glacier"
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/volume"
+)
+
+type Cmd struct {
+	volume.Volume
+	glacier.VaultConfig
+	DryRun bool `help:"Only lists versions and deleted files which would be pruned." optional:""`
+}
+
+func (c Cmd) Run() error {
+	logger.Get().Info("Pruning expired versions and deleted files")
+
+	idx, err := c.CreateIndex()
+	if err != nil {
+		return err
+	}
+
+	pruned := idx.Prunable()
+	if c.DryRun {
+		fmt.Println("Expired versions and deleted files:")
+		for _, deletion := range pruned {
+			fmt.Printf("- %v\n", deletion)
+		}
+		logger.Get().Infof("Done. %d files would be pruned.", len(pruned))
+		return nil
+	}
+
+	connection, err := glacier.OpenConnection(c.VaultConfig)
+	if err != nil {
+		return fmt.Errorf("failed to open connection to backup: %w", err)
+	}
+	if err := connection.ProcessDeletions(idx, pruned); err != nil {
+		return fmt.Errorf("failed to prune: %w", err)
+	}
+
+	logger.Get().Infof("Done. Pruned: %d.", len(pruned))
+	return nil
+}
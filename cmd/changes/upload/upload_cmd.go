@@ -1,34 +1,98 @@
 package upload
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/mrdunski/accumulation-zone/archive"
 	"github.com/mrdunski/accumulation-zone/glacier"
+	"github.com/mrdunski/accumulation-zone/index"
 	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
 	"github.com/mrdunski/accumulation-zone/volume"
 )
 
 type Cmd struct {
 	volume.Volume
 	glacier.VaultConfig
+	glacier.UploadOptions
+	archive.Options
+	index.DeletionLimits
 }
 
 func (c Cmd) Run() error {
 	logger.Get().Info("Uploading local changes")
 
-	changes, idx, err := c.GetChanges()
+	connection, err := glacier.OpenConnection(c.VaultConfig)
 	if err != nil {
+		return fmt.Errorf("failed to open connection to backup: %w", err)
+	}
+	if err := connection.ConfigureUpload(c.UploadOptions); err != nil {
+		return fmt.Errorf("invalid upload options: %w", err)
+	}
+	codec, err := archive.NewCodec(c.Options)
+	if err != nil {
+		return fmt.Errorf("invalid archive options: %w", err)
+	}
+	connection.ConfigureArchive(codec)
+	if err := connection.OpenUploadJournal(c.UploadJournalFile()); err != nil {
 		return err
 	}
-	connection, err := glacier.OpenConnection(c.VaultConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, idx, err := c.StreamChanges(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to open connection to backup: %w", err)
+		return err
+	}
+
+	findDeletions := changes.Deletions
+	changes.Deletions = func() ([]model.FileDeleted, error) {
+		deletions, err := findDeletions()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := idx.GuardDeletions(deletions, c.DeletionLimits); err != nil {
+			return nil, err
+		}
+
+		return deletions, nil
 	}
-	err = connection.Process(idx, changes)
+
+	committer := &countingCommitter{ChangeCommitter: idx}
+	err = connection.ProcessStream(committer, changes)
 	if err != nil {
 		return fmt.Errorf("failed to process changes: %w", err)
 	}
 
-	logger.Get().Infof("Done. Added: %d, deleted: %d.", len(changes.Additions), len(changes.Deletions))
+	logger.Get().Infof("Done. Added: %d, deleted: %d, kept as deleted: %d.", committer.added, committer.deleted, committer.tombstoned)
+	return nil
+}
+
+type countingCommitter struct {
+	model.ChangeCommitter
+	added      int
+	deleted    int
+	tombstoned int
+}
+
+func (c *countingCommitter) CommitAdd(changeId string, changed model.HashedFile) error {
+	if err := c.ChangeCommitter.CommitAdd(changeId, changed); err != nil {
+		return err
+	}
+	c.added++
+	return nil
+}
+
+func (c *countingCommitter) CommitDelete(changeId string, changed model.HashedFile) error {
+	if err := c.ChangeCommitter.CommitDelete(changeId, changed); err != nil {
+		return err
+	}
+	if deleted, ok := changed.(model.FileDeleted); ok && deleted.Tombstone {
+		c.tombstoned++
+		return nil
+	}
+	c.deleted++
 	return nil
 }
@@ -0,0 +1,90 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictKeepBoth  = "keep-both"
+	conflictFail      = "fail"
+)
+
+// ErrRestoreConflict is returned when restored files would overwrite local files changed after the backup.
+var ErrRestoreConflict = errors.New("restore conflicts with local changes")
+
+// conflictsOf returns files to recover which exist locally with other content, e.g. because they were modified
+// after the backup.
+func conflictsOf(filesToRecover model.IdentifiableHashedFiles, changes model.Changes) model.HashedFiles {
+	conflicts := model.HashedFiles{}
+	for _, addition := range changes.Additions {
+		if _, ok := filesToRecover[addition.Path()]; ok {
+			conflicts.Replace(addition)
+		}
+	}
+
+	return conflicts
+}
+
+// resolveConflicts reports conflicts and applies the conflict policy. It returns files to recover.
+func (c DataCmd) resolveConflicts(filesToRecover model.IdentifiableHashedFiles, conflicts model.HashedFiles) (model.IdentifiableHashedFiles, error) {
+	if len(conflicts) == 0 {
+		return filesToRecover, nil
+	}
+
+	log := logger.Get().WithField("conflicts", len(conflicts)).WithField("policy", c.OnConflict)
+	for _, conflict := range conflicts {
+		log.Warnf("Local file %s differs from the restored version", conflict.Path())
+	}
+
+	switch c.OnConflict {
+	case conflictFail:
+		log.Errorf("Refusing to overwrite %d local files. Use --on-conflict=overwrite, skip or keep-both (RESTORE_CONFLICT).", len(conflicts))
+		return nil, fmt.Errorf("%w: %d files", ErrRestoreConflict, len(conflicts))
+	case conflictSkip:
+		result := model.IdentifiableHashedFiles{}
+		for p, file := range filesToRecover {
+			if _, ok := conflicts[p]; !ok {
+				result.Replace(file)
+			}
+		}
+		log.Warnf("Skipping %d files which were changed locally", len(conflicts))
+		return result, nil
+	case conflictKeepBoth:
+		log.Warnf("Restoring %d files next to local ones, with %s suffix", len(conflicts), c.ConflictSuffix)
+	default:
+		log.Warnf("Overwriting %d local files", len(conflicts))
+	}
+
+	return filesToRecover, nil
+}
+
+// keptBothPath returns a free path next to p in dir, with suffix added before the extension of the file,
+// e.g. report.restored.xlsx or report.restored-2.xlsx.
+func keptBothPath(dir, p, suffix string) string {
+	for n := 1; ; n++ {
+		candidate := keptBothCandidate(p, suffix, n)
+		if _, err := os.Lstat(path.Join(dir, candidate)); errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+	}
+}
+
+// keptBothCandidate is the n-th path tried by keptBothPath.
+func keptBothCandidate(p, suffix string, n int) string {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	if n == 1 {
+		return base + suffix + ext
+	}
+
+	return fmt.Sprintf("%s%s-%d%s", base, suffix, n, ext)
+}
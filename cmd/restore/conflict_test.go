@@ -0,0 +1,141 @@
+package restore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrdunski/accumulation-zone/index"
+	"github.com/mrdunski/accumulation-zone/model"
+	"github.com/mrdunski/accumulation-zone/volume"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type testFile struct {
+	path    string
+	content string
+}
+
+func (f testFile) Path() string {
+	return f.path
+}
+
+func (f testFile) Hash() string {
+	return "hash of " + f.content
+}
+
+func (f testFile) Content() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(f.content)), nil
+}
+
+func (f testFile) Size() (int64, error) {
+	return int64(len(f.content)), nil
+}
+
+func writeFiles(dir string, contents map[string]string) {
+	for p, content := range contents {
+		Expect(os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0700)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, p), []byte(content), 0600)).To(Succeed())
+	}
+}
+
+func readFile(dir, p string) string {
+	data, err := os.ReadFile(filepath.Join(dir, p))
+	Expect(err).NotTo(HaveOccurred())
+	return string(data)
+}
+
+var _ = Describe("Conflicts", func() {
+	var filesToRecover model.IdentifiableHashedFiles
+	var conflicts model.HashedFiles
+
+	BeforeEach(func() {
+		filesToRecover = model.IdentifiableHashedFiles{}
+		filesToRecover.Replace(index.NewEntry("changed.txt", "backup", "archive1"))
+		filesToRecover.Replace(index.NewEntry("missing.txt", "backup", "archive2"))
+		conflicts = conflictsOf(filesToRecover, model.Changes{Additions: []model.FileAdded{
+			{FileWithContent: testFile{path: "changed.txt", content: "local"}},
+			{FileWithContent: testFile{path: "new.txt", content: "local"}},
+		}})
+	})
+
+	It("finds local files which differ from restored ones", func() {
+		Expect(conflicts).To(HaveLen(1))
+		Expect(conflicts).To(HaveKey("changed.txt"))
+	})
+
+	DescribeTable("applies the policy", func(policy string, expected ...string) {
+		cmd := DataCmd{RestoreOptions: RestoreOptions{OnConflict: policy}}
+
+		result, err := cmd.resolveConflicts(filesToRecover, conflicts)
+
+		Expect(err).NotTo(HaveOccurred())
+		var paths []string
+		for p := range result {
+			paths = append(paths, p)
+		}
+		Expect(paths).To(ConsistOf(expected))
+	},
+		Entry("overwrite", conflictOverwrite, "changed.txt", "missing.txt"),
+		Entry("skip", conflictSkip, "missing.txt"),
+		Entry("keep-both", conflictKeepBoth, "changed.txt", "missing.txt"),
+	)
+
+	It("fails before anything is restored", func() {
+		cmd := DataCmd{RestoreOptions: RestoreOptions{OnConflict: conflictFail}}
+
+		result, err := cmd.resolveConflicts(filesToRecover, conflicts)
+
+		Expect(err).To(MatchError(ErrRestoreConflict))
+		Expect(result).To(BeEmpty())
+	})
+
+	It("restores everything when there are no conflicts", func() {
+		cmd := DataCmd{RestoreOptions: RestoreOptions{OnConflict: conflictFail}}
+
+		result, err := cmd.resolveConflicts(filesToRecover, model.HashedFiles{})
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(2))
+	})
+
+	DescribeTable("finds a free path to keep both files", func(p string, existing []string, expected string) {
+		dir := GinkgoT().TempDir()
+		contents := map[string]string{}
+		for _, e := range existing {
+			contents[e] = "existing"
+		}
+		writeFiles(dir, contents)
+
+		Expect(keptBothPath(dir, p, ".restored")).To(Equal(expected))
+	},
+		Entry("with suffix", "docs/report.xlsx", nil, "docs/report.restored.xlsx"),
+		Entry("without extension", "docs/README", nil, "docs/README.restored"),
+		Entry("when suffixed path is taken", "docs/report.xlsx", []string{"docs/report.restored.xlsx"}, "docs/report.restored-2.xlsx"),
+		Entry("when numbered path is taken", "docs/report.xlsx", []string{"docs/report.restored.xlsx", "docs/report.restored-2.xlsx"}, "docs/report.restored-3.xlsx"),
+	)
+
+	It("saves conflicted file next to the local one", func() {
+		target := GinkgoT().TempDir()
+		writeFiles(target, map[string]string{"docs/report.xlsx": "local", "docs/report.restored.xlsx": "restored before"})
+		cmd := DataCmd{Volume: volume.Volume{Path: target}, RestoreOptions: RestoreOptions{OnConflict: conflictKeepBoth, ConflictSuffix: ".restored"}}
+
+		Expect(cmd.save(testFile{path: "docs/report.xlsx", content: "restored"}, true)).To(Succeed())
+
+		Expect(readFile(target, "docs/report.xlsx")).To(Equal("local"))
+		Expect(readFile(target, "docs/report.restored.xlsx")).To(Equal("restored before"))
+		Expect(readFile(target, "docs/report.restored-2.xlsx")).To(Equal("restored"))
+	})
+
+	It("overwrites conflicted file", func() {
+		target := GinkgoT().TempDir()
+		writeFiles(target, map[string]string{"docs/report.xlsx": "local"})
+		cmd := DataCmd{Volume: volume.Volume{Path: target}, RestoreOptions: RestoreOptions{OnConflict: conflictOverwrite, ConflictSuffix: ".restored"}}
+
+		Expect(cmd.save(testFile{path: "docs/report.xlsx", content: "restored"}, true)).To(Succeed())
+
+		Expect(readFile(target, "docs/report.xlsx")).To(Equal("restored"))
+	})
+})
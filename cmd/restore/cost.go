@@ -0,0 +1,66 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mrdunski/accumulation-zone/glacier"
+	"github.com/mrdunski/accumulation-zone/logger"
+)
+
+// ErrRestoreCostExceeded is returned when retrieval jobs of a restore are estimated to cost more than allowed.
+var ErrRestoreCostExceeded = errors.New("estimated restore cost exceeds the limit")
+
+// guardCost checks the estimated cost of retrieval jobs in the selected tier against MaxRestoreCost. Jobs above
+// the limit are created only when the cost is confirmed. Archives of unknown size are not included in the cost,
+// they are only warned about.
+func (c DataCmd) guardCost(plan *glacier.RestorePlan) error {
+	estimate := plan.Estimate(c.Tier)
+	if estimate.UnknownSizes > 0 {
+		logger.Get().Warnf("Sizes of %d archives are unknown, so their retrieval is not included in the estimated cost. "+
+			"Review the plan with --plan.", estimate.UnknownSizes)
+	}
+	if c.withinCostLimit(estimate.Cost()) {
+		return nil
+	}
+
+	log := logger.Get().
+		WithField("tier", c.Tier).
+		WithField("cost", fmt.Sprintf("%.2f", estimate.Cost())).
+		WithField("limit", fmt.Sprintf("%.2f", c.MaxRestoreCost))
+	plan.ReportEstimates()
+	if c.ConfirmCost {
+		log.Warnf("Creating %d retrieval jobs as their cost is confirmed", estimate.Jobs)
+		return nil
+	}
+	log.Errorf("Refusing to create %d retrieval jobs estimated to cost $%.2f, more than $%.2f. "+
+		"Review the plan with --plan, choose a cheaper --tier or run with --confirm-cost (CONFIRM_RESTORE_COST=true).",
+		estimate.Jobs, estimate.Cost(), c.MaxRestoreCost)
+
+	return fmt.Errorf("%w: $%.2f", ErrRestoreCostExceeded, estimate.Cost())
+}
+
+// guardRecreations returns a guard of retrieval jobs recreated during the restore. Cost of recreated jobs is added
+// to the estimate of the plan and checked against the same limit.
+func (c DataCmd) guardRecreations(plan *glacier.RestorePlan) func(estimate glacier.RetrievalEstimate) error {
+	cost := plan.Estimate(c.Tier).Cost()
+
+	return func(recreated glacier.RetrievalEstimate) error {
+		cost += recreated.Cost()
+		if c.ConfirmCost || c.withinCostLimit(cost) {
+			return nil
+		}
+		logger.Get().
+			WithField("tier", c.Tier).
+			WithField("cost", fmt.Sprintf("%.2f", cost)).
+			WithField("limit", fmt.Sprintf("%.2f", c.MaxRestoreCost)).
+			Errorf("Refusing to recreate retrieval job, as the restore would cost more than $%.2f. "+
+				"Run with --confirm-cost (CONFIRM_RESTORE_COST=true) to recreate it.", c.MaxRestoreCost)
+
+		return fmt.Errorf("%w: $%.2f with recreated jobs", ErrRestoreCostExceeded, cost)
+	}
+}
+
+func (c DataCmd) withinCostLimit(cost float64) bool {
+	return c.MaxRestoreCost <= 0 || cost <= c.MaxRestoreCost
+}
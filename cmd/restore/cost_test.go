@@ -0,0 +1,60 @@
+package restore
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	awsGlacier "github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/glacier"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Restore cost", func() {
+	const gib = int64(1 << 30)
+	var cmd DataCmd
+
+	BeforeEach(func() {
+		cmd = DataCmd{}
+		cmd.Tier = glacier.TierExpedited
+		cmd.MaxRestoreCost = 10
+	})
+
+	It("allows jobs within the limit", func() {
+		plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{{ArchiveId: "archive1", Size: gib}}}
+
+		Expect(cmd.guardCost(plan)).To(Succeed())
+	})
+
+	It("doesn't refuse archives of unknown size", func() {
+		plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{{ArchiveId: "archive1"}, {ArchiveId: "archive2", Size: gib}}}
+
+		Expect(cmd.guardCost(plan)).To(Succeed())
+	})
+
+	It("refuses jobs above the limit", func() {
+		plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{{ArchiveId: "archive1", Size: 1000 * gib}}}
+
+		Expect(cmd.guardCost(plan)).To(MatchError(ErrRestoreCostExceeded))
+	})
+
+	It("allows confirmed cost", func() {
+		cmd.ConfirmCost = true
+		plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{{ArchiveId: "archive1", Size: 1000 * gib}}}
+
+		Expect(cmd.guardCost(plan)).To(Succeed())
+	})
+
+	It("doesn't count archives with jobs", func() {
+		job := &awsGlacier.JobDescription{JobId: aws.String("job1"), StatusCode: aws.String("Succeeded")}
+		plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{{ArchiveId: "archive1", Size: 1000 * gib, Job: job}}}
+
+		Expect(cmd.guardCost(plan)).To(Succeed())
+	})
+
+	It("refuses recreations above the limit", func() {
+		plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{{ArchiveId: "archive1", Size: 300 * gib}}}
+		guard := cmd.guardRecreations(plan)
+
+		Expect(guard(glacier.RetrievalEstimate{Tier: cmd.Tier, UnknownSizes: 1})).To(Succeed())
+		Expect(guard(glacier.RetrievalEstimate{Tier: cmd.Tier, RetrievalCost: 2})).To(MatchError(ErrRestoreCostExceeded))
+	})
+})
@@ -0,0 +1,62 @@
+package restore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+var asOfLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+type RestoreOptions struct {
+	AsOf     string   `env:"AS_OF" help:"Restores files as they were at this time, e.g. 2023-01-02 or 2023-01-02T15:04:05Z. Dates without time zone are in local time." optional:"" group:"Restore"`
+	Deleted  bool     `env:"RECOVER_DELETED" help:"Recovers also deleted files which are still kept in Glacier." optional:"" group:"Restore"`
+	Includes []string `name:"restore-include" env:"RESTORE_INCLUDES" help:"Restores only files matching any of these globs, e.g. projects/acme or finance/**/*.xlsx. Patterns without a slash match names at any depth." optional:"" sep:"," group:"Restore"`
+	Excludes []string `name:"restore-exclude" env:"RESTORE_EXCLUDES" help:"Doesn't restore files matching any of these globs." optional:"" sep:"," group:"Restore"`
+
+	OnConflict     string `env:"RESTORE_CONFLICT" help:"What to do when a local file differs from the restored version: overwrite, skip, keep-both (restore next to it with a suffix) or fail before anything is restored." default:"fail" enum:"overwrite,skip,keep-both,fail" group:"Restore"`
+	ConflictSuffix string `env:"RESTORE_CONFLICT_SUFFIX" help:"Suffix added before the extension of files restored next to local ones." default:".restored" group:"Restore"`
+	QuarantineDir  string `env:"RESTORE_QUARANTINE" help:"Directory where restored content which doesn't match its tree hash is kept for inspection. By default it is removed." optional:"" type:"path" group:"Restore"`
+
+	Plan           bool    `env:"RESTORE_PLAN" help:"Lists files to restore with estimated cost and time of their retrieval in every tier, without creating retrieval jobs or restoring anything." optional:"" group:"Restore cost"`
+	DryRun         bool    `help:"Same as --plan." optional:"" group:"Restore cost"`
+	MaxRestoreCost float64 `env:"MAX_RESTORE_COST" help:"Refuse to create retrieval jobs which are estimated to cost more than this (in USD), unless the cost is confirmed. 0 disables the limit." default:"10" group:"Restore cost"`
+	ConfirmCost    bool    `env:"CONFIRM_RESTORE_COST" help:"Create retrieval jobs even when their estimated cost exceeds --max-restore-cost." optional:"" group:"Restore cost"`
+
+	Target      string `env:"RESTORE_TARGET" help:"Directory where files are restored. By default files are restored in place, next to the index." optional:"" type:"path" group:"Restore target"`
+	StripPrefix string `env:"RESTORE_STRIP_PREFIX" help:"Directory removed from the beginning of restored paths. Files outside of it are not restored." optional:"" group:"Restore target"`
+	AddPrefix   string `env:"RESTORE_ADD_PREFIX" help:"Directory added at the beginning of restored paths." optional:"" group:"Restore target"`
+}
+
+func (o RestoreOptions) pathFilter() (model.PathFilter, error) {
+	filter := model.PathFilter{Includes: o.Includes, Excludes: o.Excludes}
+	if err := filter.Validate(); err != nil {
+		return model.PathFilter{}, fmt.Errorf("invalid restore filter: %w", err)
+	}
+
+	return filter, nil
+}
+
+// asOf returns the time of restored state, zero time means the latest state.
+func (o RestoreOptions) asOf() (time.Time, error) {
+	if o.AsOf == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range asOfLayouts {
+		if t, err := time.ParseInLocation(layout, o.AsOf, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339 or YYYY-MM-DD format", o.AsOf)
+}
+
+func (o RestoreOptions) pathRewrite() pathRewrite {
+	return newPathRewrite(o.StripPrefix, o.AddPrefix)
+}
+
+// planOnly is true when the restore is only planned.
+func (o RestoreOptions) planOnly() bool {
+	return o.Plan || o.DryRun
+}
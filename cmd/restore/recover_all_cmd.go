@@ -1,6 +1,7 @@
 package restore
 
 import (
+	"github.com/mrdunski/accumulation-zone/archive"
 	"github.com/mrdunski/accumulation-zone/glacier"
 	"github.com/mrdunski/accumulation-zone/volume"
 )
@@ -9,7 +10,10 @@ type AllCmd struct {
 	volume.Volume
 	glacier.VaultConfig
 	glacier.ArchiveRetrievalOptions
+	glacier.DownloadOptions
 	InventoryJobOptions
+	archive.Options
+	RestoreOptions
 }
 
 func (c AllCmd) Run() error {
@@ -22,9 +26,11 @@ func (c AllCmd) Run() error {
 
 func (c AllCmd) idx() IndexCmd {
 	return IndexCmd{
-		Volume:              c.Volume,
-		VaultConfig:         c.VaultConfig,
-		InventoryJobOptions: c.InventoryJobOptions,
+		Volume:                  c.Volume,
+		VaultConfig:             c.VaultConfig,
+		ArchiveRetrievalOptions: c.ArchiveRetrievalOptions,
+		InventoryJobOptions:     c.InventoryJobOptions,
+		Options:                 c.Options,
 	}
 }
 
@@ -33,5 +39,8 @@ func (c AllCmd) data() DataCmd {
 		Volume:                  c.Volume,
 		VaultConfig:             c.VaultConfig,
 		ArchiveRetrievalOptions: c.ArchiveRetrievalOptions,
+		DownloadOptions:         c.DownloadOptions,
+		Options:                 c.Options,
+		RestoreOptions:          c.RestoreOptions,
 	}
 }
@@ -1,7 +1,13 @@
 package restore
 
 import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/mrdunski/accumulation-zone/archive"
 	"github.com/mrdunski/accumulation-zone/glacier"
+	"github.com/mrdunski/accumulation-zone/index"
 	"github.com/mrdunski/accumulation-zone/logger"
 	"github.com/mrdunski/accumulation-zone/model"
 	"github.com/mrdunski/accumulation-zone/volume"
@@ -11,52 +17,252 @@ type DataCmd struct {
 	volume.Volume
 	glacier.VaultConfig
 	glacier.ArchiveRetrievalOptions
+	glacier.DownloadOptions
+	archive.Options
+	RestoreOptions
 }
 
 func (c DataCmd) Run() error {
 	logger.Get().Info("Restoring data from Glacier")
 
+	filter, err := c.pathFilter()
+	if err != nil {
+		return err
+	}
 	connection, err := glacier.OpenConnection(c.VaultConfig)
 	if err != nil {
 		return err
 	}
 
-	changes, _, err := c.GetChanges()
+	codec, err := archive.NewCodec(c.Options)
 	if err != nil {
+		return fmt.Errorf("invalid archive options: %w", err)
+	}
+	connection.ConfigureArchive(codec)
+	if err := connection.ConfigureDownload(c.DownloadOptions); err != nil {
+		return fmt.Errorf("invalid download options: %w", err)
+	}
+	if err := connection.OpenDownloadDir(c.stagingDir()); err != nil {
 		return err
 	}
 
-	filesToRecover := model.NewIdentifiableHashedFiles(changes.Deletions)
+	idx, err := c.restoredIndex()
+	if err != nil {
+		return err
+	}
+	if err := c.target().RemoveRestoreLeftovers(); err != nil {
+		return err
+	}
+	changes, err := c.targetChanges(idx)
+	if err != nil {
+		return err
+	}
 
-	for _, file := range filesToRecover {
-		job, err := connection.FindOrCreateArchiveJob(file, c.ArchiveRetrievalOptions)
-		if err != nil {
-			return err
-		}
+	filesToRecover := c.filesToRecover(changes, idx)
+	if !filter.IsEmpty() || !c.pathRewrite().isEmpty() {
+		filesToRecover = c.selectFiles(filesToRecover, filter)
+		logger.Get().Infof("Selected %d files to restore", len(filesToRecover))
+	}
+	conflicts := conflictsOf(filesToRecover, changes)
+	filesToRecover, err = c.resolveConflicts(filesToRecover, conflicts)
+	if err != nil {
+		return err
+	}
+
+	if err := connection.OpenRestoreJournal(c.RestoreJournalFile(), c.restoredInTarget(conflicts)); err != nil {
+		return err
+	}
 
-		switch *job.StatusCode {
+	files := make([]model.IdentifiableHashedFile, 0, len(filesToRecover))
+	for _, file := range filesToRecover {
+		files = append(files, file)
+	}
+	plan, err := connection.PlanRestore(files, c.ArchiveRetrievalOptions)
+	if err != nil {
+		return err
+	}
+	plan.Report()
+	if c.planOnly() {
+		plan.ReportFiles()
+		plan.ReportEstimates()
+		logger.Get().Info("Nothing was restored, as the restore was only planned")
+		return nil
+	}
+	if err := c.guardCost(plan); err != nil {
+		return err
+	}
+	plan.GuardRecreation = c.guardRecreations(plan)
+	if err := connection.CreateMissingJobs(plan, c.ArchiveRetrievalOptions); err != nil {
+		return err
+	}
+	for _, planned := range plan.Archives {
+		switch status := aws.StringValue(planned.Job.StatusCode); status {
 		case "Succeeded":
-			logger.Get().Debugf("* recover job for file %s, status: %s\n", file.Path(), *job.StatusCode)
+			logger.Get().Debugf("* recover job for %d files of archive %s, status: %s", len(planned.Files), planned.Files[0].Path(), status)
 		case "Failed":
-			logger.Get().Errorf("* recover job for file %s, status: %s\n", file.Path(), *job.StatusCode)
+			logger.Get().Errorf("* recover job for %d files of archive %s, status: %s", len(planned.Files), planned.Files[0].Path(), status)
 		default:
-			logger.Get().Warnf("* recover job for file %s, status: %s\n", file.Path(), *job.StatusCode)
+			logger.Get().Warnf("* recover job for %d files of archive %s, status: %s", len(planned.Files), planned.Files[0].Path(), status)
+		}
+	}
+
+	err = connection.Restore(plan, c.ArchiveRetrievalOptions, func(content model.FileWithContent) error {
+		_, conflicted := conflicts[content.Path()]
+		return c.save(content, conflicted)
+	})
+	if err != nil {
+		return err
+	}
 
+	logger.Get().Info("Done")
+	return nil
+}
+
+// restoredIndex is the index with state to restore: the latest one or the one at the time of AsOf.
+func (c DataCmd) restoredIndex() (index.Index, error) {
+	asOf, err := c.asOf()
+	if err != nil {
+		return index.Index{}, err
+	}
+	idx, err := c.CreateIndex()
+	if err != nil || asOf.IsZero() {
+		return idx, err
+	}
+
+	logger.Get().Infof("Restoring files as they were at %v", asOf)
+	return idx.AsOf(asOf)
+}
+
+// filesToRecover are indexed files missing in the volume. Deleted files are recovered only on demand
+// and only when there is no other file at their path.
+func (c DataCmd) filesToRecover(changes model.Changes, idx index.Index) model.IdentifiableHashedFiles {
+	result := model.IdentifiableHashedFiles{}
+	for _, deletion := range changes.Deletions {
+		if !deletion.Purge {
+			result.Replace(deletion)
 		}
 	}
+	if !c.Deleted {
+		return result
+	}
 
-	for _, file := range filesToRecover {
-		content, err := connection.LoadContentFromGlacier(file)
-		if err != nil {
-			return err
+	present := model.HashedFiles{}
+	for _, addition := range changes.Additions {
+		present.Replace(addition)
+	}
+	for _, tombstone := range idx.Tombstones() {
+		_, added := present[tombstone.Path()]
+		_, missing := result[tombstone.Path()]
+		if !added && !missing {
+			result.Replace(tombstone)
 		}
+	}
 
-		err = c.SaveFile(content)
-		if err != nil {
-			return err
+	return result
+}
+
+// selectFiles keeps files matching filter and restored by the path rewrite, so retrieval jobs are created
+// only for them.
+func (c DataCmd) selectFiles(files model.IdentifiableHashedFiles, filter model.PathFilter) model.IdentifiableHashedFiles {
+	rewrite := c.pathRewrite()
+	result := model.IdentifiableHashedFiles{}
+	for path, file := range files {
+		if _, ok := rewrite.target(path); ok && filter.Matches(path) {
+			result.Replace(file)
 		}
 	}
 
-	logger.Get().Info("Done")
-	return nil
+	return result
+}
+
+// target is the volume where files are restored.
+func (c DataCmd) target() volume.Volume {
+	target := c.Volume
+	if c.Target != "" {
+		target.Path = c.Target
+	}
+
+	return target
+}
+
+// stagingDir is the directory where downloads of big archives are kept until they are complete.
+func (c DataCmd) stagingDir() string {
+	if c.DownloadStagingDir != "" {
+		return c.DownloadStagingDir
+	}
+
+	return c.DownloadDir()
+}
+
+// targetChanges compares the index with files in the target. Paths of the target are mapped to paths
+// in the index, so changes are reported with paths of the index.
+func (c DataCmd) targetChanges(idx index.Index) (model.Changes, error) {
+	rewrite := c.pathRewrite()
+	if c.Target == "" && rewrite.isEmpty() {
+		return c.CalculateChanges(idx)
+	}
+
+	if c.Target != "" {
+		if err := os.MkdirAll(c.Target, 0700); err != nil {
+			return model.Changes{}, fmt.Errorf("failed to create restore target: %w", err)
+		}
+	}
+	tree, err := c.target().LoadTree()
+	if err != nil {
+		return model.Changes{}, err
+	}
+	var sources []model.FileWithContent
+	for _, file := range tree {
+		if source, ok := rewrite.source(file.Path()); ok {
+			sources = append(sources, movedFile{FileWithContent: file, path: source})
+		}
+	}
+
+	return idx.CalculateChanges(sources), nil
+}
+
+// restoredInTarget returns a check of files restored by an interrupted run. A file is still restored when
+// the target has its content at the rewritten path, or next to it when both versions of a conflicted file are kept.
+// Files which were removed or changed since then, or which were restored to another target, are restored again.
+func (c DataCmd) restoredInTarget(conflicts model.HashedFiles) func(file model.HashedFile) bool {
+	rewrite := c.pathRewrite()
+	target := c.target()
+
+	return func(file model.HashedFile) bool {
+		p, ok := rewrite.target(file.Path())
+		if !ok {
+			return false
+		}
+		if _, conflicted := conflicts[file.Path()]; !conflicted || c.OnConflict != conflictKeepBoth {
+			restored, err := target.LoadFile(p)
+			return err == nil && restored.Hash() == file.Hash()
+		}
+		for n := 1; ; n++ {
+			restored, err := target.LoadFile(keptBothCandidate(p, c.ConflictSuffix, n))
+			if err != nil {
+				return false
+			}
+			if restored.Hash() == file.Hash() {
+				return true
+			}
+		}
+	}
+}
+
+// save writes file to the target, at the rewritten path. Conflicted files are saved next to local ones
+// when both are kept.
+func (c DataCmd) save(file model.FileWithContent, conflicted bool) error {
+	target, ok := c.pathRewrite().target(file.Path())
+	if !ok {
+		return fmt.Errorf("file %s is outside of %s", file.Path(), c.StripPrefix)
+	}
+	if conflicted && c.OnConflict == conflictKeepBoth {
+		target = keptBothPath(c.target().Path, target, c.ConflictSuffix)
+	}
+	if target != file.Path() {
+		logger.Get().Debugf("Restoring %s as %s", file.Path(), target)
+		file = movedFile{FileWithContent: file, path: target}
+	}
+
+	return c.target().SaveFile(file, c.QuarantineDir)
 }
@@ -2,6 +2,7 @@ package restore
 
 import (
 	"fmt"
+	"github.com/mrdunski/accumulation-zone/archive"
 	"github.com/mrdunski/accumulation-zone/glacier"
 	"github.com/mrdunski/accumulation-zone/logger"
 	"github.com/mrdunski/accumulation-zone/volume"
@@ -15,7 +16,9 @@ type InventoryJobOptions struct {
 type IndexCmd struct {
 	volume.Volume
 	glacier.VaultConfig
+	glacier.ArchiveRetrievalOptions
 	InventoryJobOptions
+	archive.Options
 }
 
 func (c IndexCmd) Run() error {
@@ -25,6 +28,11 @@ func (c IndexCmd) Run() error {
 	if err != nil {
 		return fmt.Errorf("can't open connection: %w", err)
 	}
+	codec, err := archive.NewCodec(c.Options)
+	if err != nil {
+		return fmt.Errorf("invalid archive options: %w", err)
+	}
+	connection.ConfigureArchive(codec)
 
 	job, err := connection.FindNewestInventoryJob()
 	if err != nil {
@@ -45,7 +53,7 @@ func (c IndexCmd) Run() error {
 		return fmt.Errorf("failed to create index: %w", err)
 	}
 
-	if err := connection.AddInventoryToIndex(idx); err != nil {
+	if err := connection.AddInventoryToIndex(idx, c.ArchiveRetrievalOptions); err != nil {
 		return fmt.Errorf("failed to list files in inventory: %w", err)
 	}
 
@@ -0,0 +1,59 @@
+package restore
+
+import (
+	"path"
+	"strings"
+
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+// pathRewrite maps paths in the index to paths in the restore target: strip is removed from the beginning
+// of the path and add is put in its place. Both are directories.
+type pathRewrite struct {
+	strip string
+	add   string
+}
+
+func newPathRewrite(strip, add string) pathRewrite {
+	return pathRewrite{strip: cleanDir(strip), add: cleanDir(add)}
+}
+
+func cleanDir(dir string) string {
+	return strings.Trim(path.Clean("/"+dir), "/")
+}
+
+func (r pathRewrite) isEmpty() bool {
+	return r.strip == "" && r.add == ""
+}
+
+// target returns the path where the file from p is restored. ok is false for files outside of the stripped directory.
+func (r pathRewrite) target(p string) (string, bool) {
+	return replaceDir(p, r.strip, r.add)
+}
+
+// source returns the path in the index of the file restored to p. ok is false for files which are not restored
+// from the index.
+func (r pathRewrite) source(p string) (string, bool) {
+	return replaceDir(p, r.add, r.strip)
+}
+
+func replaceDir(p, from, to string) (string, bool) {
+	if from != "" {
+		if !strings.HasPrefix(p, from+"/") {
+			return "", false
+		}
+		p = strings.TrimPrefix(p, from+"/")
+	}
+
+	return path.Join(to, p), true
+}
+
+// movedFile is a file stored at a different path.
+type movedFile struct {
+	model.FileWithContent
+	path string
+}
+
+func (f movedFile) Path() string {
+	return f.path
+}
@@ -0,0 +1,126 @@
+package restore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	awsGlacier "github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/index"
+	"github.com/mrdunski/accumulation-zone/model"
+	"github.com/mrdunski/accumulation-zone/volume"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func treeHash(content string) string {
+	return fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader([]byte(content))).TreeHash)
+}
+
+func pathsOf[T model.HashedFile](files []T) []string {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path())
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+var _ = Describe("Path rewrite", func() {
+	DescribeTable("maps paths to the target and back", func(strip, add, p, expected string) {
+		rewrite := newPathRewrite(strip, add)
+
+		target, ok := rewrite.target(p)
+		Expect(ok).To(BeTrue())
+		Expect(target).To(Equal(expected))
+		source, ok := rewrite.source(target)
+		Expect(ok).To(BeTrue())
+		Expect(source).To(Equal(p))
+	},
+		Entry("without rewrite", "", "", "projects/acme/plan.txt", "projects/acme/plan.txt"),
+		Entry("with stripped prefix", "projects", "", "projects/acme/plan.txt", "acme/plan.txt"),
+		Entry("with added prefix", "", "restored", "projects/acme/plan.txt", "restored/projects/acme/plan.txt"),
+		Entry("with both prefixes", "projects/acme", "acme-2023", "projects/acme/plan.txt", "acme-2023/plan.txt"),
+		Entry("with unclean prefixes", "/projects/", "./restored//", "projects/acme/plan.txt", "restored/acme/plan.txt"),
+	)
+
+	DescribeTable("rejects files outside of the stripped directory", func(p string) {
+		_, ok := newPathRewrite("projects/acme", "acme").target(p)
+
+		Expect(ok).To(BeFalse())
+	},
+		Entry("in other directory", "finance/plan.txt"),
+		Entry("in directory with the same prefix", "projects/acme-old/plan.txt"),
+		Entry("being the directory", "projects/acme"),
+	)
+
+	It("doesn't map files outside of the added directory back", func() {
+		_, ok := newPathRewrite("projects/acme", "acme").source("other/plan.txt")
+
+		Expect(ok).To(BeFalse())
+	})
+
+	Describe("target changes", func() {
+		var backup string
+		var idx index.Index
+
+		BeforeEach(func() {
+			backup = GinkgoT().TempDir()
+			var err error
+			idx, err = index.LoadIndexFile(filepath.Join(backup, ".changes.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(idx.CommitAdd("archive1", index.NewEntry("projects/acme/plan.txt", treeHash("plan"), ""))).To(Succeed())
+			Expect(idx.CommitAdd("archive2", index.NewEntry("projects/acme/budget.txt", treeHash("budget"), ""))).To(Succeed())
+			Expect(idx.CommitAdd("archive3", index.NewEntry("finance/report.txt", treeHash("report"), ""))).To(Succeed())
+		})
+
+		changesOf := func(options RestoreOptions) model.Changes {
+			cmd := DataCmd{Volume: volume.Volume{Path: backup, IndexFile: ".changes.log"}, RestoreOptions: options}
+			changes, err := cmd.targetChanges(idx)
+			Expect(err).NotTo(HaveOccurred())
+			return changes
+		}
+
+		It("compares the index with the target", func() {
+			target := filepath.Join(GinkgoT().TempDir(), "target")
+			writeFiles(target, map[string]string{
+				"projects/acme/plan.txt":   "plan",
+				"projects/acme/budget.txt": "changed budget",
+				"notes.txt":                "notes",
+			})
+
+			changes := changesOf(RestoreOptions{Target: target})
+
+			Expect(pathsOf(changes.Additions)).To(Equal([]string{"notes.txt", "projects/acme/budget.txt"}))
+			Expect(pathsOf(changes.Deletions)).To(Equal([]string{"finance/report.txt", "projects/acme/budget.txt"}))
+		})
+
+		It("compares rewritten paths of the volume", func() {
+			writeFiles(backup, map[string]string{
+				"acme/plan.txt":          "plan",
+				"projects/acme/plan.txt": "not restored by the rewrite",
+			})
+
+			changes := changesOf(RestoreOptions{StripPrefix: "projects/acme", AddPrefix: "acme"})
+
+			Expect(pathsOf(changes.Additions)).To(BeEmpty())
+			Expect(pathsOf(changes.Deletions)).To(Equal([]string{"finance/report.txt", "projects/acme/budget.txt"}))
+		})
+
+		It("compares rewritten paths of the target", func() {
+			target := filepath.Join(GinkgoT().TempDir(), "target")
+			writeFiles(target, map[string]string{
+				"acme/plan.txt":   "changed plan",
+				"acme/budget.txt": "budget",
+				"other/notes.txt": "notes",
+			})
+
+			changes := changesOf(RestoreOptions{Target: target, StripPrefix: "projects/acme", AddPrefix: "acme"})
+
+			Expect(pathsOf(changes.Additions)).To(Equal([]string{"projects/acme/plan.txt"}))
+			Expect(pathsOf(changes.Deletions)).To(Equal([]string{"finance/report.txt", "projects/acme/plan.txt"}))
+		})
+	})
+})
@@ -0,0 +1,125 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	hashCacheCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: telemetry.Namespace,
+		Name:      "volume_hash_cache_count",
+	}, []string{"result"})
+	hashCacheHits   = hashCacheCounter.With(prometheus.Labels{"result": "hit"})
+	hashCacheMisses = hashCacheCounter.With(prometheus.Labels{"result": "miss"})
+)
+
+// racyPeriod is the time after modification when a file can still be changed without changing its mtime.
+// Files modified more recently than that are always hashed and never cached.
+const racyPeriod = 2 * time.Second
+
+type fileMeta struct {
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"mtime"`
+	ChangeTime int64  `json:"ctime"`
+	Inode      uint64 `json:"inode"`
+}
+
+type cachedHash struct {
+	fileMeta
+	Hash string `json:"hash"`
+}
+
+// HashCache keeps tree hashes of files with their metadata, so files that didn't change are not hashed again.
+// A nil cache is valid and doesn't cache anything.
+type HashCache struct {
+	filePath string
+	paranoid bool
+	mutex    sync.Mutex
+	previous map[string]cachedHash
+	current  map[string]cachedHash
+}
+
+// LoadHashCache loads cache from filePath. When paranoid is set, cached hashes are ignored but the cache is still updated.
+func LoadHashCache(filePath string, paranoid bool) (*HashCache, error) {
+	cache := &HashCache{
+		filePath: filePath,
+		paranoid: paranoid,
+		previous: map[string]cachedHash{},
+		current:  map[string]cachedHash{},
+	}
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &cache.previous); err != nil {
+		logger.WithComponent("volume").WithError(err).Warnf("Hash cache %s is broken - all files will be hashed", filePath)
+		cache.previous = map[string]cachedHash{}
+	}
+
+	return cache, nil
+}
+
+func (c *HashCache) lookup(subPath string, meta fileMeta) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached, ok := c.previous[subPath]
+	if c.paranoid || !ok || cached.fileMeta != meta {
+		hashCacheMisses.Inc()
+		return "", false
+	}
+
+	hashCacheHits.Inc()
+	c.current[subPath] = cached
+	return cached.Hash, true
+}
+
+func (c *HashCache) store(subPath string, meta fileMeta, hash string) {
+	if c == nil || time.Since(time.Unix(0, meta.ModTime)) < racyPeriod {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.current[subPath] = cachedHash{fileMeta: meta, Hash: hash}
+}
+
+// Save writes hashes of all files looked up or stored since the cache was loaded. Entries of other files are dropped.
+func (c *HashCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	data, err := json.Marshal(c.current)
+	if err != nil {
+		return err
+	}
+
+	temp := filepath.Join(filepath.Dir(c.filePath), "."+filepath.Base(c.filePath)+".tmp")
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save hash cache: %w", err)
+	}
+
+	return os.Rename(temp, c.filePath)
+}
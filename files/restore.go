@@ -0,0 +1,62 @@
+package files
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+)
+
+// restoreTempMarker is a part of names of temporary files where restored content is written before it is moved
+// in place.
+const restoreTempMarker = ".az-restore-"
+
+func restoreTempPattern(name string) string {
+	return "." + name + restoreTempMarker + "*"
+}
+
+func isRestoreTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, restoreTempMarker)
+}
+
+// syncDir makes a rename in dir durable. Not every platform can sync directories, so failures are only logged.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err == nil {
+		err = d.Sync()
+		_ = d.Close()
+	}
+	if err != nil {
+		logger.WithComponent("volume").Debugf("Failed to sync directory %s: %v", dir, err)
+	}
+}
+
+// RemoveRestoreLeftovers removes temporary files left by restores which were interrupted. It returns the number
+// of removed files.
+func (l Volume) RemoveRestoreLeftovers() (int, error) {
+	removed := 0
+	err := filepath.WalkDir(l.basePath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || !isRestoreTemp(entry.Name()) {
+			return nil
+		}
+
+		logger.WithComponent("volume").Infof("Removing leftover of interrupted restore %s", filePath)
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+		removed++
+
+		return nil
+	})
+
+	return removed, err
+}
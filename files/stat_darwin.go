@@ -0,0 +1,16 @@
+package files
+
+import (
+	"os"
+	"syscall"
+)
+
+func metaOf(info os.FileInfo) fileMeta {
+	meta := fileMeta{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		meta.Inode = stat.Ino
+		meta.ChangeTime = stat.Ctimespec.Nano()
+	}
+
+	return meta
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package files
+
+import "os"
+
+// metaOf falls back to size and mtime where inode and ctime are not available.
+func metaOf(info os.FileInfo) fileMeta {
+	return fileMeta{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
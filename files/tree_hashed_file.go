@@ -56,8 +56,12 @@ func (fh TreeHashedFile) Hash() string {
 	return fh.treeHash
 }
 
+func (fh TreeHashedFile) Stat() (os.FileInfo, error) {
+	return fh.os.Stat(path.Join(fh.basePath, fh.path))
+}
+
 func (fh TreeHashedFile) Size() (int64, error) {
-	stat, err := fh.os.Stat(path.Join(fh.basePath, fh.path))
+	stat, err := fh.Stat()
 	if err != nil {
 		return -1, err
 	}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+type hashResult struct {
+	file TreeHashedFile
+	err  error
+}
+
+type hashJob struct {
+	subPath string
+	result  chan<- hashResult
+}
+
+// StreamTree walks the Volume and sends its files to out as soon as they are hashed. Files are sent in walk order
+// and the reported error is the one of the first failing path, regardless of the number of workers.
+// out is closed when StreamTree returns.
+func (l Volume) StreamTree(ctx context.Context, out chan<- model.FileWithContent) error {
+	defer close(out)
+	logger.WithComponent("volume").Debugf("Loading tree %s, excludes: %v", l.basePath, l.excludes)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan hashJob)
+	for w := 0; w < l.workers(); w++ {
+		go func() {
+			for job := range jobs {
+				file, err := l.LoadFile(job.subPath)
+				job.result <- hashResult{file: file, err: err}
+			}
+		}()
+	}
+
+	pending := make(chan (<-chan hashResult), l.workers())
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		walkErr <- l.walk(ctx, "", func(subPath string) bool {
+			result := make(chan hashResult, 1)
+			select {
+			case jobs <- hashJob{subPath: subPath, result: result}:
+			case <-ctx.Done():
+				return false
+			}
+			select {
+			case pending <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	for result := range pending {
+		hashed := <-result
+		if hashed.err != nil {
+			return hashed.err
+		}
+		select {
+		case out <- hashed.file:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := <-walkErr; err != nil {
+		return err
+	}
+
+	return l.cache.Save()
+}
+
+func (l Volume) workers() int {
+	if l.hashWorkers < 1 {
+		return 1
+	}
+
+	return l.hashWorkers
+}
+
+// walk visits files of subPath in lexical order. It stops when visit returns false.
+func (l Volume) walk(ctx context.Context, subPath string, visit func(subPath string) bool) error {
+	logger.WithComponent("volume").Debugf("Loading %s/%s", l.basePath, subPath)
+	entries, err := os.ReadDir(path.Join(l.basePath, subPath))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entrySubPath := path.Join(subPath, entry.Name())
+		if l.isExcluded(entrySubPath) || isRestoreTemp(entry.Name()) {
+			continue
+		}
+
+		if entry.IsDir() {
+			if err := l.walk(ctx, entrySubPath, visit); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !visit(entrySubPath) {
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
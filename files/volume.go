@@ -1,6 +1,8 @@
 package files
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/glacier"
 	"github.com/mrdunski/accumulation-zone/logger"
@@ -13,9 +15,12 @@ import (
 
 // Volume is a backup source
 type Volume struct {
-	os       FileAccess
-	basePath string
-	excludes []string
+	os          FileAccess
+	basePath    string
+	excludes    []string
+	hashWorkers int
+	cache       *HashCache
+	quarantine  string
 }
 
 // NewVolume creates a volume for specified path. excludes define paths that should not be synchronized.
@@ -23,6 +28,12 @@ func NewVolume(basePath string, excludes ...string) Volume {
 	return Volume{os: stdOSInstance, basePath: basePath, excludes: excludes}
 }
 
+// WithHashWorkers returns a copy of the volume that hashes files with given number of concurrent workers.
+func (l Volume) WithHashWorkers(workers int) Volume {
+	l.hashWorkers = workers
+	return l
+}
+
 func (l Volume) isExcluded(path string) bool {
 	for _, exclude := range l.excludes {
 		if strings.Contains(path, exclude) {
@@ -46,27 +57,46 @@ func (l Volume) LoadFile(subPath string) (_ TreeHashedFile, err error) {
 			err = closeErr
 		}
 	}(file)
-	hash := glacier.ComputeHashes(file)
 
-	if len(hash.TreeHash) == 0 {
-		logger.WithComponent("volume").Warnf("Empty file %s/%s - hash will be empty as well", l.basePath, subPath)
-		hash = glacier.ComputeHashes(strings.NewReader(""))
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	meta := metaOf(info)
+
+	treeHash, cached := l.cache.lookup(subPath, meta)
+	if !cached {
+		treeHash = l.computeHash(file, subPath)
+		l.cache.store(subPath, meta, treeHash)
 	}
 
 	return TreeHashedFile{
 		path:     subPath,
-		treeHash: fmt.Sprintf("%x", hash.TreeHash),
+		treeHash: treeHash,
 		os:       l.os,
 		basePath: l.basePath,
 	}, nil
 }
 
+func (l Volume) computeHash(file *os.File, subPath string) string {
+	hash := glacier.ComputeHashes(file)
+
+	if len(hash.TreeHash) == 0 {
+		logger.WithComponent("volume").Warnf("Empty file %s/%s - hash will be empty as well", l.basePath, subPath)
+		hash = glacier.ComputeHashes(strings.NewReader(""))
+	}
+
+	return fmt.Sprintf("%x", hash.TreeHash)
+}
+
 func (l Volume) createDirIfNotExist(content model.FileWithContent) error {
 	dirPath := path.Join(l.basePath, path.Dir(content.Path()))
 	return os.MkdirAll(dirPath, 0700)
 }
 
-// Save stores a file in volume
+// Save stores a file in volume. Content is written to a temporary file next to the destination, which is synced
+// and atomically renamed to the destination only when the whole content was read without errors, e.g. it matches
+// its hash. Interrupted saves never leave a partially written destination.
 func (l Volume) Save(content model.FileWithContent) (err error) {
 	logger.WithComponent("volume").Debugf("Saving file: %s/%s", l.basePath, content.Path())
 	reader, err := content.Content()
@@ -85,71 +115,82 @@ func (l Volume) Save(content model.FileWithContent) (err error) {
 		return err
 	}
 
-	file, err := os.OpenFile(path.Join(l.basePath, content.Path()), os.O_TRUNC|os.O_RDWR|os.O_CREATE, 0600)
+	destination := path.Join(l.basePath, content.Path())
+	file, err := os.CreateTemp(path.Dir(destination), restoreTempPattern(path.Base(destination)))
 	if err != nil {
 		return
 	}
-	defer func(file *os.File) {
-		closeErr := file.Close()
-		if closeErr != nil && err == nil {
-			err = closeErr
-		}
-	}(file)
 
 	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), destination)
+	}
 	if err != nil {
+		l.discard(file.Name(), content.Path(), err)
 		return err
 	}
+	syncDir(path.Dir(destination))
 
 	return nil
 }
 
-func (l Volume) loadEntry(entrySubPath string, entry os.DirEntry) ([]model.FileWithContent, error) {
-	if l.isExcluded(entrySubPath) {
-		return nil, nil
-	}
+// WithQuarantine returns a copy of the volume that moves saved content which doesn't match its hash to dir,
+// instead of removing it.
+func (l Volume) WithQuarantine(dir string) Volume {
+	l.quarantine = dir
+	return l
+}
 
-	if entry.IsDir() {
-		dirEntries, err := l.loadSubPath(entrySubPath)
-		if err != nil {
-			return nil, err
+// discard removes a temporary file which failed to be saved. Corrupted content is quarantined, when enabled.
+func (l Volume) discard(tempPath, subPath string, cause error) {
+	log := logger.WithComponent("volume").WithError(cause)
+	if l.quarantine != "" && errors.Is(cause, model.ErrTreeHashMismatch) {
+		quarantined := path.Join(l.quarantine, subPath)
+		err := os.MkdirAll(path.Dir(quarantined), 0700)
+		if err == nil {
+			err = os.Rename(tempPath, quarantined)
+		}
+		if err == nil {
+			log.Errorf("Content of %s is corrupted - quarantined as %s", subPath, quarantined)
+			return
 		}
-		return dirEntries, nil
+		log.WithField("quarantineError", err).Errorf("Failed to quarantine corrupted content of %s", subPath)
 	}
 
-	fileHandle, err := l.LoadFile(entrySubPath)
-	if err != nil {
-		return nil, err
+	if err := os.Remove(tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("Failed to remove %s: %v", tempPath, err)
 	}
-	return []model.FileWithContent{fileHandle}, nil
 }
 
-func (l Volume) loadSubPath(subPath string) ([]model.FileWithContent, error) {
-	logger.WithComponent("volume").Debugf("Loading %s/%s", l.basePath, subPath)
-	absolutePath := path.Join(l.basePath, subPath)
-	entries, err := os.ReadDir(absolutePath)
-	if err != nil {
-		return nil, err
-	}
-
-	var result []model.FileWithContent
-
-	for _, entry := range entries {
-		entrySubPath := path.Join(subPath, entry.Name())
-		entryFiles, err := l.loadEntry(entrySubPath, entry)
-		if err != nil {
-			return nil, err
-		}
-		if len(entryFiles) > 0 {
-			result = append(result, entryFiles...)
-		}
-	}
-
-	return result, nil
+// WithHashCache returns a copy of the volume that reuses hashes of unchanged files from the cache.
+func (l Volume) WithHashCache(cache *HashCache) Volume {
+	l.cache = cache
+	return l
 }
 
 // LoadTree loads all files from the Volume
 func (l Volume) LoadTree() ([]model.FileWithContent, error) {
-	logger.WithComponent("volume").Debugf("Loading tree %s, excludes: %v", l.basePath, l.excludes)
-	return l.loadSubPath("")
+	out := make(chan model.FileWithContent)
+	collected := make(chan []model.FileWithContent)
+	go func() {
+		var tree []model.FileWithContent
+		for file := range out {
+			tree = append(tree, file)
+		}
+		collected <- tree
+	}()
+
+	err := l.StreamTree(context.Background(), out)
+	tree := <-collected
+	if err != nil {
+		return nil, err
+	}
+
+	return tree, nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/golang/mock/gomock"
 	. "github.com/mrdunski/accumulation-zone/gomega"
+	"github.com/mrdunski/accumulation-zone/model"
 	"github.com/mrdunski/accumulation-zone/model/mock_model"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -14,6 +15,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"testing/iotest"
+	"time"
 )
 
 type fileMatcher struct {
@@ -60,6 +63,27 @@ var _ = Describe("volume.LoadTree", func() {
 		})
 	})
 
+	When("files are hashed concurrently", func() {
+		validPath := filepath.Join(testDir, "valid")
+		It("loads files in the same order", func() {
+			expected, err := NewVolume(validPath).LoadTree()
+			Expect(err).NotTo(HaveOccurred())
+
+			tree, err := NewVolume(validPath).WithHashWorkers(3).LoadTree()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tree).To(HaveLen(len(expected)))
+			for i := range expected {
+				Expect(tree[i].Path()).To(Equal(expected[i].Path()))
+				Expect(tree[i].Hash()).To(Equal(expected[i].Hash()))
+			}
+		})
+
+		It("returns an error", func() {
+			_, err := NewVolume(filepath.Join(testDir, "broken")).WithHashWorkers(3).LoadTree()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	When("file is broken", func() {
 		brokenPath := filepath.Join(testDir, "broken")
 		loader := NewVolume(brokenPath)
@@ -175,4 +199,118 @@ var _ = Describe("volume.save", func() {
 
 		Expect(err).To(WrapError(expectedErr))
 	})
+
+	Context("with corrupted content", func() {
+		var file *mock_model.MockFileWithContent
+		BeforeEach(func() {
+			_ = os.WriteFile(path.Join(testDir, "existing.txt"), []byte("???"), 0666)
+
+			file = mock_model.NewMockFileWithContent(gomock.NewController(GinkgoT()))
+			file.EXPECT().Path().AnyTimes().Return("existing.txt")
+			file.EXPECT().Content().Return(io.NopCloser(io.MultiReader(
+				strings.NewReader("corrupted"),
+				iotest.ErrReader(fmt.Errorf("%w: checked", model.ErrTreeHashMismatch)),
+			)), nil)
+		})
+
+		It("keeps the existing file", func() {
+			err := NewVolume(testDir).Save(file)
+
+			Expect(err).To(WrapError(model.ErrTreeHashMismatch))
+			Expect(os.ReadFile(path.Join(testDir, "existing.txt"))).To(Equal([]byte("???")))
+			entries, err := os.ReadDir(testDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+
+		It("quarantines content", func() {
+			quarantine := filepath.Join(testDir, "quarantine")
+
+			err := NewVolume(testDir).WithQuarantine(quarantine).Save(file)
+
+			Expect(err).To(WrapError(model.ErrTreeHashMismatch))
+			Expect(os.ReadFile(path.Join(testDir, "existing.txt"))).To(Equal([]byte("???")))
+			Expect(os.ReadFile(path.Join(quarantine, "existing.txt"))).To(Equal([]byte("corrupted")))
+		})
+	})
+})
+
+var _ = Describe("leftovers of interrupted restore", func() {
+	var testDir string
+	BeforeEach(func() {
+		testDir = GinkgoT().TempDir()
+		Expect(os.MkdirAll(path.Join(testDir, "dir"), 0700)).To(Succeed())
+		Expect(os.WriteFile(path.Join(testDir, "dir", "file.txt"), []byte("content"), 0600)).To(Succeed())
+		Expect(os.WriteFile(path.Join(testDir, "dir", ".file.txt.az-restore-123"), []byte("cont"), 0600)).To(Succeed())
+	})
+
+	It("are not loaded", func() {
+		tree, err := NewVolume(testDir).LoadTree()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tree).To(HaveLen(1))
+		Expect(tree[0].Path()).To(Equal("dir/file.txt"))
+	})
+
+	It("are removed", func() {
+		removed, err := NewVolume(testDir).RemoveRestoreLeftovers()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(Equal(1))
+		Expect(path.Join(testDir, "dir", ".file.txt.az-restore-123")).NotTo(BeAnExistingFile())
+		Expect(path.Join(testDir, "dir", "file.txt")).To(BeAnExistingFile())
+	})
+
+	It("are ignored in missing volume", func() {
+		removed, err := NewVolume(path.Join(testDir, "missing")).RemoveRestoreLeftovers()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(BeZero())
+	})
+})
+
+var _ = Describe("volume with hash cache", func() {
+	var testDir, cacheFile string
+	const expectedHash = "05e8fdb3598f91bcc3ce41a196e587b4592c8cdfc371c217274bfda2d24b1b4e"
+
+	loadTree := func(paranoid bool) []model.FileWithContent {
+		cache, err := LoadHashCache(cacheFile, paranoid)
+		Expect(err).NotTo(HaveOccurred())
+		tree, err := NewVolume(testDir, ".cache").WithHashCache(cache).LoadTree()
+		Expect(err).NotTo(HaveOccurred())
+		return tree
+	}
+
+	tamperCache := func() {
+		data, err := os.ReadFile(cacheFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(cacheFile, []byte(strings.ReplaceAll(string(data), expectedHash, "cached")), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		testDir = GinkgoT().TempDir()
+		cacheFile = path.Join(testDir, ".cache")
+		filePath := path.Join(testDir, "file")
+		Expect(os.WriteFile(filePath, []byte("test data 1"), 0600)).To(Succeed())
+		past := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(filePath, past, past)).To(Succeed())
+
+		Expect(loadTree(false)).To(ConsistOf(fileWith("file", expectedHash)))
+		Expect(cacheFile).To(BeAnExistingFile())
+		tamperCache()
+	})
+
+	It("reuses hash of unchanged file", func() {
+		Expect(loadTree(false)).To(ConsistOf(fileWith("file", "cached")))
+	})
+
+	It("ignores cache in paranoid mode", func() {
+		Expect(loadTree(true)).To(ConsistOf(fileWith("file", expectedHash)))
+	})
+
+	It("hashes modified file", func() {
+		Expect(os.WriteFile(path.Join(testDir, "file"), []byte("test data 2"), 0600)).To(Succeed())
+
+		Expect(loadTree(false)).To(ConsistOf(fileWith("file", "26637da1bd793f9011a3d304372a9ec44e36cc677d2bbfba32a2f31f912358fe")))
+	})
 })
@@ -0,0 +1,170 @@
+package glacier
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/archive"
+)
+
+// manifestMember is a file of a bundle listed in the inventory. It is read from the manifest of the bundle.
+type manifestMember struct {
+	entry      archive.BundleEntry
+	bundleId   string
+	bundleSize int64
+	uploadedAt time.Time
+}
+
+func (m manifestMember) ChangeId() string {
+	return m.bundleId
+}
+
+func (m manifestMember) Path() string {
+	return m.entry.Path
+}
+
+func (m manifestMember) Hash() string {
+	return m.entry.Hash
+}
+
+func (m manifestMember) Encoding() string {
+	return m.entry.Encoding
+}
+
+func (m manifestMember) ArchiveSize() int64 {
+	return m.bundleSize
+}
+
+func (m manifestMember) BundleRange() (offset, length int64, ok bool) {
+	return m.entry.Offset, m.entry.Length, true
+}
+
+func (m manifestMember) UploadedAt() time.Time {
+	return m.uploadedAt
+}
+
+// manifestRetrieval is a job which retrieves the end of a bundle archive with its manifest.
+type manifestRetrieval struct {
+	bundle inventoryArchive
+	job    *glacier.JobDescription
+}
+
+// manifestRange returns the range retrieved to read the manifest of bundle. Glacier accepts only ranges which start
+// at a megabyte boundary, so the range starts a bit before the manifest and ends with the archive.
+func manifestRange(bundle inventoryArchive) string {
+	start := bundle.description.ManifestOffset - bundle.description.ManifestOffset%mebibyte
+
+	return fmt.Sprintf("%d-%d", start, bundle.Size-1)
+}
+
+// rangeStart returns the offset in the archive of the first byte of the job output.
+func rangeStart(job *glacier.JobDescription) int64 {
+	start, _, _ := strings.Cut(flatString(job.RetrievalByteRange), "-")
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return offset
+}
+
+// wholeArchiveJob is false for jobs which retrieve only a range of the archive, e.g. the manifest of a bundle.
+func wholeArchiveJob(job *glacier.JobDescription) bool {
+	return rangeStart(job) == 0
+}
+
+// loadBundleMembers reads manifests of bundles and returns files packed in them. Manifests are retrieved with
+// ranged jobs, unless the whole bundle is being retrieved already. Bundles uploaded without a manifest are skipped.
+func (c *Connection) loadBundleMembers(bundles []inventoryArchive, options ArchiveRetrievalOptions) ([]manifestMember, error) {
+	if len(bundles) == 0 {
+		return nil, nil
+	}
+	jobs, err := c.listAllJobs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	var retrievals []manifestRetrieval
+	now := time.Now()
+	interval := options.jobCreationInterval()
+	var last time.Time
+	for _, bundle := range bundles {
+		if bundle.description.ManifestLength == 0 {
+			c.logger().Warnf("Bundle %s (%s) has no manifest - files packed in it can't be indexed", bundle.Path(), bundle.ArchiveId)
+			continue
+		}
+		byteRange := manifestRange(bundle)
+		var found *glacier.JobDescription
+		for _, job := range jobs {
+			if aws.StringValue(job.ArchiveId) != bundle.ArchiveId || options.jobProblem(job, now) != "" {
+				continue
+			}
+			if !wholeArchiveJob(job) && flatString(job.RetrievalByteRange) != byteRange {
+				continue
+			}
+			if found == nil || preferredJob(job, found) {
+				found = job
+			}
+		}
+		if found == nil {
+			if wait := interval - time.Since(last); !last.IsZero() && wait > 0 {
+				time.Sleep(wait)
+			}
+			last = time.Now()
+			found, err = c.createJob(glacier.JobParameters{
+				Description:        aws.String(jobDescription("manifest of " + bundle.Path())),
+				ArchiveId:          aws.String(bundle.ArchiveId),
+				RetrievalByteRange: aws.String(byteRange),
+				Tier:               aws.String(string(options.Tier)),
+				Type:               aws.String("archive-retrieval"),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve manifest of %s: %w", bundle.Path(), err)
+			}
+		}
+		retrievals = append(retrievals, manifestRetrieval{bundle: bundle, job: found})
+	}
+
+	var members []manifestMember
+	for _, retrieval := range retrievals {
+		entries, err := c.readManifest(retrieval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest of %s: %w", retrieval.bundle.Path(), err)
+		}
+		for _, entry := range entries {
+			members = append(members, manifestMember{
+				entry:      entry,
+				bundleId:   retrieval.bundle.ArchiveId,
+				bundleSize: retrieval.bundle.Size,
+				uploadedAt: retrieval.bundle.CreationDate,
+			})
+		}
+	}
+
+	return members, nil
+}
+
+func (c *Connection) readManifest(retrieval manifestRetrieval) ([]archive.BundleEntry, error) {
+	job, err := c.awaitJobCompletion(retrieval.job)
+	if err != nil {
+		return nil, err
+	}
+
+	description := retrieval.bundle.description
+	offset := description.ManifestOffset - rangeStart(job)
+	output, err := c.glacier.GetJobOutput(&glacier.GetJobOutputInput{
+		AccountId: &c.accountId,
+		VaultName: &c.vaultName,
+		JobId:     job.JobId,
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+description.ManifestLength-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.codec.ReadBundleManifest(description.ManifestEncoding, output.Body)
+}
@@ -0,0 +1,195 @@
+package glacier
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/mrdunski/accumulation-zone/archive"
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
+	"github.com/mrdunski/accumulation-zone/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadBundlesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: telemetry.Namespace,
+		Name:      "glacier_upload_bundles_sum",
+	})
+	bundledFilesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: telemetry.Namespace,
+		Name:      "glacier_upload_bundled_files_sum",
+	})
+)
+
+// bundledFile is committed instead of a file which was uploaded in a bundle.
+type bundledFile struct {
+	model.HashedFile
+	encoding   string
+	offset     int64
+	length     int64
+	bundleSize int64
+}
+
+func (f bundledFile) Encoding() string {
+	return f.encoding
+}
+
+func (f bundledFile) ArchiveSize() int64 {
+	return f.bundleSize
+}
+
+func (f bundledFile) BundleRange() (offset, length int64, ok bool) {
+	return f.offset, f.length, true
+}
+
+type bundleMember struct {
+	change model.FileAdded
+	file   bundledFile
+}
+
+type pendingBundle struct {
+	bundle  *archive.Bundle
+	members []bundleMember
+	// err is set when the bundle got broken and none of its members can be uploaded
+	err error
+}
+
+// bundler packs small files into bundles. Files are added by upload workers concurrently,
+// the worker which fills a bundle up uploads it.
+type bundler struct {
+	connection *Connection
+	mutex      sync.Mutex
+	current    *pendingBundle
+}
+
+func (c *Connection) newBundler() *bundler {
+	return &bundler{connection: c}
+}
+
+func (b *bundler) accepts(change model.FileAdded) bool {
+	threshold := b.connection.uploadOptions.bundleThresholdBytes()
+	if threshold == 0 || change.Hash() == "" || change.TombstoneId != "" {
+		return false
+	}
+	size, err := change.Size()
+
+	return err == nil && size < threshold
+}
+
+// add puts change into the current bundle. It returns the bundle when it is full and should be uploaded.
+func (b *bundler) add(change model.FileAdded) (*pendingBundle, error) {
+	encoded, err := b.connection.codec.Encode(change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", change.Path(), err)
+	}
+	var content model.FileWithContent = change
+	member := bundledFile{HashedFile: change}
+	if encoded != nil {
+		defer func(encoded *archive.EncodedFile) {
+			if err := encoded.Close(); err != nil {
+				b.connection.logger().WithError(err).Warnf("Failed to remove encoded content of %s", change.Path())
+			}
+		}(encoded)
+		content = encoded
+		member = bundledFile{HashedFile: encoded, encoding: encoded.Encoding()}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.current == nil {
+		bundle, err := b.connection.codec.NewBundle()
+		if err != nil {
+			return nil, err
+		}
+		b.current = &pendingBundle{bundle: bundle}
+	}
+
+	member.offset, member.length, err = b.current.bundle.Add(content)
+	if errors.Is(err, archive.ErrContentChanged) {
+		return nil, err
+	}
+	if err != nil {
+		broken := b.current
+		broken.err = err
+		b.current = nil
+		return broken, fmt.Errorf("failed to add %s to bundle: %w", change.Path(), err)
+	}
+	b.current.members = append(b.current.members, bundleMember{change: change, file: member})
+
+	if size, _ := b.current.bundle.Size(); size < b.connection.uploadOptions.bundleSizeBytes() {
+		return nil, nil
+	}
+	full := b.current
+	b.current = nil
+
+	return full, nil
+}
+
+// flush returns the last bundle regardless of its size.
+func (b *bundler) flush() *pendingBundle {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	last := b.current
+	b.current = nil
+	if last != nil && len(last.members) == 0 {
+		last.close()
+		return nil
+	}
+
+	return last
+}
+
+func (p *pendingBundle) close() {
+	if err := p.bundle.Close(); err != nil {
+		logger.WithComponent("glacier").WithError(err).Warnf("Failed to remove bundle %s", p.bundle.Path())
+	}
+}
+
+func (c *Connection) processBundled(bundler *bundler, change model.FileAdded) []uploadResult {
+	full, err := bundler.add(change)
+
+	var results []uploadResult
+	if err != nil {
+		results = append(results, uploadResult{change: change, err: err})
+	}
+	if full != nil {
+		results = append(results, c.uploadBundle(full)...)
+	}
+
+	return results
+}
+
+// uploadBundle uploads the bundle and returns results for all its files.
+func (c *Connection) uploadBundle(pending *pendingBundle) []uploadResult {
+	defer pending.close()
+
+	id := ""
+	err := pending.err
+	if err == nil {
+		err = pending.bundle.Seal()
+	}
+	if err == nil {
+		c.logger().Debugf("Uploading bundle %s with %d files", pending.bundle.Path(), len(pending.members))
+		id, err = c.Upload(pending.bundle)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to upload bundle %s: %w", pending.bundle.Path(), err)
+	} else {
+		uploadBundlesCounter.Inc()
+		bundledFilesCounter.Add(float64(len(pending.members)))
+	}
+
+	size, _ := pending.bundle.Size()
+	results := make([]uploadResult, 0, len(pending.members))
+	for _, member := range pending.members {
+		member.file.bundleSize = size
+		results = append(results, uploadResult{change: member.change, committed: member.file, id: id, err: err})
+	}
+
+	return results
+}
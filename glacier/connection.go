@@ -12,6 +12,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/archive"
 	"github.com/mrdunski/accumulation-zone/index"
 	"github.com/mrdunski/accumulation-zone/logger"
 	"github.com/mrdunski/accumulation-zone/model"
@@ -39,12 +40,24 @@ type Cli interface {
 	InitiateJob(input *glacier.InitiateJobInput) (*glacier.InitiateJobOutput, error)
 	DescribeJob(input *glacier.DescribeJobInput) (*glacier.JobDescription, error)
 	GetJobOutput(input *glacier.GetJobOutputInput) (*glacier.GetJobOutputOutput, error)
+	InitiateMultipartUpload(input *glacier.InitiateMultipartUploadInput) (*glacier.InitiateMultipartUploadOutput, error)
+	UploadMultipartPart(input *glacier.UploadMultipartPartInput) (*glacier.UploadMultipartPartOutput, error)
+	CompleteMultipartUpload(input *glacier.CompleteMultipartUploadInput) (*glacier.ArchiveCreationOutput, error)
+	AbortMultipartUpload(input *glacier.AbortMultipartUploadInput) (*glacier.AbortMultipartUploadOutput, error)
+	ListParts(input *glacier.ListPartsInput) (*glacier.ListPartsOutput, error)
 }
 
 type Connection struct {
-	glacier   Cli
-	accountId string
-	vaultName string
+	glacier         Cli
+	accountId       string
+	vaultName       string
+	uploadOptions   UploadOptions
+	downloadOptions DownloadOptions
+	journal         *uploadJournal
+	restoreJournal  *restoreJournal
+	downloadDir     string
+	meter           *downloadMeter
+	codec           *archive.Codec
 }
 
 func NewConnection(cli Cli, vaultName, accountId string) Connection {
@@ -80,30 +93,54 @@ func OpenConnection(cfg VaultConfig) (*Connection, error) {
 	}, nil
 }
 
+// ConfigureUpload sets options used by Upload. Zero values fall back to defaults.
+func (c *Connection) ConfigureUpload(options UploadOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	c.uploadOptions = options
+
+	return nil
+}
+
+// ConfigureArchive sets codec used to encode archives before upload and decode them after download.
+func (c *Connection) ConfigureArchive(codec *archive.Codec) {
+	c.codec = codec
+}
+
 func (c *Connection) logger() *logrus.Entry {
 	return logger.WithComponent("glacier")
 }
 
 func (c *Connection) Process(committer model.ChangeCommitter, changes model.Changes) error {
-	var resultErr error
-	for _, change := range changes.Additions {
-		id, err := c.processAdd(change)
-		if err != nil {
-			resultErr = err
-			c.logger().WithError(err).Errorf("Failed to process change: %v", change)
-			continue
-		}
-		err = committer.CommitAdd(id, change)
-		if err != nil {
-			return err
-		}
+	return c.ProcessStream(committer, changes.Stream())
+}
+
+// ProcessStream uploads additions as soon as they arrive. Deletions are processed after the stream is complete
+// and only when all additions were uploaded.
+func (c *Connection) ProcessStream(committer model.ChangeCommitter, stream model.ChangeStream) error {
+	uploaded, uploadErr, err := c.processAdditions(committer, stream.Additions)
+	if err != nil {
+		return err
+	}
+
+	deletions, err := stream.Deletions()
+	if err != nil {
+		return err
 	}
 
-	if resultErr != nil {
-		return fmt.Errorf("upload failed: %w (check previous logs)", resultErr)
+	c.AbortUnwantedUploads(uploaded)
+
+	if uploadErr != nil {
+		return fmt.Errorf("upload failed: %w (check previous logs)", uploadErr)
 	}
 
-	for _, change := range changes.Deletions {
+	return c.ProcessDeletions(committer, deletions)
+}
+
+// ProcessDeletions deletes archives of deletions and commits them one by one.
+func (c *Connection) ProcessDeletions(committer model.ChangeCommitter, deletions []model.FileDeleted) error {
+	for _, change := range deletions {
 		id, err := c.processDelete(change)
 		if err != nil {
 			return err
@@ -117,18 +154,46 @@ func (c *Connection) Process(committer model.ChangeCommitter, changes model.Chan
 	return nil
 }
 
-func (c *Connection) processAdd(change model.FileAdded) (string, error) {
-	id, err := c.Upload(change)
-	if err != nil {
-		return "", err
+// processAdd uploads the change, encoded when codec is configured. It returns the file that should be committed.
+func (c *Connection) processAdd(change model.FileAdded) (model.HashedFile, string, error) {
+	if change.TombstoneId != "" {
+		c.logger().Debugf("Reviving %s - it is still stored in archive %s", change.Path(), change.TombstoneId)
+		return change, change.TombstoneId, nil
+	}
+	var encoded *archive.EncodedFile
+	if change.Hash() != "" {
+		var err error
+		encoded, err = c.codec.Encode(change)
+		if err != nil {
+			return change, "", fmt.Errorf("failed to encode %s: %w", change.Path(), err)
+		}
 	}
-	return id, nil
+	if encoded == nil {
+		id, err := c.Upload(change)
+		return change, id, err
+	}
+	defer func(encoded *archive.EncodedFile) {
+		if err := encoded.Close(); err != nil {
+			c.logger().WithError(err).Warnf("Failed to remove encoded content of %s", change.Path())
+		}
+	}(encoded)
+
+	id, err := c.Upload(encoded)
+	return encoded, id, err
 }
 
 func (c *Connection) processDelete(change model.FileDeleted) (string, error) {
 	if change.ChangeId() == "" {
 		return "", nil
 	}
+	if change.Tombstone {
+		c.logger().Debugf("Keeping archive %s of deleted %s until retention period passes", change.ChangeId(), change.Path())
+		return change.ChangeId(), nil
+	}
+	if change.KeepArchive {
+		c.logger().Debugf("Keeping archive %s of %s - it stores other files as well", change.ChangeId(), change.Path())
+		return change.ChangeId(), nil
+	}
 	err := c.Delete(change.ChangeId())
 	if err != nil {
 		return "", err
@@ -156,6 +221,23 @@ func (c *Connection) Delete(id string) error {
 }
 
 func (c *Connection) Upload(file model.FileWithContent) (id string, err error) {
+	if file.Hash() == "" {
+		return "", nil
+	}
+	checksum := archiveHash(file)
+
+	size, err := file.Size()
+	if err != nil {
+		return "", err
+	}
+	if size > c.uploadOptions.thresholdBytes() {
+		return c.uploadMultipart(file, size)
+	}
+	description, err := c.describe(file)
+	if err != nil {
+		return "", err
+	}
+
 	content, err := file.Content()
 	if err != nil {
 		return "", err
@@ -167,13 +249,8 @@ func (c *Connection) Upload(file model.FileWithContent) (id string, err error) {
 		}
 	}(content)
 
-	checksum := file.Hash()
-	if checksum == "" {
-		return "", nil
-	}
-
 	input := &glacier.UploadArchiveInput{
-		ArchiveDescription: aws.String(file.Path()),
+		ArchiveDescription: aws.String(description.String()),
 		Body:               aws.ReadSeekCloser(content),
 		Checksum:           &checksum,
 		AccountId:          &c.accountId,
@@ -191,6 +268,15 @@ func (c *Connection) Upload(file model.FileWithContent) (id string, err error) {
 	return *arch.ArchiveId, nil
 }
 
+// archiveHash is the tree hash of uploaded content. It differs from Hash for encoded files.
+func archiveHash(file model.FileWithContent) string {
+	if encoded, ok := file.(model.EncodedFile); ok {
+		return encoded.ArchiveHash()
+	}
+
+	return file.Hash()
+}
+
 func (c *Connection) reportSize(file model.FileWithContent, summary prometheus.Summary) {
 	size, err := file.Size()
 	if err != nil {
@@ -211,6 +297,7 @@ func (c *Connection) awaitJobCompletion(inputJob *glacier.JobDescription) (*glac
 	}
 
 	job := inputJob
+	poll := jobPoll{}
 	var err error
 
 	for job.StatusCode == nil || *job.StatusCode == "InProgress" {
@@ -220,11 +307,11 @@ func (c *Connection) awaitJobCompletion(inputJob *glacier.JobDescription) (*glac
 		if err != nil {
 			return nil, err
 		}
-		time.Sleep(1 * time.Second)
+		poll.wait(nil)
 	}
 
 	if *job.StatusCode == "Failed" {
-		return nil, fmt.Errorf("job failed: %s", flatString(job.StatusMessage))
+		return nil, fmt.Errorf("%w: %s", ErrJobFailed, flatString(job.StatusMessage))
 	}
 
 	c.logger().Debugf("Job [%s %s] has finished", flatString(inputJob.JobId), flatString(inputJob.JobDescription))
@@ -346,6 +433,40 @@ func (c *Connection) GetJobAwsOutput(jobId string) (*glacier.GetJobOutputOutput,
 	return output, nil
 }
 
+// getArchiveOutput returns output of archive retrieval job. Files stored in bundles are cut out of the bundle
+// with a ranged download.
+func (c *Connection) getArchiveOutput(jobId string, file model.IdentifiableHashedFile) (*glacier.GetJobOutputOutput, error) {
+	member, ok := file.(model.BundleMember)
+	if !ok {
+		return c.GetJobAwsOutput(jobId)
+	}
+	offset, length, bundled := member.BundleRange()
+	if !bundled {
+		return c.GetJobAwsOutput(jobId)
+	}
+
+	input := glacier.GetJobOutputInput{
+		AccountId: &c.accountId,
+		VaultName: &c.vaultName,
+		JobId:     &jobId,
+	}
+	if length > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+
+	c.logger().Debugf("Loading %s from bundle (job: %s, offset: %d, length: %d)", file.Path(), jobId, offset, length)
+	output, err := c.glacier.GetJobOutput(&input)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		_ = output.Body.Close()
+		output.Body = io.NopCloser(strings.NewReader(""))
+	}
+
+	return output, nil
+}
+
 func (c *Connection) GetJobOutput(jobId string) ([]byte, error) {
 	output, err := c.GetJobAwsOutput(jobId)
 	if err != nil {
@@ -367,13 +488,36 @@ func (c *Connection) getInventory() (inventory, error) {
 	if err != nil {
 		return inventory{}, fmt.Errorf("unsupported inventory format: %w", err)
 	}
+	c.openSealedHashes(i)
 
 	return i, nil
 }
 
+// openSealedHashes decrypts hashes of encrypted archives. Archives which hash can't be decrypted, e.g. because
+// they were encrypted with another key, are listed with the hash of the archive.
+func (c *Connection) openSealedHashes(i inventory) {
+	failed := 0
+	for j := range i.ArchiveList {
+		description := &i.ArchiveList[j].description
+		if description.SealedHash == "" {
+			continue
+		}
+		hash, err := c.codec.OpenHash(description.SealedHash)
+		if err != nil {
+			c.logger().WithError(err).Debugf("Can't decrypt hash of archive %s", i.ArchiveList[j].ArchiveId)
+			failed++
+			continue
+		}
+		description.Hash = hash
+	}
+	if failed > 0 {
+		c.logger().Warnf("Hashes of %d encrypted archives can't be decrypted - set the encryption key they were uploaded with", failed)
+	}
+}
+
 func (c *Connection) CreateArchiveJob(file model.IdentifiableHashedFile, options ArchiveRetrievalOptions) (*glacier.JobDescription, error) {
 	return c.createJob(glacier.JobParameters{
-		Description: aws.String(file.Path()),
+		Description: aws.String(jobDescription(file.Path())),
 		ArchiveId:   aws.String(file.ChangeId()),
 		Tier:        aws.String(string(options.Tier)),
 		Type:        aws.String("archive-retrieval"),
@@ -407,56 +551,26 @@ func (c *Connection) listAllJobs() ([]*glacier.JobDescription, error) {
 	return result, nil
 }
 
-func (c *Connection) findJobForFile(file model.IdentifiableHashedFile) (*glacier.JobDescription, error) {
-	jobs, err := c.listAllJobs()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, job := range jobs {
-		if *job.ArchiveId == file.ChangeId() {
-			return job, nil
-		}
-	}
-
-	return nil, nil
-}
-
-func (c *Connection) FindOrCreateArchiveJob(file model.IdentifiableHashedFile, options ArchiveRetrievalOptions) (*glacier.JobDescription, error) {
-	existingJob, err := c.findJobForFile(file)
-	if err != nil {
-		return nil, err
-	}
-
-	if existingJob != nil {
-		return existingJob, nil
-	}
-
-	return c.CreateArchiveJob(file, options)
-}
-
-func (c *Connection) LoadContentFromGlacier(file model.IdentifiableHashedFile) (model.FileWithContent, error) {
-	job, err := c.findJobForFile(file)
-	if err != nil {
-		return nil, err
-	}
-
-	if job == nil {
-		return nil, fmt.Errorf("there is no retrieval job for file %s, %s", file.Path(), file.ChangeId())
-	}
-
-	job, err = c.awaitJobCompletion(job)
-	if err != nil {
-		return nil, err
+// contentOf returns file retrieved by the completed job.
+func (c *Connection) contentOf(file model.IdentifiableHashedFile, job *glacier.JobDescription) model.FileWithContent {
+	encoding := ""
+	if encoded, ok := file.(model.EncodingHolder); ok {
+		encoding = encoded.Encoding()
 	}
 
 	openContent := func() (io.ReadCloser, error) {
-		output, err := c.GetJobAwsOutput(flatString(job.JobId))
+		body, err := c.openArchiveOutput(job, file)
 		if err != nil {
 			return nil, err
 		}
 
-		return output.Body, nil
+		content, err := c.codec.Decode(encoding, body)
+		if err != nil {
+			_ = body.Close()
+			return nil, fmt.Errorf("failed to decode %s: %w", file.Path(), err)
+		}
+
+		return archive.VerifyTreeHash(content, file.Hash()), nil
 	}
 
 	getSize := func() (int64, error) {
@@ -483,7 +597,7 @@ func (c *Connection) LoadContentFromGlacier(file model.IdentifiableHashedFile) (
 		openContent:            openContent,
 		IdentifiableHashedFile: file,
 		getSize:                getSize,
-	}, nil
+	}
 }
 
 func (c *Connection) ListInventoryAllFiles() ([]model.IdentifiableHashedFile, error) {
@@ -504,17 +618,40 @@ func (c *Connection) ListInventoryNewestFiles() (map[string]model.IdentifiableHa
 	return i.newestHashFiles(), nil
 }
 
-func (c *Connection) AddInventoryToIndex(idx index.Index) error {
+// AddInventoryToIndex replaces content of the index with archives listed in the inventory. Bundles are not
+// indexed, files packed in them are indexed instead, once manifests of bundles are retrieved.
+func (c *Connection) AddInventoryToIndex(idx index.Index, options ArchiveRetrievalOptions) error {
 	files, err := c.ListInventoryAllFiles()
 	if err != nil {
 		return err
 	}
 
+	var archives []model.IdentifiableHashedFile
+	var bundles []inventoryArchive
+	for _, file := range files {
+		listed, ok := file.(inventoryArchive)
+		if ok && listed.description.Bundle {
+			bundles = append(bundles, listed)
+			continue
+		}
+		if ok && listed.description.Truncated {
+			c.logger().Warnf("Path of archive %s was too long to be stored in its description - it is indexed as %s", file.ChangeId(), file.Path())
+		}
+		archives = append(archives, file)
+	}
+	members, err := c.loadBundleMembers(bundles, options)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		archives = append(archives, member)
+	}
+
 	err = idx.Clear()
 	if err != nil {
 		return fmt.Errorf("failed to clear index: %w", err)
 	}
-	for _, file := range files {
+	for _, file := range archives {
 		if err := idx.CommitAdd(file.ChangeId(), file); err != nil {
 			_ = idx.Clear()
 			return fmt.Errorf("failed to add to index [%s]: %w", file.Path(), err)
@@ -0,0 +1,177 @@
+package glacier
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mrdunski/accumulation-zone/archive"
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+const (
+	descriptionPrefix    = "az1:"
+	maxDescriptionLength = 1024
+	truncatedPathMarker  = "..."
+)
+
+// ArchiveDescription is kept by Glacier together with every archive, so the archive can be identified with
+// the inventory alone. Glacier accepts only printable ASCII up to 1024 characters, so it is stored as compressed
+// JSON encoded with base64 and prefixed with the format version. Archives uploaded by older versions are described
+// with a plain path.
+type ArchiveDescription struct {
+	Path string `json:"p"`
+	// Hash is a tree hash of the file content before encoding. Encrypted archives have SealedHash instead,
+	// so the content can't be recognized by its hash.
+	Hash       string `json:"h,omitempty"`
+	SealedHash string `json:"sh,omitempty"`
+	Size       int64  `json:"s,omitempty"`
+	ModTime    int64  `json:"m,omitempty"`
+	Mode       uint32 `json:"o,omitempty"`
+	Encoding   string `json:"e,omitempty"`
+	// Bundle is set for bundle archives, which contain many files.
+	Bundle bool `json:"b,omitempty"`
+	// ManifestOffset, ManifestLength and ManifestEncoding locate the list of files in a bundle archive.
+	ManifestOffset   int64  `json:"mo,omitempty"`
+	ManifestLength   int64  `json:"ml,omitempty"`
+	ManifestEncoding string `json:"me,omitempty"`
+	// Truncated is set when Path didn't fit in the description and only its end is kept.
+	Truncated bool `json:"t,omitempty"`
+}
+
+// describe creates a description of file which is about to be uploaded.
+func (c *Connection) describe(file model.FileWithContent) (ArchiveDescription, error) {
+	description := ArchiveDescription{
+		Path: file.Path(),
+		Hash: file.Hash(),
+	}
+	if encoded, ok := file.(model.EncodingHolder); ok {
+		description.Encoding = encoded.Encoding()
+	}
+	if isEncrypted(description.Encoding) {
+		sealed, err := c.codec.SealHash(description.Hash)
+		if err != nil {
+			return ArchiveDescription{}, fmt.Errorf("failed to encrypt hash of %s: %w", file.Path(), err)
+		}
+		description.Hash = ""
+		description.SealedHash = sealed
+	}
+	if bundle, ok := file.(*archive.Bundle); ok {
+		description.Bundle = true
+		description.ManifestOffset, description.ManifestLength, description.ManifestEncoding = bundle.Manifest()
+	}
+
+	if stat, err := statOf(file); err == nil {
+		description.Size = stat.Size()
+		description.ModTime = stat.ModTime().Unix()
+		description.Mode = uint32(stat.Mode())
+	} else if _, encoded := file.(model.EncodedFile); !encoded {
+		// size of encoded content is not the size of the file
+		if size, err := file.Size(); err == nil {
+			description.Size = size
+		}
+	}
+
+	return description, nil
+}
+
+func isEncrypted(encoding string) bool {
+	for _, e := range strings.Split(encoding, "+") {
+		if e == archive.EncodingAES256GCM {
+			return true
+		}
+	}
+
+	return false
+}
+
+func statOf(file model.FileWithContent) (os.FileInfo, error) {
+	if statHolder, ok := file.(model.StatHolder); ok {
+		return statHolder.Stat()
+	}
+
+	return nil, model.ErrStatUnknown
+}
+
+// String encodes the description in the format accepted by Glacier. Paths which are too long are cut from the
+// beginning, so the name of the file is kept.
+func (d ArchiveDescription) String() string {
+	encoded := d.encode()
+	for len(encoded) > maxDescriptionLength && d.Path != "" {
+		d.Truncated = true
+		d.Path = truncatePath(d.Path, len(d.Path)*maxDescriptionLength/len(encoded)-len(truncatedPathMarker))
+		encoded = d.encode()
+	}
+
+	return encoded
+}
+
+func (d ArchiveDescription) encode() string {
+	data, _ := json.Marshal(d)
+
+	buffer := &bytes.Buffer{}
+	writer, _ := flate.NewWriter(buffer, flate.BestCompression)
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+
+	return descriptionPrefix + base64.RawURLEncoding.EncodeToString(buffer.Bytes())
+}
+
+// truncatePath keeps at most length last bytes of path, without breaking multibyte characters.
+func truncatePath(path string, length int) string {
+	path = strings.TrimPrefix(path, truncatedPathMarker)
+	if length <= 0 {
+		return truncatedPathMarker
+	}
+	start := len(path) - length
+	for start < len(path) && !utf8.RuneStart(path[start]) {
+		start++
+	}
+
+	return truncatedPathMarker + path[start:]
+}
+
+// ParseArchiveDescription decodes description of an archive. Descriptions which are not in the current format
+// are plain paths.
+func ParseArchiveDescription(description string) ArchiveDescription {
+	if !strings.HasPrefix(description, descriptionPrefix) {
+		return ArchiveDescription{Path: description}
+	}
+
+	compressed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(description, descriptionPrefix))
+	if err != nil {
+		return ArchiveDescription{Path: description}
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return ArchiveDescription{Path: description}
+	}
+	result := ArchiveDescription{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return ArchiveDescription{Path: description}
+	}
+
+	return result
+}
+
+// jobDescription is a printable description of a job which retrieves file. Glacier has the same limits
+// for it as for archive descriptions.
+func jobDescription(path string) string {
+	printable := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, path)
+	if len(printable) > maxDescriptionLength {
+		printable = truncatedPathMarker + printable[len(printable)-maxDescriptionLength+len(truncatedPathMarker):]
+	}
+
+	return printable
+}
@@ -0,0 +1,64 @@
+package glacier_test
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/glacier"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ArchiveDescription", func() {
+	isPrintable := func(description string) bool {
+		for _, r := range description {
+			if r < ' ' || r > '~' {
+				return false
+			}
+		}
+		return true
+	}
+
+	It("encodes description as printable ASCII", func() {
+		description := glacier.ArchiveDescription{
+			Path:     "zdjęcia/wakacje/żółw.jpg",
+			Hash:     testFileHash,
+			Size:     1024,
+			ModTime:  time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+			Mode:     0640,
+			Encoding: "gzip+aes-256-gcm",
+		}
+
+		encoded := description.String()
+
+		Expect(encoded).To(HavePrefix("az1:"))
+		Expect(isPrintable(encoded)).To(BeTrue())
+		Expect(glacier.ParseArchiveDescription(encoded)).To(Equal(description))
+	})
+
+	It("parses legacy descriptions as paths", func() {
+		Expect(glacier.ParseArchiveDescription("some/dir/file.txt")).To(Equal(glacier.ArchiveDescription{Path: "some/dir/file.txt"}))
+		Expect(glacier.ParseArchiveDescription("az1:not encoded")).To(Equal(glacier.ArchiveDescription{Path: "az1:not encoded"}))
+	})
+
+	It("keeps end of a path which is too long", func() {
+		var segments []string
+		for i := 0; i < 200; i++ {
+			segments = append(segments, fmt.Sprintf("%x-ł", uint32(i*2654435761)))
+		}
+		path := strings.Join(segments, "/") + "/plik.txt"
+
+		encoded := glacier.ArchiveDescription{Path: path, Hash: testFileHash}.String()
+		decoded := glacier.ParseArchiveDescription(encoded)
+
+		Expect(len(encoded)).To(BeNumerically("<=", 1024))
+		Expect(isPrintable(encoded)).To(BeTrue())
+		Expect(decoded.Truncated).To(BeTrue())
+		Expect(decoded.Hash).To(Equal(testFileHash))
+		Expect(decoded.Path).To(HavePrefix("..."))
+		Expect(decoded.Path).To(HaveSuffix("/plik.txt"))
+		Expect(path).To(HaveSuffix(strings.TrimPrefix(decoded.Path, "...")))
+	})
+
+})
@@ -0,0 +1,250 @@
+package glacier
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/archive"
+	"github.com/mrdunski/accumulation-zone/model"
+	"github.com/mrdunski/accumulation-zone/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// staleDownloadAge is the time after which a partial download can't be resumed, as its job output has expired.
+const staleDownloadAge = jobOutputLifetime
+
+var downloadRetriesCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: telemetry.Namespace,
+	Name:      "glacier_download_retries_sum",
+})
+
+// ConfigureDownload sets options used to download job outputs. Zero values fall back to defaults.
+func (c *Connection) ConfigureDownload(options DownloadOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	c.downloadOptions = options
+	c.meter = &downloadMeter{bytesPerSecond: options.bandwidthBytes()}
+
+	return nil
+}
+
+// OpenDownloadDir makes downloads of job outputs resumable. Verified ranges of every download are kept in dir
+// until the download is complete. Partial downloads which are too old to be resumed are removed.
+func (c *Connection) OpenDownloadDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create download directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read download directory: %w", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleDownloadAge {
+			continue
+		}
+		c.logger().Infof("Removing stale partial download %s", entry.Name())
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			c.logger().WithError(err).Warnf("Failed to remove stale partial download %s", entry.Name())
+		}
+	}
+	c.downloadDir = dir
+
+	return nil
+}
+
+// openArchiveOutput returns content of archive retrieval job. Archives bigger than a single chunk are downloaded
+// range by range and every range is verified, the rest is streamed and verified at the end.
+func (c *Connection) openArchiveOutput(job *glacier.JobDescription, file model.IdentifiableHashedFile) (io.ReadCloser, error) {
+	jobId := flatString(job.JobId)
+	size := aws.Int64Value(job.ArchiveSizeInBytes)
+	if isBundled(file) || size <= c.downloadOptions.chunkSizeBytes() {
+		output, err := c.getArchiveOutput(jobId, file)
+		if err != nil {
+			return nil, err
+		}
+		body := c.meter.throttle(output.Body)
+		if checksum := flatString(output.Checksum); checksum != "" {
+			body = archive.VerifyTreeHash(body, checksum)
+		}
+
+		return c.meter.countVerified(body), nil
+	}
+
+	return c.downloadRanges(jobId, file, size)
+}
+
+func isBundled(file model.IdentifiableHashedFile) bool {
+	member, ok := file.(model.BundleMember)
+	if !ok {
+		return false
+	}
+	_, _, bundled := member.BundleRange()
+
+	return bundled
+}
+
+// downloadRanges downloads output of the job to a partial file. A download interrupted earlier is resumed from
+// the last verified range. The partial file is removed when the returned content is closed.
+func (c *Connection) downloadRanges(jobId string, file model.IdentifiableHashedFile, size int64) (_ io.ReadCloser, err error) {
+	partial, err := c.openPartialDownload(jobId, file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		_ = partial.Close()
+		if c.downloadDir == "" {
+			_ = os.Remove(partial.Name())
+		}
+	}()
+
+	chunkSize := c.downloadOptions.chunkSizeBytes()
+	info, err := partial.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size()
+	if offset != size {
+		// only complete ranges were verified
+		offset -= offset % chunkSize
+	}
+	if offset > size {
+		offset = 0
+	}
+	// only ranges recorded in the restore journal are trusted, the rest could have been written partially -
+	// the partial download belongs to this file only, so its journaled offset applies to all its bytes
+	if journaled, ok := c.restoreJournal.find(file); ok && journaled.JobId == jobId && journaled.Offset < offset {
+		offset = journaled.Offset
+	}
+	if err := partial.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		c.logger().Infof("Resuming download of %s from %d of %d bytes", file.Path(), offset, size)
+		c.meter.resumed(offset)
+	}
+	if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	for ; offset < size; offset += chunkSize {
+		end := offset + chunkSize
+		if end > size {
+			end = size
+		}
+		data, err := c.downloadRange(jobId, file, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := partial.Write(data); err != nil {
+			return nil, err
+		}
+		if err := partial.Sync(); err != nil {
+			return nil, err
+		}
+		c.meter.verified(end - offset)
+		if err := c.restoreJournal.recordOffset(file, jobId, end); err != nil {
+			c.logger().WithError(err).Errorf("Failed to journal download of %s", file.Path())
+		}
+		c.logger().Debugf("Downloaded %d of %d bytes of %s", end, size, file.Path())
+	}
+
+	if _, err := partial.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return partialDownload{File: partial}, nil
+}
+
+// openPartialDownload opens the file where output of the job is downloaded for file. Every file has its own
+// partial download, so files restored from the same job are downloaded concurrently. Without download directory,
+// the download can't be resumed.
+func (c *Connection) openPartialDownload(jobId string, file model.HashedFile) (*os.File, error) {
+	if c.downloadDir == "" {
+		return os.CreateTemp("", "az-download-*")
+	}
+	name := fmt.Sprintf("%x", sha256.Sum256([]byte(jobId+"\x00"+file.Path())))
+
+	return os.OpenFile(filepath.Join(c.downloadDir, name), os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// downloadRange downloads bytes from offset to end (exclusive) of job output. It is retried with exponential
+// backoff when it fails or doesn't match its checksum.
+func (c *Connection) downloadRange(jobId string, file model.IdentifiableHashedFile, offset, end int64) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= c.downloadOptions.DownloadRetries; attempt++ {
+		if attempt > 0 {
+			downloadRetriesCounter.Inc()
+			delay := c.downloadOptions.retryDelay(attempt)
+			c.logger().WithError(err).Warnf("Retrying download of bytes %d-%d of %s in %v (attempt %d)", offset, end-1, file.Path(), delay, attempt+1)
+			time.Sleep(delay)
+		}
+		var data []byte
+		data, err = c.getRange(jobId, offset, end)
+		if err == nil {
+			return data, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to download bytes %d-%d of %s: %w", offset, end-1, file.Path(), err)
+}
+
+func (c *Connection) getRange(jobId string, offset, end int64) (_ []byte, err error) {
+	output, err := c.glacier.GetJobOutput(&glacier.GetJobOutputInput{
+		AccountId: &c.accountId,
+		VaultName: &c.vaultName,
+		JobId:     &jobId,
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func(body io.Closer) {
+		closeErr := body.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}(output.Body)
+
+	data, err := io.ReadAll(c.meter.throttle(output.Body))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-offset {
+		return nil, fmt.Errorf("expected %d bytes, got %d", end-offset, len(data))
+	}
+	if checksum := flatString(output.Checksum); checksum != "" {
+		if actual := fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(data)).TreeHash); actual != checksum {
+			return nil, fmt.Errorf("%w: range hashes to %s, expected %s", ErrTreeHashMismatch, actual, checksum)
+		}
+	}
+
+	return data, nil
+}
+
+// partialDownload is a complete download, which is removed once it is read.
+type partialDownload struct {
+	*os.File
+}
+
+func (d partialDownload) Close() error {
+	closeErr := d.File.Close()
+	if err := os.Remove(d.Name()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return closeErr
+}
@@ -0,0 +1,113 @@
+package glacier
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMeteredRead keeps single reads small, so a bandwidth limit is kept smoothly.
+const maxMeteredRead = 32 * 1024
+
+// downloadMeter counts verified bytes downloaded by all workers and keeps downloads together within the bandwidth
+// limit. Bytes are counted once they match their checksum, so retried downloads are not counted twice. A nil meter
+// doesn't count nor limit anything.
+type downloadMeter struct {
+	downloaded atomic.Int64
+
+	mu             sync.Mutex
+	bytesPerSecond int64
+	// next is the time from which the next read fits in the limit
+	next time.Time
+}
+
+// throttle returns body which reads are kept within the bandwidth limit.
+func (m *downloadMeter) throttle(body io.ReadCloser) io.ReadCloser {
+	if m == nil || m.bytesPerSecond <= 0 {
+		return body
+	}
+
+	return throttledBody{ReadCloser: body, meter: m}
+}
+
+// countVerified returns body which bytes are counted once it is read to the end without an error, i.e. once
+// it is verified.
+func (m *downloadMeter) countVerified(body io.ReadCloser) io.ReadCloser {
+	if m == nil {
+		return body
+	}
+
+	return &countedBody{ReadCloser: body, meter: m}
+}
+
+// verified counts bytes of a range which matched its checksum.
+func (m *downloadMeter) verified(bytes int64) {
+	if m != nil {
+		m.downloaded.Add(bytes)
+	}
+}
+
+// resumed counts bytes downloaded and verified by an interrupted run.
+func (m *downloadMeter) resumed(bytes int64) {
+	m.verified(bytes)
+}
+
+func (m *downloadMeter) bytes() int64 {
+	if m == nil {
+		return 0
+	}
+
+	return m.downloaded.Load()
+}
+
+// wait blocks until reading n bytes fits in the bandwidth limit. Reads of all workers are spread evenly in time.
+func (m *downloadMeter) wait(n int) {
+	if m.bytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	now := time.Now()
+	if m.next.Before(now) {
+		m.next = now
+	}
+	delay := m.next.Sub(now)
+	m.next = m.next.Add(time.Duration(float64(n) / float64(m.bytesPerSecond) * float64(time.Second)))
+	m.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	meter *downloadMeter
+}
+
+func (b throttledBody) Read(p []byte) (int, error) {
+	if len(p) > maxMeteredRead {
+		p = p[:maxMeteredRead]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.meter.wait(n)
+
+	return n, err
+}
+
+type countedBody struct {
+	io.ReadCloser
+	meter *downloadMeter
+	// read is the number of bytes not counted yet
+	read int64
+}
+
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.meter.verified(b.read)
+		b.read = 0
+	}
+
+	return n, err
+}
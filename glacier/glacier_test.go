@@ -1,6 +1,9 @@
 package glacier_test
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,12 +13,16 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awsutil"
 	awsGlacier "github.com/aws/aws-sdk-go/service/glacier"
 	"github.com/golang/mock/gomock"
+	"github.com/mrdunski/accumulation-zone/archive"
 	"github.com/mrdunski/accumulation-zone/files"
 	"github.com/mrdunski/accumulation-zone/glacier"
 	"github.com/mrdunski/accumulation-zone/glacier/mock_glacier"
@@ -34,6 +41,7 @@ const (
 	testFileHash    = "mockedHash"
 	testFilePath    = "mockedPath"
 	testFileId      = "mockedId"
+	mebibyte        = 1024 * 1024
 )
 
 func TestGlacier(t *testing.T) {
@@ -84,6 +92,27 @@ var _ = Describe("Connection", func() {
 		}, out)
 	}
 
+	// restoreFile plans restore of the file with existing jobs and returns content passed to save
+	restoreFile := func(file model.IdentifiableHashedFile) ([]byte, error) {
+		options := glacier.ArchiveRetrievalOptions{}
+		plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{file}, options)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		err = connection.Restore(plan, options, func(content model.FileWithContent) error {
+			reader, err := content.Content()
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			data, err = io.ReadAll(reader)
+			return err
+		})
+
+		return data, err
+	}
+
 	BeforeEach(func() {
 		glacierCli = mock_glacier.NewMockCli(gomock.NewController(GinkgoT()))
 		connection = glacier.NewConnection(glacierCli, testVaultName, testAccountId)
@@ -116,7 +145,7 @@ var _ = Describe("Connection", func() {
 						VaultName:          aws.String(testVaultName),
 						AccountId:          aws.String(testAccountId),
 						Checksum:           aws.String(testFileHash),
-						ArchiveDescription: aws.String(testFilePath),
+						ArchiveDescription: aws.String(glacier.ArchiveDescription{Path: testFilePath, Hash: testFileHash, Size: 100}.String()),
 						Body:               aws.ReadSeekCloser(strings.NewReader(testFileContent)),
 					},
 				).
@@ -129,6 +158,32 @@ var _ = Describe("Connection", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It("describes archive with attributes of the file", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "żółw.txt"), []byte(testFileContent), 0640)).To(Succeed())
+			modTime := time.Date(2022, 5, 6, 7, 8, 9, 0, time.UTC)
+			Expect(os.Chtimes(filepath.Join(dir, "żółw.txt"), modTime, modTime)).To(Succeed())
+			file, err := files.NewVolume(dir).LoadFile("żółw.txt")
+			Expect(err).NotTo(HaveOccurred())
+			var description glacier.ArchiveDescription
+			glacierCli.EXPECT().UploadArchive(gomock.Any()).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+				description = glacier.ParseArchiveDescription(*input.ArchiveDescription)
+				return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("testArchive1")}, nil
+			})
+			committer.EXPECT().CommitAdd("testArchive1", gomock.Any()).Return(nil)
+
+			err = connection.Process(committer, model.Changes{Additions: []model.FileAdded{{FileWithContent: file}}})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(description).To(Equal(glacier.ArchiveDescription{
+				Path:    "żółw.txt",
+				Hash:    file.Hash(),
+				Size:    int64(len(testFileContent)),
+				ModTime: modTime.Unix(),
+				Mode:    0640,
+			}))
+		})
+
 		It("handles delete", func() {
 			change := model.FileDeleted{IdentifiableHashedFile: FileWithChangeId{
 				changeId:   "deletedArchive1",
@@ -149,6 +204,111 @@ var _ = Describe("Connection", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It("keeps archive of a tombstone", func() {
+			change := model.FileDeleted{IdentifiableHashedFile: FileWithChangeId{
+				changeId:   "deletedArchive1",
+				HashedFile: exampleFile,
+			}, Tombstone: true}
+			committer.EXPECT().CommitDelete("deletedArchive1", change).Return(nil)
+
+			err := connection.Process(committer, model.Changes{Deletions: []model.FileDeleted{change}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("revives file without upload", func() {
+			change := model.FileAdded{FileWithContent: exampleFile, TombstoneId: "keptArchive"}
+			committer.EXPECT().CommitAdd("keptArchive", change).Return(nil)
+
+			err := connection.Process(committer, model.Changes{Additions: []model.FileAdded{change}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("with concurrent uploads", func() {
+			var additions []model.FileAdded
+
+			BeforeEach(func() {
+				Expect(connection.ConfigureUpload(glacier.UploadOptions{UploadWorkers: 3})).To(Succeed())
+				additions = nil
+				for i := 0; i < 6; i++ {
+					file := mock_model.NewMockFileWithContent(gomock.NewController(GinkgoT()))
+					file.EXPECT().Hash().AnyTimes().Return(testFileHash)
+					file.EXPECT().Path().AnyTimes().Return(fmt.Sprintf("file%d", i))
+					file.EXPECT().Size().AnyTimes().Return(int64(100), nil)
+					file.EXPECT().Content().AnyTimes().DoAndReturn(func() (io.ReadCloser, error) {
+						return io.NopCloser(strings.NewReader(testFileContent)), nil
+					})
+					additions = append(additions, model.FileAdded{FileWithContent: file})
+				}
+			})
+
+			It("commits every upload one at a time", func() {
+				var active, maxActive int32
+				glacierCli.EXPECT().UploadArchive(gomock.Any()).Times(len(additions)).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+					return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("id-" + glacier.ParseArchiveDescription(*input.ArchiveDescription).Path)}, nil
+				})
+				committed := map[string]string{}
+				committer.EXPECT().CommitAdd(gomock.Any(), gomock.Any()).Times(len(additions)).DoAndReturn(func(id string, file model.HashedFile) error {
+					if current := atomic.AddInt32(&active, 1); current > atomic.LoadInt32(&maxActive) {
+						atomic.StoreInt32(&maxActive, current)
+					}
+					defer atomic.AddInt32(&active, -1)
+					committed[file.Path()] = id
+					return nil
+				})
+
+				err := connection.Process(committer, model.Changes{Additions: additions})
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(maxActive).To(Equal(int32(1)))
+				Expect(committed).To(HaveLen(len(additions)))
+				Expect(committed).To(HaveKeyWithValue("file3", "id-file3"))
+			})
+
+			It("skips deletions when any upload fails", func() {
+				uploadErr := errors.New("upload failed")
+				glacierCli.EXPECT().UploadArchive(gomock.Any()).Times(len(additions)).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+					if glacier.ParseArchiveDescription(*input.ArchiveDescription).Path == "file2" {
+						return nil, uploadErr
+					}
+					return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("id-" + glacier.ParseArchiveDescription(*input.ArchiveDescription).Path)}, nil
+				})
+				committer.EXPECT().CommitAdd(gomock.Any(), gomock.Any()).Times(len(additions) - 1).Return(nil)
+				deletion := model.FileDeleted{IdentifiableHashedFile: FileWithChangeId{changeId: "deletedArchive1", HashedFile: exampleFile}}
+
+				err := connection.Process(committer, model.Changes{Additions: additions, Deletions: []model.FileDeleted{deletion}})
+
+				Expect(err).To(WrapError(uploadErr))
+			})
+
+			It("stops on commit error", func() {
+				commitErr := errors.New("disk full")
+				glacierCli.EXPECT().UploadArchive(gomock.Any()).MinTimes(1).MaxTimes(len(additions)).Return(&awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("id")}, nil)
+				committer.EXPECT().CommitAdd(gomock.Any(), gomock.Any()).Return(commitErr)
+
+				err := connection.Process(committer, model.Changes{Additions: additions})
+
+				Expect(err).To(WrapError(commitErr))
+			})
+		})
+
+		It("skips deletions when stream fails", func() {
+			scanErr := errors.New("scan failed")
+			additions := make(chan model.FileAdded, 1)
+			additions <- model.FileAdded{FileWithContent: exampleFile}
+			close(additions)
+			glacierCli.EXPECT().UploadArchive(gomock.Any()).Return(&awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("testArchive1")}, nil)
+			committer.EXPECT().CommitAdd("testArchive1", gomock.Any()).Return(nil)
+
+			err := connection.ProcessStream(committer, model.ChangeStream{
+				Additions: additions,
+				Deletions: func() ([]model.FileDeleted, error) {
+					return nil, scanErr
+				},
+			})
+
+			Expect(err).To(WrapError(scanErr))
+		})
+
 		It("handles commit err", func() {
 			change := model.FileDeleted{IdentifiableHashedFile: FileWithChangeId{
 				changeId:   "deletedArchive1",
@@ -163,6 +323,1106 @@ var _ = Describe("Connection", func() {
 		})
 	})
 
+	DescribeTable("validates upload options", func(options glacier.UploadOptions, valid bool) {
+		err := connection.ConfigureUpload(options)
+		if valid {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(err).To(HaveOccurred())
+		}
+	},
+		Entry("defaults", glacier.UploadOptions{}, true),
+		Entry("threshold of single upload limit", glacier.UploadOptions{MultipartThreshold: 4096}, true),
+		Entry("threshold above single upload limit", glacier.UploadOptions{MultipartThreshold: 4097}, false),
+		Entry("negative threshold", glacier.UploadOptions{MultipartThreshold: -1}, false),
+		Entry("part size not a power of two", glacier.UploadOptions{PartSize: 3}, false),
+	)
+
+	Describe("Upload in parts", func() {
+		var bigFile *mock_model.MockFileWithContent
+		var bigContent []byte
+		var bigHash string
+
+		BeforeEach(func() {
+			bigContent = []byte(strings.Repeat("0123456789abcdef", 160*1024))
+			bigHash = fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(bigContent)).TreeHash)
+			bigFile = mock_model.NewMockFileWithContent(gomock.NewController(GinkgoT()))
+			bigFile.EXPECT().Path().AnyTimes().Return(testFilePath)
+			bigFile.EXPECT().Size().AnyTimes().Return(int64(len(bigContent)), nil)
+			bigFile.EXPECT().Content().AnyTimes().DoAndReturn(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(bigContent)), nil
+			})
+			Expect(connection.ConfigureUpload(glacier.UploadOptions{MultipartThreshold: 1, PartSize: 1})).To(Succeed())
+			glacierCli.EXPECT().InitiateMultipartUpload(gomock.Any()).DoAndReturn(func(input *awsGlacier.InitiateMultipartUploadInput) (*awsGlacier.InitiateMultipartUploadOutput, error) {
+				Expect(*input.AccountId).To(Equal(testAccountId))
+				Expect(*input.VaultName).To(Equal(testVaultName))
+				Expect(*input.PartSize).To(Equal("1048576"))
+				description := glacier.ParseArchiveDescription(*input.ArchiveDescription)
+				Expect(description.Path).To(Equal(testFilePath))
+				Expect(description.Size).To(Equal(int64(len(bigContent))))
+				return &awsGlacier.InitiateMultipartUploadOutput{UploadId: aws.String("anUpload")}, nil
+			})
+		})
+
+		It("uploads big file in parts", func() {
+			bigFile.EXPECT().Hash().AnyTimes().Return(bigHash)
+			var ranges []string
+			glacierCli.EXPECT().UploadMultipartPart(gomock.Any()).Times(3).DoAndReturn(func(input *awsGlacier.UploadMultipartPartInput) (*awsGlacier.UploadMultipartPartOutput, error) {
+				ranges = append(ranges, *input.Range)
+				return &awsGlacier.UploadMultipartPartOutput{Checksum: input.Checksum}, nil
+			})
+			glacierCli.EXPECT().CompleteMultipartUpload(gomock.Eq(&awsGlacier.CompleteMultipartUploadInput{
+				AccountId:   aws.String(testAccountId),
+				VaultName:   aws.String(testVaultName),
+				UploadId:    aws.String("anUpload"),
+				ArchiveSize: aws.String("2621440"),
+				Checksum:    aws.String(bigHash),
+			})).Return(&awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("bigArchive")}, nil)
+
+			id, err := connection.Upload(bigFile)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal("bigArchive"))
+			Expect(ranges).To(Equal([]string{"bytes 0-1048575/*", "bytes 1048576-2097151/*", "bytes 2097152-2621439/*"}))
+		})
+
+		It("aborts upload when parts don't match file hash", func() {
+			bigFile.EXPECT().Hash().AnyTimes().Return(testFileHash)
+			glacierCli.EXPECT().UploadMultipartPart(gomock.Any()).Times(3).Return(&awsGlacier.UploadMultipartPartOutput{}, nil)
+			glacierCli.EXPECT().AbortMultipartUpload(gomock.Eq(&awsGlacier.AbortMultipartUploadInput{
+				AccountId: aws.String(testAccountId),
+				VaultName: aws.String(testVaultName),
+				UploadId:  aws.String("anUpload"),
+			})).Return(&awsGlacier.AbortMultipartUploadOutput{}, nil)
+
+			id, err := connection.Upload(bigFile)
+
+			Expect(err).To(WrapError(glacier.ErrTreeHashMismatch))
+			Expect(id).To(BeEmpty())
+		})
+
+		Context("with upload journal", func() {
+			var journalPath string
+
+			BeforeEach(func() {
+				bigFile.EXPECT().Hash().AnyTimes().Return(bigHash)
+				journalPath = filepath.Join(GinkgoT().TempDir(), ".changes.log.uploads")
+				Expect(connection.OpenUploadJournal(journalPath)).To(Succeed())
+			})
+
+			It("resumes interrupted upload", func() {
+				uploadErr := errors.New("connection reset")
+				uploadedParts := map[string]string{}
+				glacierCli.EXPECT().UploadMultipartPart(gomock.Any()).Times(2).DoAndReturn(func(input *awsGlacier.UploadMultipartPartInput) (*awsGlacier.UploadMultipartPartOutput, error) {
+					if len(uploadedParts) == 1 {
+						return nil, uploadErr
+					}
+					uploadedParts[*input.Range] = *input.Checksum
+					return &awsGlacier.UploadMultipartPartOutput{Checksum: input.Checksum}, nil
+				})
+
+				_, err := connection.Upload(bigFile)
+				Expect(err).To(WrapError(uploadErr))
+				Expect(journalPath).To(BeAnExistingFile())
+
+				glacierCli.EXPECT().ListParts(gomock.Eq(&awsGlacier.ListPartsInput{
+					AccountId: aws.String(testAccountId),
+					VaultName: aws.String(testVaultName),
+					UploadId:  aws.String("anUpload"),
+				})).Return(&awsGlacier.ListPartsOutput{Parts: []*awsGlacier.PartListElement{{
+					RangeInBytes:   aws.String("0-1048575"),
+					SHA256TreeHash: aws.String(uploadedParts["bytes 0-1048575/*"]),
+				}}}, nil)
+				var resumedRanges []string
+				glacierCli.EXPECT().UploadMultipartPart(gomock.Any()).Times(2).DoAndReturn(func(input *awsGlacier.UploadMultipartPartInput) (*awsGlacier.UploadMultipartPartOutput, error) {
+					resumedRanges = append(resumedRanges, *input.Range)
+					return &awsGlacier.UploadMultipartPartOutput{Checksum: input.Checksum}, nil
+				})
+				glacierCli.EXPECT().CompleteMultipartUpload(gomock.Any()).Return(&awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("bigArchive")}, nil)
+
+				id, err := connection.Upload(bigFile)
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(id).To(Equal("bigArchive"))
+				Expect(resumedRanges).To(Equal([]string{"bytes 1048576-2097151/*", "bytes 2097152-2621439/*"}))
+				Expect(journalPath).NotTo(BeAnExistingFile())
+			})
+
+			It("aborts upload that is no longer wanted", func() {
+				glacierCli.EXPECT().UploadMultipartPart(gomock.Any()).Return(nil, errors.New("connection reset"))
+				_, err := connection.Upload(bigFile)
+				Expect(err).To(HaveOccurred())
+
+				glacierCli.EXPECT().AbortMultipartUpload(gomock.Eq(&awsGlacier.AbortMultipartUploadInput{
+					AccountId: aws.String(testAccountId),
+					VaultName: aws.String(testVaultName),
+					UploadId:  aws.String("anUpload"),
+				})).Return(&awsGlacier.AbortMultipartUploadOutput{}, nil)
+
+				connection.AbortUnwantedUploads(nil)
+
+				Expect(journalPath).NotTo(BeAnExistingFile())
+			})
+		})
+	})
+
+	Describe("Bundles", func() {
+		var committer *mock_model.MockChangeCommitter
+
+		BeforeEach(func() {
+			committer = mock_model.NewMockChangeCommitter(gomock.NewController(GinkgoT()))
+			Expect(connection.ConfigureUpload(glacier.UploadOptions{UploadWorkers: 3, BundleThreshold: 1})).To(Succeed())
+		})
+
+		newSmallFile := func(path, content string) model.FileAdded {
+			file := mock_model.NewMockFileWithContent(gomock.NewController(GinkgoT()))
+			file.EXPECT().Path().AnyTimes().Return(path)
+			file.EXPECT().Hash().AnyTimes().Return(fmt.Sprintf("%x", awsGlacier.ComputeHashes(strings.NewReader(content)).TreeHash))
+			file.EXPECT().Size().AnyTimes().Return(int64(len(content)), nil)
+			file.EXPECT().Content().AnyTimes().DoAndReturn(func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(content)), nil
+			})
+			return model.FileAdded{FileWithContent: file}
+		}
+
+		It("packs small files into a bundle", func() {
+			contents := map[string]string{}
+			var additions []model.FileAdded
+			for i := 0; i < 5; i++ {
+				path := fmt.Sprintf("small%d.txt", i)
+				contents[path] = strings.Repeat(fmt.Sprintf("content of file %d\n", i), i+1)
+				additions = append(additions, newSmallFile(path, contents[path]))
+			}
+			bigContent := strings.Repeat("x", 2048)
+			additions = append(additions, newSmallFile("big.txt", bigContent))
+
+			var bundle []byte
+			glacierCli.EXPECT().UploadArchive(gomock.Any()).Times(2).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+				description := glacier.ParseArchiveDescription(*input.ArchiveDescription)
+				if description.Path == "big.txt" {
+					return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("bigArchive")}, nil
+				}
+				Expect(description.Path).To(HavePrefix(archive.BundlePathPrefix))
+				Expect(description.Bundle).To(BeTrue())
+				var err error
+				bundle, err = io.ReadAll(input.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*input.Checksum).To(Equal(fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(bundle)).TreeHash)))
+				return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("bundleArchive")}, nil
+			})
+			committed := map[string]model.BundleMember{}
+			committer.EXPECT().CommitAdd("bundleArchive", gomock.Any()).Times(5).DoAndReturn(func(_ string, file model.HashedFile) error {
+				committed[file.Path()] = file.(model.BundleMember)
+				return nil
+			})
+			committer.EXPECT().CommitAdd("bigArchive", gomock.Any()).Return(nil)
+
+			err := connection.Process(committer, model.Changes{Additions: additions})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(committed).To(HaveLen(5))
+			for path, member := range committed {
+				offset, length, ok := member.BundleRange()
+				Expect(ok).To(BeTrue())
+				Expect(string(bundle[offset : offset+length])).To(Equal(contents[path]))
+			}
+		})
+
+		It("indexes files of bundle listed in the inventory", func() {
+			contents := map[string]string{"a/first.txt": "first file", "b/second.txt": "second file"}
+			var additions []model.FileAdded
+			for path, content := range contents {
+				additions = append(additions, newSmallFile(path, content))
+			}
+			var bundle []byte
+			var description string
+			glacierCli.EXPECT().UploadArchive(gomock.Any()).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+				description = *input.ArchiveDescription
+				var err error
+				bundle, err = io.ReadAll(input.Body)
+				Expect(err).NotTo(HaveOccurred())
+				return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("bundleArchive")}, nil
+			})
+			committer.EXPECT().CommitAdd("bundleArchive", gomock.Any()).Times(2).Return(nil)
+			Expect(connection.Process(committer, model.Changes{Additions: additions})).To(Succeed())
+
+			inventory, err := json.Marshal(map[string]any{"ArchiveList": []map[string]any{{
+				"ArchiveId":          "bundleArchive",
+				"ArchiveDescription": description,
+				"CreationDate":       "2023-01-02T15:04:05Z",
+				"Size":               len(bundle),
+				"SHA256TreeHash":     fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(bundle)).TreeHash),
+			}}})
+			Expect(err).NotTo(HaveOccurred())
+			mockSuccessfulInventoryJob(string(inventory))
+			mockNoJobs()
+			byteRange := fmt.Sprintf("0-%d", len(bundle)-1)
+			manifestJob := awsGlacier.JobDescription{JobId: aws.String("manifestJob"), ArchiveId: aws.String("bundleArchive"), RetrievalByteRange: aws.String(byteRange), StatusCode: aws.String("Succeeded")}
+			glacierCli.EXPECT().InitiateJob(gomock.Any()).DoAndReturn(func(input *awsGlacier.InitiateJobInput) (*awsGlacier.InitiateJobOutput, error) {
+				Expect(*input.JobParameters.ArchiveId).To(Equal("bundleArchive"))
+				Expect(*input.JobParameters.RetrievalByteRange).To(Equal(byteRange))
+				return &awsGlacier.InitiateJobOutput{JobId: manifestJob.JobId}, nil
+			})
+			glacierCli.EXPECT().DescribeJob(gomock.Any()).Return(&manifestJob, nil)
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).DoAndReturn(func(input *awsGlacier.GetJobOutputInput) (*awsGlacier.GetJobOutputOutput, error) {
+				Expect(*input.JobId).To(Equal("manifestJob"))
+				var start, end int
+				_, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end)
+				Expect(err).NotTo(HaveOccurred())
+				return &awsGlacier.GetJobOutputOutput{Body: io.NopCloser(bytes.NewReader(bundle[start : end+1]))}, nil
+			})
+
+			idxPath := filepath.Join(GinkgoT().TempDir(), "idx.log")
+			idx, err := index.LoadIndexFile(idxPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(connection.AddInventoryToIndex(idx, glacier.ArchiveRetrievalOptions{Tier: glacier.TierBulk})).To(Succeed())
+
+			idx, err = index.LoadIndexFile(idxPath)
+			Expect(err).NotTo(HaveOccurred())
+			indexed := idx.CalculateChanges(nil).Deletions
+			Expect(indexed).To(HaveLen(2))
+			for _, file := range indexed {
+				Expect(file.ChangeId()).To(Equal("bundleArchive"))
+				Expect(file.Path()).NotTo(HavePrefix(archive.BundlePathPrefix))
+				offset, length, ok := file.IdentifiableHashedFile.(model.BundleMember).BundleRange()
+				Expect(ok).To(BeTrue())
+				Expect(string(bundle[offset : offset+length])).To(Equal(contents[file.Path()]))
+				Expect(file.Hash()).To(Equal(fmt.Sprintf("%x", awsGlacier.ComputeHashes(strings.NewReader(contents[file.Path()])).TreeHash)))
+			}
+		})
+
+		It("restores encrypted files of bundle missing in the volume", func() {
+			keyFile := filepath.Join(GinkgoT().TempDir(), "key")
+			Expect(os.WriteFile(keyFile, []byte(strings.Repeat("0f", 32)), 0600)).To(Succeed())
+			codec, err := archive.NewCodec(archive.Options{EncryptionKeyFile: keyFile})
+			Expect(err).NotTo(HaveOccurred())
+			connection.ConfigureArchive(codec)
+			contents := map[string]string{"a/first.txt": "first file", "b/second.txt": "second file"}
+			var additions []model.FileAdded
+			for path, content := range contents {
+				additions = append(additions, newSmallFile(path, content))
+			}
+			var bundle []byte
+			glacierCli.EXPECT().UploadArchive(gomock.Any()).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+				bundle, err = io.ReadAll(input.Body)
+				Expect(err).NotTo(HaveOccurred())
+				return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("bundleArchive")}, nil
+			})
+			idx, err := index.LoadIndexFile(filepath.Join(GinkgoT().TempDir(), "idx.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(connection.Process(idx, model.Changes{Additions: additions})).To(Succeed())
+
+			job := awsGlacier.JobDescription{JobId: aws.String("bundleJob"), ArchiveId: aws.String("bundleArchive"), StatusCode: aws.String("Succeeded"), ArchiveSizeInBytes: aws.Int64(int64(len(bundle)))}
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&job}}, nil)
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).Times(2).DoAndReturn(func(input *awsGlacier.GetJobOutputInput) (*awsGlacier.GetJobOutputOutput, error) {
+				Expect(input.Range).NotTo(BeNil())
+				var start, end int
+				_, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end)
+				Expect(err).NotTo(HaveOccurred())
+				return &awsGlacier.GetJobOutputOutput{Body: io.NopCloser(bytes.NewReader(bundle[start : end+1]))}, nil
+			})
+			var missing []model.IdentifiableHashedFile
+			for _, deletion := range idx.CalculateChanges(nil).Deletions {
+				missing = append(missing, deletion)
+			}
+			options := glacier.ArchiveRetrievalOptions{}
+
+			plan, err := connection.PlanRestore(missing, options)
+			Expect(err).NotTo(HaveOccurred())
+			restored := map[string]string{}
+			mutex := sync.Mutex{}
+			err = connection.Restore(plan, options, func(file model.FileWithContent) error {
+				content, err := file.Content()
+				if err != nil {
+					return err
+				}
+				defer content.Close()
+				data, err := io.ReadAll(content)
+				mutex.Lock()
+				defer mutex.Unlock()
+				restored[file.Path()] = string(data)
+				return err
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(contents))
+			Expect(plan.Archives).To(HaveLen(1))
+			Expect(plan.Archives[0].Size).To(Equal(int64(len(bundle))))
+		})
+
+		It("keeps archive shared with other files", func() {
+			deletion := model.FileDeleted{IdentifiableHashedFile: NewFile("bundleArchive"), KeepArchive: true}
+			committer.EXPECT().CommitDelete("bundleArchive", deletion).Return(nil)
+
+			err := connection.Process(committer, model.Changes{Deletions: []model.FileDeleted{deletion}})
+
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("loads bundled file with ranged download", func() {
+			job := awsGlacier.JobDescription{JobId: aws.String("aJob"), ArchiveId: aws.String(testFileId), StatusCode: aws.String("Succeeded")}
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&job}}, nil)
+			glacierCli.EXPECT().GetJobOutput(gomock.Eq(&awsGlacier.GetJobOutputInput{
+				AccountId: aws.String(testAccountId),
+				VaultName: aws.String(testVaultName),
+				JobId:     aws.String("aJob"),
+				Range:     aws.String("bytes=1536-1546"),
+			})).Return(&awsGlacier.GetJobOutputOutput{Body: io.NopCloser(strings.NewReader(testFileContent))}, nil)
+
+			restored, err := restoreFile(bundledTestFile{IdentifiableHashedFile: NewRestoredFile([]byte(testFileContent)), offset: 1536, length: 11})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal([]byte(testFileContent)))
+		})
+	})
+
+	Describe("Encrypted archives", func() {
+		var codec *archive.Codec
+		var plainContent []byte
+		var plainFile *mock_model.MockFileWithContent
+
+		BeforeEach(func() {
+			keyFile := filepath.Join(GinkgoT().TempDir(), "key")
+			Expect(os.WriteFile(keyFile, []byte(strings.Repeat("0f", 32)), 0600)).To(Succeed())
+			var err error
+			codec, err = archive.NewCodec(archive.Options{EncryptionKeyFile: keyFile})
+			Expect(err).NotTo(HaveOccurred())
+			connection.ConfigureArchive(codec)
+
+			plainContent = []byte(strings.Repeat(testFileContent, 1000))
+			plainFile = mock_model.NewMockFileWithContent(gomock.NewController(GinkgoT()))
+			plainFile.EXPECT().Path().AnyTimes().Return(testFilePath)
+			plainFile.EXPECT().Hash().AnyTimes().Return(fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(plainContent)).TreeHash))
+			plainFile.EXPECT().Size().AnyTimes().Return(int64(len(plainContent)), nil)
+			plainFile.EXPECT().Content().AnyTimes().DoAndReturn(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(plainContent)), nil
+			})
+		})
+
+		It("uploads ciphertext and commits encoding", func() {
+			committer := mock_model.NewMockChangeCommitter(gomock.NewController(GinkgoT()))
+			var uploaded []byte
+			glacierCli.EXPECT().UploadArchive(gomock.Any()).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+				var err error
+				uploaded, err = io.ReadAll(input.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*input.Checksum).To(Equal(fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(uploaded)).TreeHash)))
+				return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("encryptedArchive")}, nil
+			})
+			committer.EXPECT().CommitAdd("encryptedArchive", gomock.Any()).DoAndReturn(func(_ string, file model.HashedFile) error {
+				Expect(file.Path()).To(Equal(testFilePath))
+				Expect(file.Hash()).To(Equal(plainFile.Hash()))
+				Expect(file).To(BeAssignableToTypeOf(&archive.EncodedFile{}))
+				Expect(file.(model.EncodingHolder).Encoding()).To(Equal(archive.EncodingAES256GCM))
+				return nil
+			})
+
+			err := connection.Process(committer, model.Changes{Additions: []model.FileAdded{{FileWithContent: plainFile}}})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bytes.Contains(uploaded, []byte(testFileContent))).To(BeFalse())
+		})
+
+		It("keeps hash of encrypted file out of archive description", func() {
+			committer := mock_model.NewMockChangeCommitter(gomock.NewController(GinkgoT()))
+			var description string
+			glacierCli.EXPECT().UploadArchive(gomock.Any()).DoAndReturn(func(input *awsGlacier.UploadArchiveInput) (*awsGlacier.ArchiveCreationOutput, error) {
+				description = *input.ArchiveDescription
+				return &awsGlacier.ArchiveCreationOutput{ArchiveId: aws.String("encryptedArchive")}, nil
+			})
+			committer.EXPECT().CommitAdd("encryptedArchive", gomock.Any()).Return(nil)
+			Expect(connection.Process(committer, model.Changes{Additions: []model.FileAdded{{FileWithContent: plainFile}}})).To(Succeed())
+
+			parsed := glacier.ParseArchiveDescription(description)
+			Expect(parsed.Hash).To(BeEmpty())
+			Expect(parsed.SealedHash).NotTo(BeEmpty())
+			Expect(parsed.SealedHash).NotTo(ContainSubstring(plainFile.Hash()))
+
+			inventory, err := json.Marshal(map[string]any{"ArchiveList": []map[string]any{{
+				"ArchiveId":          "encryptedArchive",
+				"ArchiveDescription": description,
+				"CreationDate":       "2023-01-02T15:04:05Z",
+				"SHA256TreeHash":     "archiveHash",
+			}}})
+			Expect(err).NotTo(HaveOccurred())
+			mockSuccessfulInventoryJob(string(inventory))
+
+			files, err := connection.ListInventoryAllFiles()
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			Expect(files[0].Hash()).To(Equal(plainFile.Hash()))
+		})
+
+		It("decrypts restored content", func() {
+			encoded, err := codec.Encode(plainFile)
+			Expect(err).NotTo(HaveOccurred())
+			defer encoded.Close()
+			encryptedContent, err := encoded.Content()
+			Expect(err).NotTo(HaveOccurred())
+			encrypted, err := io.ReadAll(encryptedContent)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(encryptedContent.Close()).To(Succeed())
+
+			job := awsGlacier.JobDescription{JobId: aws.String("aJob"), ArchiveId: aws.String(testFileId), StatusCode: aws.String("Succeeded")}
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&job}}, nil)
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).Return(&awsGlacier.GetJobOutputOutput{Body: io.NopCloser(bytes.NewReader(encrypted))}, nil)
+
+			restored, err := restoreFile(encodedTestFile{
+				IdentifiableHashedFile: NewRestoredFile(plainContent),
+				encoding:               archive.EncodingAES256GCM,
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(plainContent))
+		})
+	})
+
+	Describe("Ranged downloads", func() {
+		const jobId = "rangedJob"
+		var content []byte
+		var requested []string
+		var failures, corruptions map[string]int
+		var downloadDir string
+
+		partialFileOf := func(path string) string {
+			return filepath.Join(downloadDir, fmt.Sprintf("%x", sha256.Sum256([]byte(jobId+"\x00"+path))))
+		}
+		partialFile := func() string {
+			return partialFileOf(testFilePath)
+		}
+		treeHash := func(data []byte) string {
+			return fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(data)).TreeHash)
+		}
+		load := func() ([]byte, error) {
+			job := awsGlacier.JobDescription{JobId: aws.String(jobId), ArchiveId: aws.String(testFileId), StatusCode: aws.String("Succeeded"), ArchiveSizeInBytes: aws.Int64(int64(len(content)))}
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&job}}, nil)
+
+			return restoreFile(NewRestoredFile(content))
+		}
+		// restoreTogether restores files of paths from the same job, with downloads of all of them running at once
+		restoreTogether := func(paths ...string) (map[string][]byte, error) {
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadChunkSize: 1, DownloadWorkers: len(paths)})).To(Succeed())
+			planned := &glacier.PlannedArchive{
+				ArchiveId: testFileId,
+				Size:      int64(len(content)),
+				Job:       &awsGlacier.JobDescription{JobId: aws.String(jobId), ArchiveId: aws.String(testFileId), StatusCode: aws.String("Succeeded"), ArchiveSizeInBytes: aws.Int64(int64(len(content)))},
+			}
+			for _, path := range paths {
+				planned.Files = append(planned.Files, index.NewEntry(path, treeHash(content), testFileId))
+			}
+			started := sync.WaitGroup{}
+			started.Add(len(paths))
+			mutex := sync.Mutex{}
+			restored := map[string][]byte{}
+			err := connection.Restore(&glacier.RestorePlan{Archives: []*glacier.PlannedArchive{planned}}, glacier.ArchiveRetrievalOptions{}, func(file model.FileWithContent) error {
+				started.Done()
+				started.Wait()
+				reader, err := file.Content()
+				if err != nil {
+					return err
+				}
+				defer reader.Close()
+				data, err := io.ReadAll(reader)
+				mutex.Lock()
+				defer mutex.Unlock()
+				restored[file.Path()] = data
+				return err
+			})
+
+			return restored, err
+		}
+
+		BeforeEach(func() {
+			content = make([]byte, 5*mebibyte/2)
+			_, _ = rand.Read(content)
+			requested = nil
+			failures = map[string]int{}
+			corruptions = map[string]int{}
+			downloadDir = GinkgoT().TempDir()
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadChunkSize: 1, DownloadRetries: 1})).To(Succeed())
+			Expect(connection.OpenDownloadDir(downloadDir)).To(Succeed())
+
+			mutex := &sync.Mutex{}
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).AnyTimes().DoAndReturn(func(input *awsGlacier.GetJobOutputInput) (*awsGlacier.GetJobOutputOutput, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				Expect(*input.JobId).To(Equal(jobId))
+				requested = append(requested, *input.Range)
+				var start, end int64
+				_, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end)
+				Expect(err).NotTo(HaveOccurred())
+				data := content[start : end+1]
+				checksum := treeHash(data)
+
+				if failures[*input.Range] > 0 {
+					failures[*input.Range]--
+					return nil, errors.New("connection reset")
+				}
+				if corruptions[*input.Range] > 0 {
+					corruptions[*input.Range]--
+					data = append([]byte{}, data...)
+					data[0]++
+				}
+
+				return &awsGlacier.GetJobOutputOutput{Body: io.NopCloser(bytes.NewReader(data)), Checksum: aws.String(checksum)}, nil
+			})
+		})
+
+		It("downloads output in ranges", func() {
+			Expect(load()).To(Equal(content))
+			Expect(requested).To(Equal([]string{"bytes=0-1048575", "bytes=1048576-2097151", "bytes=2097152-2621439"}))
+			Expect(partialFile()).NotTo(BeAnExistingFile())
+		})
+
+		It("retries failed range", func() {
+			failures["bytes=1048576-2097151"] = 1
+
+			Expect(load()).To(Equal(content))
+			Expect(requested).To(HaveLen(4))
+		})
+
+		It("retries corrupted range", func() {
+			corruptions["bytes=1048576-2097151"] = 1
+
+			Expect(load()).To(Equal(content))
+			Expect(requested).To(HaveLen(4))
+		})
+
+		It("backs off between retries of a range", func() {
+			failures["bytes=1048576-2097151"] = 2
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadChunkSize: 1, DownloadRetries: 2, DownloadRetryDelay: 100 * time.Millisecond})).To(Succeed())
+			started := time.Now()
+
+			Expect(load()).To(Equal(content))
+			Expect(requested).To(HaveLen(5))
+			Expect(time.Since(started)).To(BeNumerically(">=", 300*time.Millisecond))
+		})
+
+		It("keeps verified ranges when download fails", func() {
+			failures["bytes=2097152-2621439"] = 1
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadChunkSize: 1})).To(Succeed())
+
+			_, err := load()
+
+			Expect(err).To(HaveOccurred())
+			Expect(os.ReadFile(partialFile())).To(Equal(content[:2*mebibyte]))
+		})
+
+		It("resumes download from the last verified range", func() {
+			Expect(os.WriteFile(partialFile(), content[:3*mebibyte/2], 0600)).To(Succeed())
+
+			Expect(load()).To(Equal(content))
+			Expect(requested).To(Equal([]string{"bytes=1048576-2097151", "bytes=2097152-2621439"}))
+		})
+
+		It("downloads files of the same job concurrently", func() {
+			restored, err := restoreTogether("a.txt", "b.txt")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(map[string][]byte{"a.txt": content, "b.txt": content}))
+			Expect(requested).To(HaveLen(6))
+			Expect(os.ReadDir(downloadDir)).To(BeEmpty())
+		})
+
+		It("resumes downloads of files of the same job concurrently", func() {
+			journalPath := filepath.Join(GinkgoT().TempDir(), "restore.journal")
+			var journal []string
+			for path, offset := range map[string]int64{"a.txt": mebibyte, "b.txt": 2 * mebibyte} {
+				// partial downloads have more bytes than the journal confirms
+				Expect(os.WriteFile(partialFileOf(path), content[:offset+mebibyte/2], 0600)).To(Succeed())
+				journal = append(journal, fmt.Sprintf(`{"path":"%s","hash":"%s","jobId":"%s","offset":%d}`, path, treeHash(content), jobId, offset))
+			}
+			Expect(os.WriteFile(journalPath, []byte(strings.Join(journal, "\n")+"\n"), 0600)).To(Succeed())
+			Expect(connection.OpenRestoreJournal(journalPath, func(model.HashedFile) bool { return false })).To(Succeed())
+
+			restored, err := restoreTogether("a.txt", "b.txt")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(map[string][]byte{"a.txt": content, "b.txt": content}))
+			Expect(requested).To(ConsistOf("bytes=1048576-2097151", "bytes=2097152-2621439", "bytes=2097152-2621439"))
+		})
+	})
+
+	Describe("RestorePlan", func() {
+		fileIn := func(path, archiveId string, size int64) model.IdentifiableHashedFile {
+			entry := index.NewEntry(path, "h-"+path, archiveId)
+			return sizedTestFile{IdentifiableHashedFile: entry, size: size}
+		}
+		retrievalJob := func(jobId, archiveId, status string) *awsGlacier.JobDescription {
+			return &awsGlacier.JobDescription{JobId: aws.String(jobId), ArchiveId: aws.String(archiveId), StatusCode: aws.String(status), ArchiveSizeInBytes: aws.Int64(200)}
+		}
+
+		It("matches files with jobs listed once", func() {
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Times(1).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{
+				{JobId: aws.String("inventory"), InventoryRetrievalParameters: &awsGlacier.InventoryRetrievalJobDescription{}, StatusCode: aws.String("Succeeded")},
+				retrievalJob("failedJob", "archive1", "Failed"),
+				retrievalJob("job1", "archive1", "Succeeded"),
+				retrievalJob("job3", "archive3", "InProgress"),
+			}}, nil)
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).DoAndReturn(func(input *awsGlacier.GetJobOutputInput) (*awsGlacier.GetJobOutputOutput, error) {
+				Expect(*input.JobId).To(Equal("inventory"))
+				return &awsGlacier.GetJobOutputOutput{Body: io.NopCloser(strings.NewReader(`{"ArchiveList":[{"ArchiveId":"archive2","Size":300}]}`))}, nil
+			})
+
+			plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{
+				fileIn("b.txt", "archive1", 100),
+				fileIn("a.txt", "archive1", 100),
+				fileIn("c.txt", "archive2", 0),
+				fileIn("d.txt", "archive3", 0),
+				fileIn("empty.txt", "", 0),
+			}, glacier.ArchiveRetrievalOptions{Tier: glacier.TierBulk})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Files()).To(Equal(5))
+			Expect(plan.EmptyFiles).To(HaveLen(1))
+			Expect(plan.Archives).To(HaveLen(3))
+			Expect(plan.Archives[0].ArchiveId).To(Equal("archive1"))
+			Expect(plan.Archives[0].Files).To(HaveLen(2))
+			Expect(plan.Archives[0].Size).To(Equal(int64(100)))
+			Expect(*plan.Archives[0].Job.JobId).To(Equal("job1"))
+			Expect(plan.Archives[1].Job).To(BeNil())
+			Expect(plan.Archives[1].Size).To(Equal(int64(300)))
+			Expect(plan.Archives[2].Size).To(Equal(int64(200)))
+			plan.Report()
+		})
+
+		It("takes sizes of deleted files", func() {
+			mockNoJobs()
+
+			plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{
+				model.FileDeleted{IdentifiableHashedFile: fileIn("a.txt", "archive1", 100)},
+			}, glacier.ArchiveRetrievalOptions{})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Archives[0].Size).To(Equal(int64(100)))
+			Expect(plan.Estimate(glacier.TierStandard).UnknownSizes).To(BeZero())
+		})
+
+		It("keeps sizes unknown without completed inventory", func() {
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{
+				{JobId: aws.String("inventory"), InventoryRetrievalParameters: &awsGlacier.InventoryRetrievalJobDescription{}, StatusCode: aws.String("InProgress")},
+			}}, nil)
+
+			plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{
+				fileIn("a.txt", "archive1", 0),
+			}, glacier.ArchiveRetrievalOptions{})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Archives[0].Size).To(BeZero())
+		})
+
+		It("creates missing jobs", func() {
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{
+				retrievalJob("job1", "archive1", "Succeeded"),
+			}}, nil)
+			var created []string
+			glacierCli.EXPECT().InitiateJob(gomock.Any()).Times(2).DoAndReturn(func(input *awsGlacier.InitiateJobInput) (*awsGlacier.InitiateJobOutput, error) {
+				Expect(*input.JobParameters.Tier).To(Equal("Bulk"))
+				created = append(created, *input.JobParameters.ArchiveId)
+				return &awsGlacier.InitiateJobOutput{JobId: aws.String("new-" + *input.JobParameters.ArchiveId)}, nil
+			})
+			glacierCli.EXPECT().DescribeJob(gomock.Any()).Times(2).DoAndReturn(func(input *awsGlacier.DescribeJobInput) (*awsGlacier.JobDescription, error) {
+				return retrievalJob(*input.JobId, strings.TrimPrefix(*input.JobId, "new-"), "InProgress"), nil
+			})
+			options := glacier.ArchiveRetrievalOptions{Tier: glacier.TierBulk, JobCreationRate: 1000}
+
+			plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{
+				fileIn("a.txt", "archive1", 0),
+				fileIn("b.txt", "archive2", 0),
+				fileIn("c.txt", "archive3", 0),
+			}, options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(connection.CreateMissingJobs(plan, options)).To(Succeed())
+
+			Expect(created).To(Equal([]string{"archive2", "archive3"}))
+			for _, planned := range plan.Archives {
+				Expect(planned.Job).NotTo(BeNil())
+				Expect(planned.Size).To(Equal(int64(200)))
+			}
+		})
+
+		completedJob := func(jobId, archiveId string, completedAgo time.Duration) *awsGlacier.JobDescription {
+			job := retrievalJob(jobId, archiveId, "Succeeded")
+			job.CompletionDate = aws.String(time.Now().Add(-completedAgo).UTC().Format(time.RFC3339))
+			return job
+		}
+
+		It("ignores failed and expiring jobs", func() {
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{
+				retrievalJob("failed", "archive1", "Failed"),
+				completedJob("expired", "archive2", 30*time.Hour),
+				completedJob("expiring", "archive3", 23*time.Hour+30*time.Minute),
+				completedJob("fresh", "archive4", time.Hour),
+			}}, nil)
+
+			plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{
+				fileIn("a.txt", "archive1", 0),
+				fileIn("b.txt", "archive2", 0),
+				fileIn("c.txt", "archive3", 0),
+				fileIn("d.txt", "archive4", 0),
+			}, glacier.ArchiveRetrievalOptions{Tier: glacier.TierBulk, JobExpiryMargin: time.Hour})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Archives[0].Job).To(BeNil())
+			Expect(plan.Archives[1].Job).To(BeNil())
+			Expect(plan.Archives[2].Job).To(BeNil())
+			Expect(*plan.Archives[3].Job.JobId).To(Equal("fresh"))
+		})
+
+		It("downloads completed jobs earliest deadline first", func() {
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{
+				retrievalJob("running", "archive1", "InProgress"),
+				completedJob("recent", "archive2", 2*time.Hour),
+				completedJob("old", "archive3", 10*time.Hour),
+			}}, nil)
+
+			plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{
+				fileIn("a.txt", "archive1", 0),
+				fileIn("b.txt", "archive2", 0),
+				fileIn("c.txt", "archive3", 0),
+			}, glacier.ArchiveRetrievalOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			var order []string
+			for _, planned := range plan.DownloadOrder() {
+				order = append(order, planned.ArchiveId)
+			}
+			Expect(order).To(Equal([]string{"archive3", "archive2", "archive1"}))
+		})
+
+		It("estimates cost and time of jobs to create", func() {
+			gib := int64(1024 * mebibyte)
+			plan := &glacier.RestorePlan{Tier: glacier.TierStandard, Archives: []*glacier.PlannedArchive{
+				{ArchiveId: "retrieved", Size: 10 * gib, Job: retrievalJob("job1", "retrieved", "Succeeded")},
+				{ArchiveId: "archive1", Size: gib},
+				{ArchiveId: "archive2", Size: gib},
+			}}
+
+			expedited := plan.Estimate(glacier.TierExpedited)
+			Expect(expedited.Jobs).To(Equal(2))
+			Expect(expedited.Bytes).To(Equal(2 * gib))
+			Expect(expedited.RetrievalCost).To(BeNumerically("~", 0.06))
+			Expect(expedited.RequestCost).To(BeNumerically("~", 0.02))
+			Expect(expedited.Completion).To(Equal(5 * time.Minute))
+			bulk := plan.Estimate(glacier.TierBulk)
+			Expect(bulk.Cost()).To(BeNumerically("~", 0.00505))
+			Expect(bulk.Completion).To(Equal(12 * time.Hour))
+			Expect(plan.Estimates()).To(HaveLen(3))
+			plan.ReportEstimates()
+		})
+
+		It("estimates nothing when all jobs exist", func() {
+			plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{
+				{ArchiveId: "archive1", Size: 100, Job: retrievalJob("job1", "archive1", "InProgress")},
+			}}
+
+			estimate := plan.Estimate(glacier.TierExpedited)
+
+			Expect(estimate.Jobs).To(BeZero())
+			Expect(estimate.Cost()).To(BeZero())
+			Expect(estimate.Completion).To(BeZero())
+		})
+
+		It("counts archives of unknown size", func() {
+			gib := int64(1024 * mebibyte)
+			plan := &glacier.RestorePlan{Tier: glacier.TierStandard, Archives: []*glacier.PlannedArchive{
+				{ArchiveId: "archive1", Size: gib},
+				{ArchiveId: "archive2"},
+			}}
+
+			estimate := plan.Estimate(glacier.TierStandard)
+
+			Expect(estimate.Jobs).To(Equal(2))
+			Expect(estimate.Bytes).To(Equal(gib))
+			Expect(estimate.UnknownSizes).To(Equal(1))
+			plan.ReportEstimates()
+		})
+
+		It("doesn't recreate job refused by the guard", func() {
+			file := NewRestoredFile([]byte(testFileContent))
+			planned := &glacier.PlannedArchive{ArchiveId: testFileId, Files: []model.IdentifiableHashedFile{file}, Size: 100, Job: retrievalJob("failed", testFileId, "Failed")}
+			refused := errors.New("too expensive")
+			var guarded []glacier.RetrievalEstimate
+			plan := &glacier.RestorePlan{Archives: []*glacier.PlannedArchive{planned}, GuardRecreation: func(estimate glacier.RetrievalEstimate) error {
+				guarded = append(guarded, estimate)
+				return refused
+			}}
+
+			err := connection.Restore(plan, glacier.ArchiveRetrievalOptions{Tier: glacier.TierExpedited}, func(model.FileWithContent) error {
+				Fail("nothing should be saved")
+				return nil
+			})
+
+			Expect(err).To(WrapError(refused))
+			Expect(guarded).To(HaveLen(1))
+			Expect(guarded[0].Tier).To(Equal(glacier.TierExpedited))
+			Expect(guarded[0].Jobs).To(Equal(1))
+			Expect(guarded[0].Bytes).To(Equal(int64(100)))
+		})
+
+		It("recreates job which fails", func() {
+			running := retrievalJob("running", testFileId, "InProgress")
+			failed := retrievalJob("running", testFileId, "Failed")
+			recreated := completedJob("recreated", testFileId, 0)
+			glacierCli.EXPECT().DescribeJob(gomock.Any()).Times(2).DoAndReturn(func(input *awsGlacier.DescribeJobInput) (*awsGlacier.JobDescription, error) {
+				if *input.JobId == "running" {
+					return failed, nil
+				}
+				return recreated, nil
+			})
+			glacierCli.EXPECT().InitiateJob(gomock.Any()).DoAndReturn(func(input *awsGlacier.InitiateJobInput) (*awsGlacier.InitiateJobOutput, error) {
+				Expect(*input.JobParameters.Tier).To(Equal("Expedited"))
+				return &awsGlacier.InitiateJobOutput{JobId: aws.String("recreated")}, nil
+			})
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).DoAndReturn(func(input *awsGlacier.GetJobOutputInput) (*awsGlacier.GetJobOutputOutput, error) {
+				Expect(*input.JobId).To(Equal("recreated"))
+				return &awsGlacier.GetJobOutputOutput{Body: io.NopCloser(strings.NewReader(testFileContent))}, nil
+			})
+			file := NewRestoredFile([]byte(testFileContent))
+			planned := &glacier.PlannedArchive{ArchiveId: testFileId, Files: []model.IdentifiableHashedFile{file}, Job: running}
+
+			var restored []string
+			err := connection.Restore(&glacier.RestorePlan{Archives: []*glacier.PlannedArchive{planned}}, glacier.ArchiveRetrievalOptions{Tier: glacier.TierExpedited}, func(content model.FileWithContent) error {
+				reader, err := content.Content()
+				if err != nil {
+					return err
+				}
+				defer reader.Close()
+				data, err := io.ReadAll(reader)
+				restored = append(restored, string(data))
+				return err
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*planned.Job.JobId).To(Equal("recreated"))
+			Expect(restored).To(Equal([]string{testFileContent}))
+		})
+
+		It("polls all running jobs and downloads the one which expires first", func() {
+			completed := map[string]*awsGlacier.JobDescription{
+				"job1": completedJob("job1", "archive1", time.Hour),
+				"job2": completedJob("job2", "archive2", 2*time.Hour),
+				"job3": retrievalJob("job3", "archive3", "InProgress"),
+			}
+			glacierCli.EXPECT().DescribeJob(gomock.Any()).Times(4).DoAndReturn(func(input *awsGlacier.DescribeJobInput) (*awsGlacier.JobDescription, error) {
+				job := completed[*input.JobId]
+				if *input.JobId == "job3" {
+					// the last job completes only at the next poll
+					completed["job3"] = completedJob("job3", "archive3", 0)
+				}
+				return job, nil
+			})
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).AnyTimes().DoAndReturn(func(_ *awsGlacier.GetJobOutputInput) (*awsGlacier.GetJobOutputOutput, error) {
+				return &awsGlacier.GetJobOutputOutput{Body: io.NopCloser(strings.NewReader(testFileContent))}, nil
+			})
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadWorkers: 1})).To(Succeed())
+			var archives []*glacier.PlannedArchive
+			for _, id := range []string{"1", "2", "3"} {
+				file := index.NewEntry("file"+id, fmt.Sprintf("%x", awsGlacier.ComputeHashes(strings.NewReader(testFileContent)).TreeHash), "archive"+id)
+				archives = append(archives, &glacier.PlannedArchive{ArchiveId: "archive" + id, Files: []model.IdentifiableHashedFile{file}, Job: retrievalJob("job"+id, "archive"+id, "InProgress")})
+			}
+			var restored []string
+
+			err := connection.Restore(&glacier.RestorePlan{Archives: archives}, glacier.ArchiveRetrievalOptions{}, func(content model.FileWithContent) error {
+				restored = append(restored, content.Path())
+				return nil
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal([]string{"file2", "file1", "file3"}))
+		})
+	})
+
+	Describe("Restore", func() {
+		restoredFile := func(path string, content []byte) model.IdentifiableHashedFile {
+			return index.NewEntry(path, fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(content)).TreeHash), "archive-"+path)
+		}
+		planOf := func(content []byte, paths ...string) *glacier.RestorePlan {
+			plan := &glacier.RestorePlan{EmptyFiles: []model.IdentifiableHashedFile{index.NewEntry("empty.txt", "", "")}}
+			for _, path := range paths {
+				plan.Archives = append(plan.Archives, &glacier.PlannedArchive{
+					ArchiveId: "archive-" + path,
+					Files:     []model.IdentifiableHashedFile{restoredFile(path, content)},
+					Size:      int64(len(content)),
+					Job:       &awsGlacier.JobDescription{JobId: aws.String("job-" + path), StatusCode: aws.String("Succeeded")},
+				})
+			}
+			return plan
+		}
+		mockOutput := func(content []byte) {
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).AnyTimes().DoAndReturn(func(_ *awsGlacier.GetJobOutputInput) (*awsGlacier.GetJobOutputOutput, error) {
+				return &awsGlacier.GetJobOutputOutput{Body: io.NopCloser(bytes.NewReader(content))}, nil
+			})
+		}
+
+		It("saves files with many workers", func() {
+			content := []byte(testFileContent)
+			mockOutput(content)
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadWorkers: 3})).To(Succeed())
+			saved := make(chan string, 10)
+			inFlight, maxInFlight := int32(0), int32(0)
+
+			err := connection.Restore(planOf(content, "a.txt", "b.txt", "c.txt", "d.txt"), glacier.ArchiveRetrievalOptions{}, func(file model.FileWithContent) error {
+				current := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for {
+					max := atomic.LoadInt32(&maxInFlight)
+					if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				reader, err := file.Content()
+				if err != nil {
+					return err
+				}
+				defer reader.Close()
+				if _, err := io.ReadAll(reader); err != nil {
+					return err
+				}
+				saved <- file.Path()
+				return nil
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			close(saved)
+			var paths []string
+			for path := range saved {
+				paths = append(paths, path)
+			}
+			Expect(paths).To(ConsistOf("empty.txt", "a.txt", "b.txt", "c.txt", "d.txt"))
+			Expect(atomic.LoadInt32(&maxInFlight)).To(BeNumerically(">", 1))
+		})
+
+		It("stops on the first error", func() {
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadWorkers: 1})).To(Succeed())
+			saveErr := errors.New("disk full")
+			saves := 0
+
+			err := connection.Restore(planOf([]byte(testFileContent), "a.txt", "b.txt"), glacier.ArchiveRetrievalOptions{}, func(file model.FileWithContent) error {
+				saves++
+				return saveErr
+			})
+
+			Expect(err).To(WrapError(saveErr))
+			Expect(saves).To(Equal(1))
+		})
+
+		It("limits bandwidth", func() {
+			content := bytes.Repeat([]byte("x"), 1024)
+			mockOutput(content)
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadWorkers: 2, DownloadBandwidth: 1})).To(Succeed())
+			started := time.Now()
+
+			err := connection.Restore(planOf(content, "a.txt", "b.txt"), glacier.ArchiveRetrievalOptions{}, func(file model.FileWithContent) error {
+				reader, err := file.Content()
+				if err != nil {
+					return err
+				}
+				defer reader.Close()
+				_, err = io.ReadAll(reader)
+				return err
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Since(started)).To(BeNumerically(">=", 900*time.Millisecond))
+		})
+
+		It("resumes interrupted restore from the journal", func() {
+			journalPath := filepath.Join(GinkgoT().TempDir(), "restore.journal")
+			Expect(connection.OpenRestoreJournal(journalPath, func(model.HashedFile) bool { return true })).To(Succeed())
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadWorkers: 1})).To(Succeed())
+			content := []byte(testFileContent)
+			mockOutput(content)
+			job := func(jobId, archiveId, created string) *awsGlacier.JobDescription {
+				return &awsGlacier.JobDescription{JobId: aws.String(jobId), ArchiveId: aws.String(archiveId), StatusCode: aws.String("Succeeded"), CreationDate: aws.String(created)}
+			}
+			jobs := []*awsGlacier.JobDescription{
+				job("job-a", "archive-a.txt", "2023-01-01T00:00:00Z"),
+				job("job-b", "archive-b.txt", "2023-01-01T00:00:00Z"),
+			}
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Times(2).DoAndReturn(func(_ *awsGlacier.ListJobsInput) (*awsGlacier.ListJobsOutput, error) {
+				return &awsGlacier.ListJobsOutput{JobList: jobs}, nil
+			})
+			files := []model.IdentifiableHashedFile{restoredFile("a.txt", content), restoredFile("b.txt", content)}
+			options := glacier.ArchiveRetrievalOptions{}
+			saveErr := errors.New("disk full")
+
+			plan, err := connection.PlanRestore(files, options)
+			Expect(err).NotTo(HaveOccurred())
+			err = connection.Restore(plan, options, func(file model.FileWithContent) error {
+				if file.Path() == "b.txt" {
+					return saveErr
+				}
+				return nil
+			})
+			Expect(err).To(WrapError(saveErr))
+			Expect(journalPath).To(BeAnExistingFile())
+
+			// the next run finds a newer job of b.txt, but keeps the one from the journal
+			jobs = append(jobs, job("newer-b", "archive-b.txt", "2023-01-02T00:00:00Z"))
+			Expect(connection.OpenRestoreJournal(journalPath, func(model.HashedFile) bool { return true })).To(Succeed())
+			plan, err = connection.PlanRestore(files, options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Restored).To(Equal(1))
+			Expect(plan.Files()).To(Equal(1))
+			Expect(*plan.Archives[0].Job.JobId).To(Equal("job-b"))
+
+			var restored []string
+			Expect(connection.Restore(plan, options, func(file model.FileWithContent) error {
+				restored = append(restored, file.Path())
+				return nil
+			})).To(Succeed())
+			Expect(restored).To(Equal([]string{"b.txt"}))
+			Expect(journalPath).NotTo(BeAnExistingFile())
+		})
+
+		It("restores again files which are not in place anymore", func() {
+			journalPath := filepath.Join(GinkgoT().TempDir(), "restore.journal")
+			inPlace := map[string]bool{}
+			Expect(connection.OpenRestoreJournal(journalPath, func(file model.HashedFile) bool { return inPlace[file.Path()] })).To(Succeed())
+			Expect(connection.ConfigureDownload(glacier.DownloadOptions{DownloadWorkers: 1})).To(Succeed())
+			content := []byte(testFileContent)
+			mockOutput(content)
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{}, nil)
+			saveErr := errors.New("disk full")
+
+			err := connection.Restore(planOf(content, "a.txt", "b.txt"), glacier.ArchiveRetrievalOptions{}, func(file model.FileWithContent) error {
+				if file.Path() == "b.txt" {
+					return saveErr
+				}
+				inPlace[file.Path()] = true
+				return nil
+			})
+			Expect(err).To(WrapError(saveErr))
+
+			// a.txt was removed from the target after it was restored
+			delete(inPlace, "a.txt")
+			plan, err := connection.PlanRestore([]model.IdentifiableHashedFile{restoredFile("a.txt", content), restoredFile("b.txt", content)}, glacier.ArchiveRetrievalOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Restored).To(BeZero())
+			Expect(plan.Files()).To(Equal(2))
+		})
+
+		It("keeps the journal when content is corrupted", func() {
+			journalPath := filepath.Join(GinkgoT().TempDir(), "restore.journal")
+			Expect(connection.OpenRestoreJournal(journalPath, func(model.HashedFile) bool { return true })).To(Succeed())
+			content := []byte(testFileContent)
+			mockOutput(content)
+
+			err := connection.Restore(planOf(content, "a.txt", "b.txt"), glacier.ArchiveRetrievalOptions{}, func(file model.FileWithContent) error {
+				if file.Path() == "a.txt" {
+					return fmt.Errorf("failed to save: %w", glacier.ErrTreeHashMismatch)
+				}
+				return nil
+			})
+
+			Expect(err).To(WrapError(glacier.ErrTreeHashMismatch))
+			Expect(journalPath).To(BeAnExistingFile())
+		})
+	})
+
 	Describe("FindNewestInventoryJob", func() {
 		It("should return nil when there are no jobs", func() {
 			mockNoJobs()
@@ -354,7 +1614,23 @@ ArchiveList:
 			Entry("with id", `{"ArchiveList":[{"ArchiveId":"testId"}]}`, "", "", "testId"),
 			Entry("with path", `{"ArchiveList":[{"ArchiveDescription":"testPath"}]}`, "testPath", "", ""),
 			Entry("with hash", `{"ArchiveList":[{"SHA256TreeHash":"testHash"}]}`, "", "testHash", ""),
+			Entry("with structured description",
+				fmt.Sprintf(`{"ArchiveList":[{"ArchiveDescription":"%s","SHA256TreeHash":"archiveHash"}]}`, glacier.ArchiveDescription{Path: "zdjęcia/żółw.jpg", Hash: "plainHash"}),
+				"zdjęcia/żółw.jpg", "plainHash", ""),
 		)
+
+		It("reads encoding from description", func() {
+			description := glacier.ArchiveDescription{Path: testFilePath, Hash: testFileHash, Encoding: "gzip+aes-256-gcm"}
+			mockSuccessfulInventoryJob(fmt.Sprintf(`{"ArchiveList":[{"ArchiveDescription":"%s","ArchiveId":"testId"}]}`, description))
+
+			files, err := connection.ListInventoryAllFiles()
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			encoded, ok := files[0].(model.EncodingHolder)
+			Expect(ok).To(BeTrue())
+			Expect(encoded.Encoding()).To(Equal("gzip+aes-256-gcm"))
+		})
 	})
 
 	Context("with fixture of glacier inventory", func() {
@@ -411,7 +1687,7 @@ ArchiveList:
 
 			It("creates working index", func() {
 				idx, err := index.LoadIndexFile(idxFile.Name())
-				err = connection.AddInventoryToIndex(idx)
+				err = connection.AddInventoryToIndex(idx, glacier.ArchiveRetrievalOptions{})
 				Expect(err).NotTo(HaveOccurred())
 
 				tree, err := files.NewVolume(testDir).LoadTree()
@@ -424,7 +1700,7 @@ ArchiveList:
 
 			It("creates loadable index", func() {
 				idx, err := index.LoadIndexFile(idxFile.Name())
-				err = connection.AddInventoryToIndex(idx)
+				err = connection.AddInventoryToIndex(idx, glacier.ArchiveRetrievalOptions{})
 				Expect(err).NotTo(HaveOccurred())
 
 				tree, err := files.NewVolume(testDir).LoadTree()
@@ -502,104 +1778,57 @@ ArchiveList:
 
 	})
 
-	Describe("FindOrCreateArchiveJob", func() {
-		var testingFile, otherFile *mock_model.MockIdentifiableHashedFile
-
-		BeforeEach(func() {
-			testingFile = NewTestingFile()
-			otherFile = NewFile("otherId")
-		})
-
+	Describe("Restore of a single file", func() {
 		Context("with job for test file", func() {
-			var existingJob, createdJob awsGlacier.JobDescription
+			var existingJob awsGlacier.JobDescription
 
 			BeforeEach(func() {
 				existingJob = awsGlacier.JobDescription{
-					JobId:     aws.String("aJob"),
-					ArchiveId: aws.String(testFileId),
-				}
-				createdJob = awsGlacier.JobDescription{
-					JobId:     aws.String("someOtherJob"),
-					ArchiveId: aws.String(testFileId),
+					JobId:      aws.String("aJob"),
+					ArchiveId:  aws.String(testFileId),
+					StatusCode: aws.String("Succeeded"),
 				}
 
-				glacierCli.EXPECT().ListJobs(gomock.Any()).AnyTimes().Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&existingJob}}, nil)
-				glacierCli.EXPECT().DescribeJob(gomock.Eq(&awsGlacier.DescribeJobInput{AccountId: aws.String(testAccountId), VaultName: aws.String(testVaultName), JobId: existingJob.JobId})).AnyTimes().Return(&existingJob, nil)
-				glacierCli.EXPECT().InitiateJob(gomock.Any()).AnyTimes().Return(&awsGlacier.InitiateJobOutput{JobId: aws.String("someOtherJob")}, nil)
-				glacierCli.EXPECT().DescribeJob(gomock.Eq(&awsGlacier.DescribeJobInput{AccountId: aws.String(testAccountId), VaultName: aws.String(testVaultName), JobId: createdJob.JobId})).AnyTimes().Return(&createdJob, nil)
-			})
-
-			It("returns a existingJob for test file", func() {
-				result, err := connection.FindOrCreateArchiveJob(testingFile, glacier.ArchiveRetrievalOptions{Tier: glacier.TierExpedited})
-
-				Expect(err).ToNot(HaveOccurred())
-				Expect(result).To(Equal(&existingJob))
+				inventoryJob := awsGlacier.JobDescription{JobId: aws.String("inventory"), StatusCode: aws.String("Succeeded")}
+				glacierCli.EXPECT().ListJobs(gomock.Any()).AnyTimes().Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&inventoryJob, &existingJob}}, nil)
+				glacierCli.EXPECT().GetJobOutput(gomock.Eq(&awsGlacier.GetJobOutputInput{AccountId: aws.String(testAccountId), VaultName: aws.String(testVaultName), JobId: existingJob.JobId})).AnyTimes().Return(&awsGlacier.GetJobOutputOutput{Body: io.NopCloser(strings.NewReader(testFileContent))}, nil)
 			})
 
-			It("creates a existingJob for other file", func() {
-				result, err := connection.FindOrCreateArchiveJob(otherFile, glacier.ArchiveRetrievalOptions{Tier: glacier.TierStandard})
+			It("loads file content from job output", func() {
+				restored, err := restoreFile(NewRestoredFile([]byte(testFileContent)))
 
 				Expect(err).ToNot(HaveOccurred())
-				Expect(result).To(Equal(&createdJob))
+				Expect(restored).To(Equal([]byte(testFileContent)))
 			})
-		})
 
-		Context("with failing call for jobs", func() {
-			connErr := errors.New("omg")
+			It("verifies content against hash of the file", func() {
+				_, err := restoreFile(NewTestingFile())
 
-			BeforeEach(func() {
-				glacierCli.EXPECT().ListJobs(gomock.Any()).AnyTimes().Return(nil, connErr)
+				Expect(err).To(WrapError(glacier.ErrTreeHashMismatch))
 			})
 
-			It("handles err", func() {
-				job, err := connection.FindOrCreateArchiveJob(testingFile, glacier.ArchiveRetrievalOptions{})
+			It("fails without job of the archive", func() {
+				_, err := restoreFile(NewFile("missing"))
 
-				Expect(err).To(WrapError(connErr))
-				Expect(job).To(BeNil())
+				Expect(err).To(HaveOccurred())
 			})
 		})
-	})
 
-	Describe("LoadContentFromGlacier", func() {
-		Context("with job for test file", func() {
-			var existingJob awsGlacier.JobDescription
-
-			BeforeEach(func() {
-				existingJob = awsGlacier.JobDescription{
-					JobId:      aws.String("aJob"),
-					ArchiveId:  aws.String(testFileId),
-					StatusCode: aws.String("Succeeded"),
-				}
+		It("verifies job output against its checksum", func() {
+			job := awsGlacier.JobDescription{JobId: aws.String("aJob"), ArchiveId: aws.String(testFileId), StatusCode: aws.String("Succeeded")}
+			glacierCli.EXPECT().ListJobs(gomock.Any()).Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&job}}, nil)
+			glacierCli.EXPECT().GetJobOutput(gomock.Any()).Return(&awsGlacier.GetJobOutputOutput{
+				Body:     io.NopCloser(strings.NewReader(testFileContent)),
+				Checksum: aws.String("corrupted"),
+			}, nil)
 
-				glacierCli.EXPECT().ListJobs(gomock.Any()).AnyTimes().Return(&awsGlacier.ListJobsOutput{JobList: []*awsGlacier.JobDescription{&existingJob}}, nil)
-				glacierCli.EXPECT().GetJobOutput(gomock.Eq(&awsGlacier.GetJobOutputInput{AccountId: aws.String(testAccountId), VaultName: aws.String(testVaultName), JobId: existingJob.JobId})).AnyTimes().Return(&awsGlacier.GetJobOutputOutput{Body: io.NopCloser(strings.NewReader(testFileContent))}, nil)
-			})
+			_, err := restoreFile(NewRestoredFile([]byte(testFileContent)))
 
-			It("loads file content from job output", func() {
-				file := NewTestingFile()
-				fileFromGlacier, err := connection.LoadContentFromGlacier(file)
-
-				Expect(err).ToNot(HaveOccurred())
-				if Expect(fileFromGlacier).ToNot(BeNil()) {
-					content, err := fileFromGlacier.Content()
-					if Expect(err).NotTo(HaveOccurred()) {
-						bytes, err := io.ReadAll(content)
-						Expect(err).NotTo(HaveOccurred())
-						Expect(bytes).To(Equal([]byte(testFileContent)))
-					}
-				}
-			})
-
-			It("handles job output error", func() {
-				missingFile := NewFile("missing")
-				fileFromGlacier, err := connection.LoadContentFromGlacier(missingFile)
-				Expect(err).To(HaveOccurred())
-				Expect(fileFromGlacier).To(BeNil())
-			})
+			Expect(err).To(WrapError(glacier.ErrTreeHashMismatch))
 		})
 
 		var exampleErr = errors.New("omg")
-		DescribeTable("handle error", func(listErr, describeErr, outputErr, expectedFileErr, expectedFileContentErr error) {
+		DescribeTable("handle error", func(listErr, describeErr, outputErr error) {
 			existingJob := awsGlacier.JobDescription{
 				JobId:      aws.String("aJob"),
 				ArchiveId:  aws.String(testFileId),
@@ -615,25 +1844,26 @@ ArchiveList:
 			glacierCli.EXPECT().DescribeJob(gomock.Eq(&awsGlacier.DescribeJobInput{AccountId: aws.String(testAccountId), VaultName: aws.String(testVaultName), JobId: existingJob.JobId})).AnyTimes().Return(&finishedJob, describeErr)
 			glacierCli.EXPECT().GetJobOutput(gomock.Eq(&awsGlacier.GetJobOutputInput{AccountId: aws.String(testAccountId), VaultName: aws.String(testVaultName), JobId: finishedJob.JobId})).AnyTimes().Return(&awsGlacier.GetJobOutputOutput{Body: io.NopCloser(strings.NewReader(testFileContent))}, outputErr)
 
-			file := NewTestingFile()
-			fileFromGlacier, err := connection.LoadContentFromGlacier(file)
+			_, err := restoreFile(NewRestoredFile([]byte(testFileContent)))
 
-			if expectedFileErr != nil {
-				Expect(err).To(WrapError(expectedFileErr))
-			} else if Expect(err).NotTo(HaveOccurred()) && Expect(fileFromGlacier).ToNot(BeNil()) {
-				_, err := fileFromGlacier.Content()
-				if expectedFileContentErr != nil {
-					Expect(err).To(WrapError(expectedFileContentErr))
-				}
-			}
+			Expect(err).To(WrapError(exampleErr))
 		},
-			Entry("in ListJobs", exampleErr, nil, nil, exampleErr, nil),
-			Entry("in DescribeJob", nil, exampleErr, nil, exampleErr, nil),
-			Entry("in GetJobOutput", nil, nil, exampleErr, nil, exampleErr),
+			Entry("in ListJobs", exampleErr, nil, nil),
+			Entry("in DescribeJob", nil, exampleErr, nil),
+			Entry("in GetJobOutput", nil, nil, exampleErr),
 		)
 	})
 })
 
+type sizedTestFile struct {
+	model.IdentifiableHashedFile
+	size int64
+}
+
+func (f sizedTestFile) ArchiveSize() int64 {
+	return f.size
+}
+
 type ArchiveEq awsGlacier.UploadArchiveInput
 
 func (m ArchiveEq) Matches(x interface{}) bool {
@@ -691,6 +1921,25 @@ func (f FileWithChangeId) ChangeId() string {
 	return f.changeId
 }
 
+type encodedTestFile struct {
+	model.IdentifiableHashedFile
+	encoding string
+}
+
+func (f encodedTestFile) Encoding() string {
+	return f.encoding
+}
+
+type bundledTestFile struct {
+	model.IdentifiableHashedFile
+	offset int64
+	length int64
+}
+
+func (f bundledTestFile) BundleRange() (int64, int64, bool) {
+	return f.offset, f.length, true
+}
+
 type MatchingFile struct {
 	Path string
 	Hash string
@@ -718,6 +1967,16 @@ func NewTestingFile() *mock_model.MockIdentifiableHashedFile {
 	return NewFile(testFileId)
 }
 
+// NewRestoredFile is the test file with real hash of content.
+func NewRestoredFile(content []byte) *mock_model.MockIdentifiableHashedFile {
+	file := mock_model.NewMockIdentifiableHashedFile(gomock.NewController(GinkgoT()))
+	file.EXPECT().Path().AnyTimes().Return(testFilePath)
+	file.EXPECT().Hash().AnyTimes().Return(fmt.Sprintf("%x", awsGlacier.ComputeHashes(bytes.NewReader(content)).TreeHash))
+	file.EXPECT().ChangeId().AnyTimes().Return(testFileId)
+
+	return file
+}
+
 func NewFile(id string) *mock_model.MockIdentifiableHashedFile {
 	file := mock_model.NewMockIdentifiableHashedFile(gomock.NewController(GinkgoT()))
 	file.EXPECT().Path().AnyTimes().Return(testFilePath)
@@ -12,6 +12,8 @@ type inventoryArchive struct {
 	SHA256TreeHash     string
 	ArchiveId          string
 	CreationDate       time.Time
+	Size               int64
+	description        ArchiveDescription
 }
 
 func (a inventoryArchive) ChangeId() string {
@@ -19,13 +21,30 @@ func (a inventoryArchive) ChangeId() string {
 }
 
 func (a inventoryArchive) Path() string {
-	return a.ArchiveDescription
+	return a.description.Path
 }
 
+// Hash is the hash of the original content, so files can be compared with the volume also when archives are encoded.
 func (a inventoryArchive) Hash() string {
+	if a.description.Hash != "" {
+		return a.description.Hash
+	}
+
 	return a.SHA256TreeHash
 }
 
+func (a inventoryArchive) Encoding() string {
+	return a.description.Encoding
+}
+
+func (a inventoryArchive) ArchiveSize() int64 {
+	return a.Size
+}
+
+func (a inventoryArchive) UploadedAt() time.Time {
+	return a.CreationDate
+}
+
 type inventoryArchives map[string]inventoryArchive
 
 func (a inventoryArchives) addNewest(archive inventoryArchive) {
@@ -56,6 +75,9 @@ func unmarshalInventory(data []byte) (inventory, error) {
 	if err != nil {
 		return inventory{}, fmt.Errorf("can't unmarshal inventory: %w", err)
 	}
+	for j := range i.ArchiveList {
+		i.ArchiveList[j].description = ParseArchiveDescription(i.ArchiveList[j].ArchiveDescription)
+	}
 
 	return i, nil
 }
@@ -34,6 +34,36 @@ func (m *MockCli) EXPECT() *MockCliMockRecorder {
 	return m.recorder
 }
 
+// AbortMultipartUpload mocks base method.
+func (m *MockCli) AbortMultipartUpload(arg0 *glacier.AbortMultipartUploadInput) (*glacier.AbortMultipartUploadOutput, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AbortMultipartUpload", arg0)
+	ret0, _ := ret[0].(*glacier.AbortMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AbortMultipartUpload indicates an expected call of AbortMultipartUpload.
+func (mr *MockCliMockRecorder) AbortMultipartUpload(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AbortMultipartUpload", reflect.TypeOf((*MockCli)(nil).AbortMultipartUpload), arg0)
+}
+
+// CompleteMultipartUpload mocks base method.
+func (m *MockCli) CompleteMultipartUpload(arg0 *glacier.CompleteMultipartUploadInput) (*glacier.ArchiveCreationOutput, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteMultipartUpload", arg0)
+	ret0, _ := ret[0].(*glacier.ArchiveCreationOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompleteMultipartUpload indicates an expected call of CompleteMultipartUpload.
+func (mr *MockCliMockRecorder) CompleteMultipartUpload(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteMultipartUpload", reflect.TypeOf((*MockCli)(nil).CompleteMultipartUpload), arg0)
+}
+
 // DeleteArchive mocks base method.
 func (m *MockCli) DeleteArchive(arg0 *glacier.DeleteArchiveInput) (*glacier.DeleteArchiveOutput, error) {
 	m.ctrl.T.Helper()
@@ -94,6 +124,21 @@ func (mr *MockCliMockRecorder) InitiateJob(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InitiateJob", reflect.TypeOf((*MockCli)(nil).InitiateJob), arg0)
 }
 
+// InitiateMultipartUpload mocks base method.
+func (m *MockCli) InitiateMultipartUpload(arg0 *glacier.InitiateMultipartUploadInput) (*glacier.InitiateMultipartUploadOutput, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InitiateMultipartUpload", arg0)
+	ret0, _ := ret[0].(*glacier.InitiateMultipartUploadOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// InitiateMultipartUpload indicates an expected call of InitiateMultipartUpload.
+func (mr *MockCliMockRecorder) InitiateMultipartUpload(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InitiateMultipartUpload", reflect.TypeOf((*MockCli)(nil).InitiateMultipartUpload), arg0)
+}
+
 // ListJobs mocks base method.
 func (m *MockCli) ListJobs(arg0 *glacier.ListJobsInput) (*glacier.ListJobsOutput, error) {
 	m.ctrl.T.Helper()
@@ -109,6 +154,21 @@ func (mr *MockCliMockRecorder) ListJobs(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListJobs", reflect.TypeOf((*MockCli)(nil).ListJobs), arg0)
 }
 
+// ListParts mocks base method.
+func (m *MockCli) ListParts(arg0 *glacier.ListPartsInput) (*glacier.ListPartsOutput, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListParts", arg0)
+	ret0, _ := ret[0].(*glacier.ListPartsOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListParts indicates an expected call of ListParts.
+func (mr *MockCliMockRecorder) ListParts(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListParts", reflect.TypeOf((*MockCli)(nil).ListParts), arg0)
+}
+
 // UploadArchive mocks base method.
 func (m *MockCli) UploadArchive(arg0 *glacier.UploadArchiveInput) (*glacier.ArchiveCreationOutput, error) {
 	m.ctrl.T.Helper()
@@ -123,3 +183,18 @@ func (mr *MockCliMockRecorder) UploadArchive(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadArchive", reflect.TypeOf((*MockCli)(nil).UploadArchive), arg0)
 }
+
+// UploadMultipartPart mocks base method.
+func (m *MockCli) UploadMultipartPart(arg0 *glacier.UploadMultipartPartInput) (*glacier.UploadMultipartPartOutput, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UploadMultipartPart", arg0)
+	ret0, _ := ret[0].(*glacier.UploadMultipartPartOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UploadMultipartPart indicates an expected call of UploadMultipartPart.
+func (mr *MockCliMockRecorder) UploadMultipartPart(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadMultipartPart", reflect.TypeOf((*MockCli)(nil).UploadMultipartPart), arg0)
+}
@@ -0,0 +1,296 @@
+package glacier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/model"
+	"github.com/mrdunski/accumulation-zone/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadPartsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: telemetry.Namespace,
+		Name:      "glacier_upload_parts_sum",
+	})
+	skippedPartsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: telemetry.Namespace,
+		Name:      "glacier_upload_skipped_parts_sum",
+	})
+	abortedUploadsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: telemetry.Namespace,
+		Name:      "glacier_upload_aborted_sum",
+	})
+)
+
+// ErrTreeHashMismatch is returned when the uploaded or downloaded content doesn't match the hash of the file.
+var ErrTreeHashMismatch = model.ErrTreeHashMismatch
+
+// OpenUploadJournal makes multipart uploads resumable. Progress of every multipart upload is kept in filePath.
+func (c *Connection) OpenUploadJournal(filePath string) error {
+	journal, err := openUploadJournal(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open upload journal: %w", err)
+	}
+	c.journal = journal
+
+	return nil
+}
+
+// AbortUnwantedUploads aborts journaled multipart uploads that are stale or don't belong to any of wanted files.
+func (c *Connection) AbortUnwantedUploads(wanted model.HashedFiles) {
+	now := time.Now()
+	partSize := c.uploadOptions.partSizeBytes()
+	for _, upload := range c.journal.list() {
+		switch {
+		case c.uploadOptions.isStale(upload, now):
+			c.logger().Infof("Aborting stale multipart upload of %s started at %v", upload.Path, upload.Started)
+		case !wanted.HasFile(upload.Path, upload.Hash):
+			c.logger().Infof("Aborting multipart upload of %s - file is no longer going to be uploaded", upload.Path)
+		case upload.PartSize != partSize:
+			c.logger().Infof("Aborting multipart upload of %s - part size has changed", upload.Path)
+		default:
+			continue
+		}
+		c.abortMultipart(upload.UploadId)
+	}
+}
+
+func (c *Connection) uploadMultipart(file model.FileWithContent, size int64) (id string, err error) {
+	partSize := c.uploadOptions.partSizeBytes()
+	content, err := file.Content()
+	if err != nil {
+		return "", err
+	}
+	defer func(content io.ReadCloser) {
+		cErr := content.Close()
+		if cErr != nil && err == nil {
+			err = cErr
+		}
+	}(content)
+
+	uploadId, uploaded, err := c.resumeOrInitiateMultipart(file, size, partSize)
+	if err != nil {
+		return "", err
+	}
+
+	id, err = c.uploadParts(uploadId, uploaded, file, content, size, partSize)
+	if errors.Is(err, ErrTreeHashMismatch) {
+		c.abortMultipart(uploadId)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.journal.remove(uploadId); err != nil {
+		c.logger().WithError(err).Errorf("Failed to remove upload %s from journal", uploadId)
+	}
+	c.reportSize(file, uploadBytesSummary)
+
+	return id, nil
+}
+
+func (c *Connection) resumeOrInitiateMultipart(file model.FileWithContent, size, partSize int64) (string, map[int64]string, error) {
+	if existing := c.journal.find(file.Path(), file.Hash(), size, partSize); existing != nil {
+		uploaded, err := c.listUploadedParts(existing.UploadId)
+		if err == nil {
+			c.logger().Infof("Resuming multipart upload of %s: %d parts already uploaded", file.Path(), len(uploaded))
+			return existing.UploadId, uploaded, nil
+		}
+
+		var awsErr awserr.Error
+		if !errors.As(err, &awsErr) || awsErr.Code() != glacier.ErrCodeResourceNotFoundException {
+			return "", nil, fmt.Errorf("failed to list parts of upload %s: %w", existing.UploadId, err)
+		}
+		c.logger().Warnf("Multipart upload %s of %s no longer exists - starting over", existing.UploadId, file.Path())
+		if err := c.journal.remove(existing.UploadId); err != nil {
+			return "", nil, err
+		}
+	}
+
+	c.logger().Debugf("Starting multipart upload: %s %s (size: %d, part size: %d)", file.Path(), file.Hash(), size, partSize)
+	description, err := c.describe(file)
+	if err != nil {
+		return "", nil, err
+	}
+	initiated, err := c.glacier.InitiateMultipartUpload(&glacier.InitiateMultipartUploadInput{
+		AccountId:          &c.accountId,
+		VaultName:          &c.vaultName,
+		ArchiveDescription: aws.String(description.String()),
+		PartSize:           aws.String(strconv.FormatInt(partSize, 10)),
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to initiate multipart upload: %w", err)
+	}
+	uploadId := flatString(initiated.UploadId)
+
+	err = c.journal.start(multipartUpload{
+		UploadId: uploadId,
+		Path:     file.Path(),
+		Hash:     file.Hash(),
+		Size:     size,
+		PartSize: partSize,
+		Started:  time.Now(),
+	})
+	if err != nil {
+		c.abortMultipart(uploadId)
+		return "", nil, fmt.Errorf("failed to journal multipart upload: %w", err)
+	}
+
+	return uploadId, map[int64]string{}, nil
+}
+
+func (c *Connection) listUploadedParts(uploadId string) (map[int64]string, error) {
+	result := map[int64]string{}
+	input := glacier.ListPartsInput{
+		AccountId: &c.accountId,
+		VaultName: &c.vaultName,
+		UploadId:  &uploadId,
+	}
+
+	for {
+		c.logger().Debugf("Loading parts of upload %s", uploadId)
+		output, err := c.glacier.ListParts(&input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, part := range output.Parts {
+			offset, err := parseRangeStart(flatString(part.RangeInBytes))
+			if err != nil {
+				return nil, err
+			}
+			result[offset] = flatString(part.SHA256TreeHash)
+		}
+
+		if output.Marker == nil {
+			return result, nil
+		}
+		input.Marker = output.Marker
+	}
+}
+
+func parseRangeStart(byteRange string) (int64, error) {
+	start, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return -1, fmt.Errorf("unexpected range: %s", byteRange)
+	}
+
+	return strconv.ParseInt(start, 10, 64)
+}
+
+func (c *Connection) uploadParts(uploadId string, uploaded map[int64]string, file model.FileWithContent, content io.Reader, size, partSize int64) (string, error) {
+	var partHashes [][]byte
+	buffer := make([]byte, partSize)
+	offset := int64(0)
+
+	for offset < size {
+		n, err := io.ReadFull(content, buffer)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("failed to read part at %d: %w", offset, err)
+		}
+		if n == 0 {
+			break
+		}
+
+		part := bytes.NewReader(buffer[:n])
+		treeHash := glacier.ComputeHashes(part).TreeHash
+		if uploaded[offset] == fmt.Sprintf("%x", treeHash) {
+			c.logger().Debugf("Skipping part %d of %s - already uploaded", offset, uploadId)
+			skippedPartsCounter.Inc()
+		} else if err := c.uploadPart(uploadId, part, treeHash, offset); err != nil {
+			return "", err
+		}
+
+		partHashes = append(partHashes, treeHash)
+		offset += int64(n)
+	}
+
+	if offset != size {
+		return "", fmt.Errorf("%w: file %s has changed during upload: expected %d bytes, read %d", ErrTreeHashMismatch, file.Path(), size, offset)
+	}
+	if n, _ := content.Read(make([]byte, 1)); n != 0 {
+		return "", fmt.Errorf("%w: file %s has changed during upload: it is bigger than %d bytes", ErrTreeHashMismatch, file.Path(), size)
+	}
+
+	checksum := fmt.Sprintf("%x", glacier.ComputeTreeHash(partHashes))
+	if expected := archiveHash(file); checksum != expected {
+		return "", fmt.Errorf("%w: parts of %s hash to %s, expected %s", ErrTreeHashMismatch, file.Path(), checksum, expected)
+	}
+
+	c.logger().Debugf("Completing multipart upload %s of %s", uploadId, file.Path())
+	archive, err := c.glacier.CompleteMultipartUpload(&glacier.CompleteMultipartUploadInput{
+		AccountId:   &c.accountId,
+		VaultName:   &c.vaultName,
+		UploadId:    &uploadId,
+		ArchiveSize: aws.String(strconv.FormatInt(size, 10)),
+		Checksum:    &checksum,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	return flatString(archive.ArchiveId), nil
+}
+
+func (c *Connection) uploadPart(uploadId string, part *bytes.Reader, treeHash []byte, offset int64) error {
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	checksum := fmt.Sprintf("%x", treeHash)
+	partRange := fmt.Sprintf("bytes %d-%d/*", offset, offset+part.Size()-1)
+
+	c.logger().Debugf("Uploading part %s of %s", partRange, uploadId)
+	output, err := c.glacier.UploadMultipartPart(&glacier.UploadMultipartPartInput{
+		AccountId: &c.accountId,
+		VaultName: &c.vaultName,
+		UploadId:  &uploadId,
+		Range:     &partRange,
+		Checksum:  &checksum,
+		Body:      part,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %s: %w", partRange, err)
+	}
+	if output.Checksum != nil && *output.Checksum != checksum {
+		return fmt.Errorf("%w: part %s uploaded as %s, expected %s", ErrTreeHashMismatch, partRange, *output.Checksum, checksum)
+	}
+
+	uploadPartsCounter.Inc()
+
+	if err := c.journal.recordPart(uploadId, offset, checksum); err != nil {
+		c.logger().WithError(err).Errorf("Failed to journal part %s of upload %s", partRange, uploadId)
+	}
+
+	return nil
+}
+
+func (c *Connection) abortMultipart(uploadId string) {
+	c.logger().Debugf("Aborting multipart upload %s", uploadId)
+	_, err := c.glacier.AbortMultipartUpload(&glacier.AbortMultipartUploadInput{
+		AccountId: &c.accountId,
+		VaultName: &c.vaultName,
+		UploadId:  &uploadId,
+	})
+
+	var awsErr awserr.Error
+	if err != nil && (!errors.As(err, &awsErr) || awsErr.Code() != glacier.ErrCodeResourceNotFoundException) {
+		c.logger().WithError(err).Errorf("Failed to abort multipart upload %s", uploadId)
+		return
+	}
+
+	abortedUploadsCounter.Inc()
+	if err := c.journal.remove(uploadId); err != nil {
+		c.logger().WithError(err).Errorf("Failed to remove upload %s from journal", uploadId)
+	}
+}
@@ -1,6 +1,11 @@
 package glacier
 
-import "github.com/aws/aws-sdk-go/aws/credentials"
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
 
 type VaultConfig struct {
 	AccountId string `env:"ACCOUNT_ID" help:"AWS account id" required:"" group:"AWS Glacier"`
@@ -33,4 +38,174 @@ type ArchiveRetrievalOptions struct {
 	* Bulk - cost effective - up to 12 hours
 
 For more info see https://docs.aws.amazon.com/amazonglacier/latest/dev/api-initiate-job-post.html"`
+	JobCreationRate float64       `env:"JOB_CREATION_RATE" help:"Maximum number of retrieval jobs created per second. 0 disables the limit." default:"5"`
+	JobExpiryMargin time.Duration `env:"JOB_EXPIRY_MARGIN" help:"Completed retrieval jobs which output expires within this time are recreated, as it could expire before it is downloaded." default:"1h"`
+}
+
+// jobCreationInterval is the minimal time between creation of two retrieval jobs.
+func (o ArchiveRetrievalOptions) jobCreationInterval() time.Duration {
+	if o.JobCreationRate <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(time.Second) / o.JobCreationRate)
+}
+
+const (
+	kibibyte                  = int64(1024)
+	mebibyte                  = 1024 * kibibyte
+	gibibyte                  = 1024 * mebibyte
+	defaultMultipartThreshold = 1024
+	defaultPartSize           = 128
+	maxPartSize               = 4096
+	// Glacier rejects archives bigger than 4 GiB uploaded in a single request
+	maxMultipartThreshold = 4096
+	defaultBundleSize     = 64
+	// files are kept in memory while they are added to a bundle
+	maxBundleThreshold = 64 * 1024
+)
+
+type UploadOptions struct {
+	MultipartThreshold int64         `env:"MULTIPART_THRESHOLD" help:"Files bigger than this size (in MiB) are uploaded in multiple parts. At most 4096, as Glacier rejects bigger single uploads." default:"1024" group:"Upload"`
+	PartSize           int64         `env:"MULTIPART_PART_SIZE" help:"Size (in MiB) of a single part of multipart upload. Must be a power of two between 1 and 4096." default:"128" group:"Upload"`
+	StaleUploadAge     time.Duration `env:"MULTIPART_STALE_AGE" help:"Unfinished multipart uploads older than this are aborted instead of resumed." default:"168h" group:"Upload"`
+	UploadWorkers      int           `env:"UPLOAD_WORKERS" help:"Number of archives uploaded concurrently. Every multipart upload keeps one part in memory." default:"4" group:"Upload"`
+	BundleThreshold    int64         `env:"BUNDLE_THRESHOLD" help:"Files smaller than this size (in KiB) are packed together into bundle archives to save on per-archive costs. 0 disables bundling." default:"256" group:"Upload"`
+	BundleSize         int64         `env:"BUNDLE_SIZE" help:"Target size (in MiB) of a bundle archive." default:"64" group:"Upload"`
+}
+
+func (o UploadOptions) validate() error {
+	partSize := o.PartSize
+	if partSize < 0 || partSize > maxPartSize || partSize&(partSize-1) != 0 {
+		return fmt.Errorf("invalid part size %d MiB: must be a power of two between 1 and %d", partSize, maxPartSize)
+	}
+	if o.MultipartThreshold < 0 || o.MultipartThreshold > maxMultipartThreshold {
+		return fmt.Errorf("invalid multipart threshold %d MiB: must be between 0 and %d", o.MultipartThreshold, maxMultipartThreshold)
+	}
+	if o.UploadWorkers < 0 {
+		return fmt.Errorf("invalid number of upload workers: %d", o.UploadWorkers)
+	}
+	if o.BundleThreshold < 0 || o.BundleThreshold > maxBundleThreshold {
+		return fmt.Errorf("invalid bundle threshold %d KiB: must be between 0 and %d", o.BundleThreshold, maxBundleThreshold)
+	}
+	if o.BundleSize < 0 {
+		return fmt.Errorf("invalid bundle size %d MiB", o.BundleSize)
+	}
+
+	return nil
+}
+
+func (o UploadOptions) thresholdBytes() int64 {
+	if o.MultipartThreshold == 0 {
+		return defaultMultipartThreshold * mebibyte
+	}
+
+	return o.MultipartThreshold * mebibyte
+}
+
+func (o UploadOptions) partSizeBytes() int64 {
+	if o.PartSize == 0 {
+		return defaultPartSize * mebibyte
+	}
+
+	return o.PartSize * mebibyte
+}
+
+func (o UploadOptions) workers() int {
+	if o.UploadWorkers == 0 {
+		return 1
+	}
+
+	return o.UploadWorkers
+}
+
+func (o UploadOptions) bundleThresholdBytes() int64 {
+	return o.BundleThreshold * kibibyte
+}
+
+func (o UploadOptions) bundleSizeBytes() int64 {
+	if o.BundleSize == 0 {
+		return defaultBundleSize * mebibyte
+	}
+
+	return o.BundleSize * mebibyte
+}
+
+func (o UploadOptions) isStale(upload multipartUpload, now time.Time) bool {
+	return o.StaleUploadAge > 0 && now.Sub(upload.Started) > o.StaleUploadAge
+}
+
+const (
+	defaultDownloadChunkSize = 64
+	maxDownloadChunkSize     = 4096
+	// retries of a range back off exponentially up to this delay
+	maxDownloadRetryDelay = 5 * time.Minute
+)
+
+type DownloadOptions struct {
+	DownloadChunkSize        int64         `env:"DOWNLOAD_CHUNK_SIZE" help:"Size (in MiB) of a range of job output downloaded and verified at once. Must be a power of two between 1 and 4096." default:"64" group:"Download"`
+	DownloadRetries          int           `env:"DOWNLOAD_RETRIES" help:"Number of retries of a range which failed to download or didn't match its checksum." default:"3" group:"Download"`
+	DownloadRetryDelay       time.Duration `env:"DOWNLOAD_RETRY_DELAY" help:"Delay before the first retry of a range. It doubles with every next retry, up to 5 minutes. 0 retries immediately." default:"1s" group:"Download"`
+	DownloadStagingDir       string        `env:"DOWNLOAD_STAGING_DIR" help:"Directory where archives bigger than a download chunk are staged until they are complete. Needs free space for the biggest archives downloaded concurrently. Defaults to a directory next to the index." type:"path" group:"Download"`
+	DownloadWorkers          int           `env:"DOWNLOAD_WORKERS" help:"Number of files downloaded and saved concurrently." default:"4" group:"Download"`
+	DownloadBandwidth        int64         `env:"DOWNLOAD_BANDWIDTH" help:"Maximum total download speed (in KiB/s) of all workers. 0 disables the limit." default:"0" group:"Download"`
+	DownloadProgressInterval time.Duration `env:"DOWNLOAD_PROGRESS_INTERVAL" help:"How often progress of the restore is logged." default:"30s" group:"Download"`
+}
+
+func (o DownloadOptions) validate() error {
+	chunkSize := o.DownloadChunkSize
+	if chunkSize < 0 || chunkSize > maxDownloadChunkSize || chunkSize&(chunkSize-1) != 0 {
+		return fmt.Errorf("invalid download chunk size %d MiB: must be a power of two between 1 and %d", chunkSize, maxDownloadChunkSize)
+	}
+	if o.DownloadRetries < 0 {
+		return fmt.Errorf("invalid number of download retries: %d", o.DownloadRetries)
+	}
+	if o.DownloadRetryDelay < 0 {
+		return fmt.Errorf("invalid download retry delay %v", o.DownloadRetryDelay)
+	}
+	if o.DownloadWorkers < 0 {
+		return fmt.Errorf("invalid number of download workers: %d", o.DownloadWorkers)
+	}
+	if o.DownloadBandwidth < 0 {
+		return fmt.Errorf("invalid download bandwidth %d KiB/s", o.DownloadBandwidth)
+	}
+	if o.DownloadProgressInterval < 0 {
+		return fmt.Errorf("invalid progress interval %v", o.DownloadProgressInterval)
+	}
+
+	return nil
+}
+
+// chunkSizeBytes is tree hash aligned, so Glacier returns a checksum of every range.
+func (o DownloadOptions) chunkSizeBytes() int64 {
+	if o.DownloadChunkSize == 0 {
+		return defaultDownloadChunkSize * mebibyte
+	}
+
+	return o.DownloadChunkSize * mebibyte
+}
+
+// retryDelay is the delay before the retry attempt of a range, doubled with every attempt.
+func (o DownloadOptions) retryDelay(attempt int) time.Duration {
+	delay := o.DownloadRetryDelay
+	for i := 1; i < attempt && delay < maxDownloadRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDownloadRetryDelay {
+		return maxDownloadRetryDelay
+	}
+
+	return delay
+}
+
+func (o DownloadOptions) workers() int {
+	if o.DownloadWorkers == 0 {
+		return 1
+	}
+
+	return o.DownloadWorkers
+}
+
+func (o DownloadOptions) bandwidthBytes() int64 {
+	return o.DownloadBandwidth * kibibyte
 }
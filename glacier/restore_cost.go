@@ -0,0 +1,126 @@
+package glacier
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+)
+
+// retrievalPricing is the price (in USD) and the typical time of archive retrievals in a tier. Prices are the ones
+// of us-east-1, other regions differ slightly. See https://aws.amazon.com/s3/glacier/pricing/.
+type retrievalPricing struct {
+	perGiB              float64
+	perThousandRequests float64
+	completion          time.Duration
+}
+
+var retrievalPrices = map[RetrievalTier]retrievalPricing{
+	TierExpedited: {perGiB: 0.03, perThousandRequests: 10, completion: 5 * time.Minute},
+	TierStandard:  {perGiB: 0.01, perThousandRequests: 0.05, completion: 5 * time.Hour},
+	TierBulk:      {perGiB: 0.0025, perThousandRequests: 0.025, completion: 12 * time.Hour},
+}
+
+// RetrievalEstimate is the expected cost and time of retrieval jobs created to restore files of a plan.
+// Archives which already have retrieval jobs cost nothing.
+type RetrievalEstimate struct {
+	Tier RetrievalTier
+	// Jobs is the number of retrieval jobs to create
+	Jobs int
+	// Bytes is the size of archives retrieved by new jobs, without archives of unknown size
+	Bytes int64
+	// UnknownSizes is the number of archives retrieved by new jobs, which size is unknown, so their retrieval
+	// is not included in the cost
+	UnknownSizes  int
+	RetrievalCost float64
+	RequestCost   float64
+	// Completion is the expected time until all jobs are completed, 0 when there are no jobs to create
+	Completion time.Duration
+}
+
+func (e RetrievalEstimate) Cost() float64 {
+	return e.RetrievalCost + e.RequestCost
+}
+
+// Estimate returns the expected cost and time of retrieval jobs created in the tier.
+func (p *RestorePlan) Estimate(tier RetrievalTier) RetrievalEstimate {
+	return estimateJobs(tier, p.Archives)
+}
+
+// estimateRecreation returns the expected cost and time of a job which replaces the job of planned archive.
+func estimateRecreation(tier RetrievalTier, planned *PlannedArchive) RetrievalEstimate {
+	return estimateJobs(tier, []*PlannedArchive{{ArchiveId: planned.ArchiveId, Size: planned.Size}})
+}
+
+func estimateJobs(tier RetrievalTier, archives []*PlannedArchive) RetrievalEstimate {
+	pricing := retrievalPrices[tier]
+	estimate := RetrievalEstimate{Tier: tier}
+	for _, planned := range archives {
+		if planned.Job != nil {
+			continue
+		}
+		estimate.Jobs++
+		estimate.Bytes += planned.Size
+		if planned.Size == 0 {
+			estimate.UnknownSizes++
+		}
+	}
+	estimate.RetrievalCost = float64(estimate.Bytes) / float64(gibibyte) * pricing.perGiB
+	estimate.RequestCost = float64(estimate.Jobs) / 1000 * pricing.perThousandRequests
+	if estimate.Jobs > 0 {
+		estimate.Completion = pricing.completion
+	}
+
+	return estimate
+}
+
+// Estimates returns estimates of all retrieval tiers.
+func (p *RestorePlan) Estimates() []RetrievalEstimate {
+	return []RetrievalEstimate{p.Estimate(TierExpedited), p.Estimate(TierStandard), p.Estimate(TierBulk)}
+}
+
+// ReportFiles logs every file of the plan with the size retrieved to restore it.
+func (p *RestorePlan) ReportFiles() {
+	log := logger.WithComponent("glacier")
+	for _, file := range p.EmptyFiles {
+		log.Infof("To restore: %s (empty)", file.Path())
+	}
+	for _, planned := range p.Archives {
+		for _, file := range planned.Files {
+			log.Infof("To restore: %s (%s)", file.Path(), formatBytes(retrievedSize(planned, file)))
+		}
+	}
+}
+
+// ReportEstimates logs estimates of all retrieval tiers. The tier of the plan is marked.
+func (p *RestorePlan) ReportEstimates() {
+	log := logger.WithComponent("glacier")
+	for _, estimate := range p.Estimates() {
+		marker := ""
+		if estimate.Tier == p.Tier {
+			marker = " (selected)"
+		}
+		completion := "no jobs to create"
+		if estimate.Jobs > 0 {
+			completion = "completed in up to " + formatDuration(estimate.Completion)
+		}
+		unknown := ""
+		if estimate.UnknownSizes > 0 {
+			unknown = fmt.Sprintf(" and %d archives of unknown size", estimate.UnknownSizes)
+		}
+		log.Infof("Estimate %s%s: %d jobs retrieving %s%s, $%.2f for retrieval + $%.2f for requests = $%.2f, %s",
+			estimate.Tier, marker, estimate.Jobs, formatBytes(estimate.Bytes), unknown,
+			estimate.RetrievalCost, estimate.RequestCost, estimate.Cost(), completion)
+	}
+	if unknown := p.Estimate(p.Tier).UnknownSizes; unknown > 0 {
+		log.Warnf("Size of %d archives is unknown, so retrieval of them is not included in estimates", unknown)
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	if d >= time.Hour && d%time.Hour == 0 {
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+
+	return fmt.Sprintf("%d minutes", d/time.Minute)
+}
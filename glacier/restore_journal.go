@@ -0,0 +1,175 @@
+package glacier
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+// journaledFile is the state of a file selected for a restore.
+type journaledFile struct {
+	Path  string `json:"path"`
+	Hash  string `json:"hash"`
+	JobId string `json:"jobId,omitempty"`
+	// Offset is the number of bytes of the archive downloaded and verified by the job
+	Offset int64 `json:"offset,omitempty"`
+	Done   bool  `json:"done,omitempty"`
+}
+
+// restoreJournal keeps state of restored files in a file, so an interrupted restore is continued by a later run.
+// Every change of a file is appended as a new line and the last line of a file wins. A nil journal doesn't persist
+// anything.
+type restoreJournal struct {
+	filePath string
+	mutex    sync.Mutex
+	files    map[string]*journaledFile
+	out      *os.File
+	// restored checks that a file completed by an earlier run is still in place
+	restored func(file model.HashedFile) bool
+}
+
+// OpenRestoreJournal makes restores resumable. Jobs, download offsets and completion of restored files are kept
+// in filePath, until the restore is finished. Files completed by an earlier run are skipped only when restored
+// confirms they are still in place, e.g. they weren't removed and the restore target didn't change.
+func (c *Connection) OpenRestoreJournal(filePath string, restored func(file model.HashedFile) bool) error {
+	journal, err := openRestoreJournal(filePath, restored)
+	if err != nil {
+		return fmt.Errorf("failed to open restore journal: %w", err)
+	}
+	c.restoreJournal = journal
+
+	return nil
+}
+
+func openRestoreJournal(filePath string, restored func(file model.HashedFile) bool) (*restoreJournal, error) {
+	j := &restoreJournal{filePath: filePath, files: map[string]*journaledFile{}, restored: restored}
+
+	in, err := os.Open(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer in.Close()
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			file := &journaledFile{}
+			if err := json.Unmarshal(scanner.Bytes(), file); err != nil {
+				// the last line could be written only partially when the restore was killed
+				continue
+			}
+			j.files[file.Path] = file
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("can't read restore journal %s: %w", filePath, err)
+		}
+	}
+
+	return j, nil
+}
+
+// find returns the state of the file, unless the journal has state of other content at its path.
+func (j *restoreJournal) find(file model.HashedFile) (journaledFile, bool) {
+	if j == nil {
+		return journaledFile{}, false
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	journaled, ok := j.files[file.Path()]
+	if !ok || journaled.Hash != file.Hash() {
+		return journaledFile{}, false
+	}
+
+	return *journaled, true
+}
+
+// recordJob records the job retrieving the file. Download offset of other job is forgotten.
+func (j *restoreJournal) recordJob(file model.HashedFile, jobId string) error {
+	return j.update(file, func(journaled *journaledFile) {
+		if journaled.JobId != jobId {
+			journaled.JobId = jobId
+			journaled.Offset = 0
+		}
+	})
+}
+
+func (j *restoreJournal) recordOffset(file model.HashedFile, jobId string, offset int64) error {
+	return j.update(file, func(journaled *journaledFile) {
+		journaled.JobId = jobId
+		journaled.Offset = offset
+	})
+}
+
+// isDone returns true when the file was restored by an earlier run and it is still in place.
+func (j *restoreJournal) isDone(file model.HashedFile, journaled journaledFile) bool {
+	return journaled.Done && j.restored != nil && j.restored(file)
+}
+
+func (j *restoreJournal) recordDone(file model.HashedFile) error {
+	return j.update(file, func(journaled *journaledFile) {
+		journaled.Done = true
+	})
+}
+
+func (j *restoreJournal) update(file model.HashedFile, change func(journaled *journaledFile)) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	journaled, ok := j.files[file.Path()]
+	if !ok || journaled.Hash != file.Hash() {
+		journaled = &journaledFile{Path: file.Path(), Hash: file.Hash()}
+		j.files[file.Path()] = journaled
+	}
+	before := *journaled
+	change(journaled)
+	if *journaled == before && ok {
+		return nil
+	}
+
+	return j.append(*journaled)
+}
+
+func (j *restoreJournal) append(journaled journaledFile) error {
+	if j.out == nil {
+		out, err := os.OpenFile(j.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		j.out = out
+	}
+	data, err := json.Marshal(journaled)
+	if err != nil {
+		return err
+	}
+	_, err = j.out.Write(append(data, '\n'))
+
+	return err
+}
+
+// remove deletes the journal once the restore is finished.
+func (j *restoreJournal) remove() error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.out != nil {
+		_ = j.out.Close()
+		j.out = nil
+	}
+	j.files = map[string]*journaledFile{}
+	if err := os.Remove(j.filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
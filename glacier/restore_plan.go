@@ -0,0 +1,475 @@
+package glacier
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
+	"github.com/mrdunski/accumulation-zone/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// jobOutputLifetime is the time for which output of a completed job can be downloaded.
+	jobOutputLifetime = 24 * time.Hour
+	// maxJobRecreations limits how many times a retrieval job of a single archive is recreated during a restore,
+	// so an archive which can't be retrieved doesn't block the restore forever.
+	maxJobRecreations = 2
+	// minJobPollInterval and maxJobPollInterval bound the time between checks of running jobs. The interval
+	// doubles while no job completes, as retrieval jobs take from minutes to hours.
+	minJobPollInterval = time.Second
+	maxJobPollInterval = 5 * time.Minute
+)
+
+// ErrJobFailed is returned when a job finished without success.
+var ErrJobFailed = errors.New("job failed")
+
+var recreatedJobsCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: telemetry.Namespace,
+	Name:      "glacier_recreated_jobs_sum",
+})
+
+// PlannedArchive is an archive retrieved to restore files. Many files are restored from a single bundle archive.
+type PlannedArchive struct {
+	ArchiveId string
+	Files     []model.IdentifiableHashedFile
+	// Size of the archive, 0 when unknown
+	Size int64
+	// Job retrieving the archive, nil when it is not created yet
+	Job *glacier.JobDescription
+	// recreations is the number of times the job was recreated during the restore
+	recreations int
+}
+
+// RestorePlan lists archives retrieved to restore files, together with their retrieval jobs.
+type RestorePlan struct {
+	Archives []*PlannedArchive
+	// EmptyFiles don't have archives, they are restored without retrieval
+	EmptyFiles []model.IdentifiableHashedFile
+	// Restored is the number of files skipped, as they were restored by an interrupted run
+	Restored int
+	Tier     RetrievalTier
+	// GuardRecreation is called with the estimate of a job before it is recreated during the restore, as recreated
+	// jobs are not included in estimates of the plan. The job is not recreated when it returns an error.
+	GuardRecreation func(estimate RetrievalEstimate) error
+}
+
+// PlanRestore matches files with existing retrieval jobs of their archives. Jobs are listed only once. With
+// a restore journal, files restored by an interrupted run are skipped and jobs used by it are preferred.
+func (c *Connection) PlanRestore(files []model.IdentifiableHashedFile, options ArchiveRetrievalOptions) (*RestorePlan, error) {
+	jobs, err := c.listAllJobs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	jobsByArchive := map[string]*glacier.JobDescription{}
+	jobsById := map[string]*glacier.JobDescription{}
+	unusableJobs := map[string]string{}
+	now := time.Now()
+	for _, job := range jobs {
+		// inventory jobs don't have archive id, ranged jobs retrieve only manifests of bundles
+		if job.ArchiveId == nil || !wholeArchiveJob(job) {
+			continue
+		}
+		if problem := options.jobProblem(job, now); problem != "" {
+			unusableJobs[*job.ArchiveId] = problem
+			continue
+		}
+		jobsById[flatString(job.JobId)] = job
+		if previous, ok := jobsByArchive[*job.ArchiveId]; !ok || preferredJob(job, previous) {
+			jobsByArchive[*job.ArchiveId] = job
+		}
+	}
+
+	plan := &RestorePlan{Tier: options.Tier}
+	archives := map[string]*PlannedArchive{}
+	for _, file := range files {
+		journaled, ok := c.restoreJournal.find(file)
+		if ok && c.restoreJournal.isDone(file, journaled) {
+			plan.Restored++
+			continue
+		}
+		archiveId := file.ChangeId()
+		if archiveId == "" {
+			plan.EmptyFiles = append(plan.EmptyFiles, file)
+			continue
+		}
+		planned, ok := archives[archiveId]
+		if !ok {
+			planned = &PlannedArchive{ArchiveId: archiveId, Job: jobsByArchive[archiveId]}
+			archives[archiveId] = planned
+			plan.Archives = append(plan.Archives, planned)
+			if problem, ok := unusableJobs[archiveId]; ok && planned.Job == nil {
+				c.logger().Infof("Retrieval job of %s is not usable (%s), it will be recreated", file.Path(), problem)
+			}
+		}
+		if job, ok := jobsById[journaled.JobId]; ok && aws.StringValue(job.ArchiveId) == archiveId {
+			planned.Job = job
+		}
+		planned.Files = append(planned.Files, file)
+		if sized, ok := file.(model.ArchiveSizeHolder); ok && planned.Size == 0 {
+			planned.Size = sized.ArchiveSize()
+		}
+		if planned.Job != nil && planned.Size == 0 {
+			planned.Size = aws.Int64Value(planned.Job.ArchiveSizeInBytes)
+		}
+	}
+	c.estimateSizes(plan.Archives, jobs)
+	for _, planned := range plan.Archives {
+		sort.Slice(planned.Files, func(i, j int) bool {
+			return planned.Files[i].Path() < planned.Files[j].Path()
+		})
+	}
+	sort.Slice(plan.Archives, func(i, j int) bool {
+		return plan.Archives[i].Files[0].Path() < plan.Archives[j].Files[0].Path()
+	})
+
+	return plan, nil
+}
+
+// estimateSizes fills unknown sizes of archives, e.g. of ones indexed before sizes were, from the newest completed
+// inventory. Sizes stay unknown without a completed inventory, as waiting for a new one takes hours.
+func (c *Connection) estimateSizes(archives []*PlannedArchive, jobs []*glacier.JobDescription) {
+	unknown := map[string]*PlannedArchive{}
+	for _, planned := range archives {
+		if planned.Size == 0 {
+			unknown[planned.ArchiveId] = planned
+		}
+	}
+	if len(unknown) == 0 {
+		return
+	}
+
+	var newest *glacier.JobDescription
+	for _, job := range jobs {
+		if job.InventoryRetrievalParameters == nil || flatString(job.StatusCode) != "Succeeded" {
+			continue
+		}
+		if newest == nil || parseCreationDate(job.CreationDate).After(parseCreationDate(newest.CreationDate)) {
+			newest = job
+		}
+	}
+	if newest == nil {
+		c.logger().Warnf("Sizes of %d archives are unknown and there is no completed inventory to estimate them - "+
+			"start one with `inventory retrieve` for better estimates", len(unknown))
+		return
+	}
+	output, err := c.GetJobOutput(flatString(newest.JobId))
+	if err != nil {
+		c.logger().WithError(err).Warnf("Sizes of %d archives are unknown, as the inventory can't be downloaded", len(unknown))
+		return
+	}
+	i, err := unmarshalInventory(output)
+	if err != nil {
+		c.logger().WithError(err).Warnf("Sizes of %d archives are unknown, as the inventory can't be read", len(unknown))
+		return
+	}
+
+	estimated := 0
+	for _, archive := range i.ArchiveList {
+		if planned, ok := unknown[archive.ArchiveId]; ok && archive.Size > 0 {
+			planned.Size = archive.Size
+			estimated++
+		}
+	}
+	c.logger().Infof("Sizes of %d of %d archives of unknown size were estimated from the inventory of %s",
+		estimated, len(unknown), flatString(newest.CreationDate))
+}
+
+// preferredJob returns true when job is more useful than other job of the same archive.
+func preferredJob(job, other *glacier.JobDescription) bool {
+	rank := map[string]int{"Succeeded": 2, "InProgress": 1}
+	if rank[flatString(job.StatusCode)] != rank[flatString(other.StatusCode)] {
+		return rank[flatString(job.StatusCode)] > rank[flatString(other.StatusCode)]
+	}
+
+	return parseCreationDate(job.CreationDate).After(parseCreationDate(other.CreationDate))
+}
+
+// jobDeadline returns the time when output of a completed job expires. ok is false for jobs which are not
+// completed.
+func jobDeadline(job *glacier.JobDescription) (deadline time.Time, ok bool) {
+	if flatString(job.StatusCode) != "Succeeded" || job.CompletionDate == nil {
+		return time.Time{}, false
+	}
+	completed, err := time.Parse(time.RFC3339, *job.CompletionDate)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return completed.Add(jobOutputLifetime), true
+}
+
+// jobProblem describes why output of the job can't be downloaded: the job has failed, or its output has expired
+// or expires within the margin of options. It is empty for usable jobs.
+func (o ArchiveRetrievalOptions) jobProblem(job *glacier.JobDescription, now time.Time) string {
+	switch status := flatString(job.StatusCode); status {
+	case "", "InProgress":
+		return ""
+	case "Succeeded":
+		deadline, ok := jobDeadline(job)
+		switch {
+		case !ok || now.Add(o.JobExpiryMargin).Before(deadline):
+			return ""
+		case now.Before(deadline):
+			return fmt.Sprintf("output expires at %s", deadline.Format(time.RFC3339))
+		default:
+			return fmt.Sprintf("output expired at %s", deadline.Format(time.RFC3339))
+		}
+	default:
+		return fmt.Sprintf("job %s: %s", strings.ToLower(status), flatString(job.StatusMessage))
+	}
+}
+
+// Files returns the number of restored files.
+func (p *RestorePlan) Files() int {
+	files := len(p.EmptyFiles)
+	for _, planned := range p.Archives {
+		files += len(planned.Files)
+	}
+
+	return files
+}
+
+// Report logs a summary of the plan.
+func (p *RestorePlan) Report() {
+	var bytes int64
+	unknownSizes := 0
+	statuses := map[string]int{}
+	for _, planned := range p.Archives {
+		bytes += planned.Size
+		if planned.Size == 0 {
+			unknownSizes++
+		}
+		status := "to create"
+		if planned.Job != nil {
+			status = strings.ToLower(flatString(planned.Job.StatusCode))
+		}
+		statuses[status]++
+	}
+
+	var jobs []string
+	for status, count := range statuses {
+		jobs = append(jobs, fmt.Sprintf("%d %s", count, status))
+	}
+	sort.Strings(jobs)
+
+	log := logger.WithComponent("glacier").WithField("tier", p.Tier)
+	log.Infof("Restore plan: %d files in %d archives, %d empty files", p.Files(), len(p.Archives), len(p.EmptyFiles))
+	if p.Restored > 0 {
+		log.Infof("Restore plan: %d files were already restored by an interrupted run", p.Restored)
+	}
+	log.Infof("Restore plan: %s to retrieve in %s tier", formatBytes(bytes), p.Tier)
+	if unknownSizes > 0 {
+		log.Infof("Restore plan: size of %d archives is unknown", unknownSizes)
+	}
+	if len(jobs) > 0 {
+		log.Infof("Restore plan: retrieval jobs %s", strings.Join(jobs, ", "))
+	}
+}
+
+func formatBytes(bytes int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// CreateMissingJobs creates retrieval jobs for archives which don't have them, no faster than the rate
+// of the options.
+func (c *Connection) CreateMissingJobs(plan *RestorePlan, options ArchiveRetrievalOptions) error {
+	interval := options.jobCreationInterval()
+	var last time.Time
+	for _, planned := range plan.Archives {
+		if planned.Job != nil {
+			continue
+		}
+		if wait := interval - time.Since(last); !last.IsZero() && wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+
+		if err := c.createPlannedJob(planned, options); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// journalJob records the job of the archive for all its files, so a later run awaits the same job.
+func (c *Connection) journalJob(planned *PlannedArchive) {
+	if planned.Job == nil {
+		return
+	}
+	for _, file := range planned.Files {
+		if err := c.restoreJournal.recordJob(file, flatString(planned.Job.JobId)); err != nil {
+			c.logger().WithError(err).Errorf("Failed to journal retrieval job of %s", file.Path())
+			return
+		}
+	}
+}
+
+func (c *Connection) createPlannedJob(planned *PlannedArchive, options ArchiveRetrievalOptions) error {
+	job, err := c.CreateArchiveJob(planned.Files[0], options)
+	if err != nil {
+		return fmt.Errorf("failed to create retrieval job for %s: %w", planned.Files[0].Path(), err)
+	}
+	if job == nil {
+		return fmt.Errorf("retrieval job for %s wasn't created", planned.Files[0].Path())
+	}
+	planned.Job = job
+	if planned.Size == 0 {
+		planned.Size = aws.Int64Value(job.ArchiveSizeInBytes)
+	}
+
+	return nil
+}
+
+// DownloadOrder returns archives in the order of downloading: archives of completed jobs go first, the ones
+// which expire earliest at the front. The rest keeps the order of the plan.
+func (p *RestorePlan) DownloadOrder() []*PlannedArchive {
+	ordered := append([]*PlannedArchive{}, p.Archives...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iDeadline, iCompleted := plannedDeadline(ordered[i])
+		jDeadline, jCompleted := plannedDeadline(ordered[j])
+		if iCompleted != jCompleted {
+			return iCompleted
+		}
+
+		return iDeadline.Before(jDeadline)
+	})
+
+	return ordered
+}
+
+func plannedDeadline(planned *PlannedArchive) (time.Time, bool) {
+	if planned.Job == nil {
+		return time.Time{}, false
+	}
+
+	return jobDeadline(planned.Job)
+}
+
+// nextCompleted returns the archive with a completed job which output expires first, or -1 when all jobs are still
+// running. Jobs which fail, or which output expires before it could be downloaded, are recreated in the tier
+// of options, when the guard of the plan allows it.
+func (c *Connection) nextCompleted(plan *RestorePlan, pending []*PlannedArchive, options ArchiveRetrievalOptions) (int, error) {
+	next := -1
+	var nextDeadline time.Time
+	nextKnown := false
+	now := time.Now()
+	for i, planned := range pending {
+		if planned.Job == nil {
+			return -1, fmt.Errorf("there is no retrieval job for file %s, %s", planned.Files[0].Path(), planned.ArchiveId)
+		}
+		if problem := options.jobProblem(planned.Job, now); problem != "" {
+			if err := c.recreatePlannedJob(plan, planned, options, problem); err != nil {
+				return -1, err
+			}
+			continue
+		}
+		if flatString(planned.Job.StatusCode) != "Succeeded" {
+			continue
+		}
+		// jobs without completion date go after the ones which expire
+		deadline, known := jobDeadline(planned.Job)
+		if next < 0 || known && (!nextKnown || deadline.Before(nextDeadline)) {
+			next, nextDeadline, nextKnown = i, deadline, known
+		}
+	}
+
+	return next, nil
+}
+
+func (c *Connection) recreatePlannedJob(plan *RestorePlan, planned *PlannedArchive, options ArchiveRetrievalOptions, problem string) error {
+	if planned.recreations == maxJobRecreations {
+		return fmt.Errorf("retrieval job of %s was recreated %d times and is still not usable: %s", planned.Files[0].Path(), planned.recreations, problem)
+	}
+	if plan.GuardRecreation != nil {
+		if err := plan.GuardRecreation(estimateRecreation(options.Tier, planned)); err != nil {
+			return fmt.Errorf("retrieval job of %s is not usable (%s): %w", planned.Files[0].Path(), problem, err)
+		}
+	}
+
+	c.logger().Warnf("Retrieval job of %s is not usable (%s), recreating it in %s tier", planned.Files[0].Path(), problem, options.Tier)
+	if err := c.createPlannedJob(planned, options); err != nil {
+		return err
+	}
+	planned.recreations++
+	recreatedJobsCounter.Inc()
+	c.journalJob(planned)
+
+	return nil
+}
+
+// refreshJobs describes running jobs of all pending archives.
+func (c *Connection) refreshJobs(pending []*PlannedArchive) error {
+	for _, planned := range pending {
+		if status := flatString(planned.Job.StatusCode); status != "" && status != "InProgress" {
+			continue
+		}
+		job, err := c.describeJob(planned.Job.JobId)
+		if err != nil {
+			return err
+		}
+		planned.Job = job
+	}
+
+	return nil
+}
+
+// jobPoll waits between checks of running jobs, with exponential backoff.
+type jobPoll struct {
+	interval time.Duration
+}
+
+// wait sleeps for the current interval and doubles it. It returns false when stop is closed in the meantime.
+func (p *jobPoll) wait(stop <-chan struct{}) bool {
+	if p.interval == 0 {
+		p.interval = minJobPollInterval
+	}
+	timer := time.NewTimer(p.interval)
+	defer timer.Stop()
+	p.interval *= 2
+	if p.interval > maxJobPollInterval {
+		p.interval = maxJobPollInterval
+	}
+
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// reset starts the backoff again, once a job has completed.
+func (p *jobPoll) reset() {
+	p.interval = 0
+}
+
+// EmptyContent returns content of a file without archive.
+func EmptyContent(file model.IdentifiableHashedFile) model.FileWithContent {
+	return archiveLoader{
+		IdentifiableHashedFile: file,
+		openContent: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("")), nil
+		},
+		getSize: func() (int64, error) {
+			return 0, nil
+		},
+	}
+}
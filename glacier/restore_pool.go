@@ -0,0 +1,211 @@
+package glacier
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+// Restore passes content of all files of the plan to save, with a pool of download workers. Retrieval jobs of all
+// archives are polled together by the calling goroutine, while workers download files of jobs which have completed. save is called concurrently. Content which doesn't match its hash is rejected and the restore
+// continues, any other error stops the restore and is returned. The restore journal is removed once all files
+// are restored.
+func (c *Connection) Restore(plan *RestorePlan, options ArchiveRetrievalOptions, save func(model.FileWithContent) error) error {
+	if c.meter == nil {
+		c.meter = &downloadMeter{}
+	}
+	for _, planned := range plan.Archives {
+		c.journalJob(planned)
+	}
+	progress := newRestoreProgress(plan, c.meter)
+	stopReports := progress.reportEvery(c.downloadOptions.DownloadProgressInterval)
+	defer stopReports()
+
+	contents := make(chan model.FileWithContent)
+	stop := make(chan struct{})
+	var corrupted atomic.Int64
+	var firstErr error
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < c.downloadOptions.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for content := range contents {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				err := save(content)
+				if errors.Is(err, ErrTreeHashMismatch) {
+					logger.WithComponent("glacier").WithError(err).Errorf("Rejected corrupted content of %s", content.Path())
+					corrupted.Add(1)
+					continue
+				}
+				if err != nil {
+					fail(err)
+					continue
+				}
+				if err := c.restoreJournal.recordDone(content); err != nil {
+					fail(fmt.Errorf("failed to journal restore of %s: %w", content.Path(), err))
+					continue
+				}
+				progress.fileDone(content)
+			}
+		}()
+	}
+
+	send := func(content model.FileWithContent) bool {
+		select {
+		case <-stop:
+			return false
+		case contents <- content:
+			return true
+		}
+	}
+	c.sendContents(plan, options, send, fail, stop)
+	close(contents)
+	wg.Wait()
+
+	progress.report()
+	if firstErr != nil {
+		return firstErr
+	}
+	if corrupted.Load() > 0 {
+		return fmt.Errorf("%w: %d files were not restored", ErrTreeHashMismatch, corrupted.Load())
+	}
+	if err := c.restoreJournal.remove(); err != nil {
+		return fmt.Errorf("failed to remove restore journal: %w", err)
+	}
+
+	return nil
+}
+
+// sendContents passes files of the plan to workers. Files of the completed job which output expires first are sent
+// first. When all jobs are still running, they are polled with growing intervals.
+func (c *Connection) sendContents(plan *RestorePlan, options ArchiveRetrievalOptions, send func(model.FileWithContent) bool, fail func(error), stop <-chan struct{}) {
+	for _, file := range plan.EmptyFiles {
+		if !send(EmptyContent(file)) {
+			return
+		}
+	}
+
+	pending := plan.DownloadOrder()
+	poll := jobPoll{}
+	for len(pending) > 0 {
+		next, err := c.nextCompleted(plan, pending, options)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if next < 0 {
+			c.logger().Debugf("Waiting for %d retrieval jobs", len(pending))
+			if !poll.wait(stop) {
+				return
+			}
+			if err := c.refreshJobs(pending); err != nil {
+				fail(err)
+				return
+			}
+			continue
+		}
+
+		poll.reset()
+		planned := pending[next]
+		pending = append(pending[:next], pending[next+1:]...)
+		for _, file := range planned.Files {
+			if !send(c.contentOf(file, planned.Job)) {
+				return
+			}
+		}
+	}
+}
+
+// restoreProgress counts restored files and downloaded bytes of a restore.
+type restoreProgress struct {
+	totalFiles int
+	totalBytes int64
+	files      atomic.Int64
+	meter      *downloadMeter
+	// bytes downloaded by the meter before the restore has started
+	initialBytes int64
+	started      time.Time
+}
+
+func newRestoreProgress(plan *RestorePlan, meter *downloadMeter) *restoreProgress {
+	progress := &restoreProgress{totalFiles: plan.Files(), meter: meter, initialBytes: meter.bytes(), started: time.Now()}
+	for _, planned := range plan.Archives {
+		for _, file := range planned.Files {
+			progress.totalBytes += retrievedSize(planned, file)
+		}
+	}
+
+	return progress
+}
+
+// retrievedSize is the number of bytes downloaded to restore the file, 0 when it is unknown.
+func retrievedSize(planned *PlannedArchive, file model.IdentifiableHashedFile) int64 {
+	if member, ok := file.(model.BundleMember); ok {
+		if _, length, bundled := member.BundleRange(); bundled {
+			return length
+		}
+	}
+
+	return planned.Size
+}
+
+func (p *restoreProgress) fileDone(file model.FileWithContent) {
+	files := p.files.Add(1)
+	logger.WithComponent("glacier").Debugf("Restored %s (%d of %d files)", file.Path(), files, p.totalFiles)
+}
+
+// reportEvery logs progress periodically, until the returned function is called.
+func (p *restoreProgress) reportEvery(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+func (p *restoreProgress) report() {
+	bytes := p.meter.bytes() - p.initialBytes
+	eta := "unknown"
+	elapsed := time.Since(p.started)
+	if remaining := p.totalBytes - bytes; bytes > 0 && remaining > 0 {
+		eta = time.Duration(float64(elapsed) * float64(remaining) / float64(bytes)).Round(time.Second).String()
+	} else if remaining <= 0 {
+		eta = "0s"
+	}
+
+	logger.WithComponent("glacier").Infof("Restored %d of %d files, downloaded %s of %s, ETA %s",
+		p.files.Load(), p.totalFiles, formatBytes(bytes), formatBytes(p.totalBytes), eta)
+}
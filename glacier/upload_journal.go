@@ -0,0 +1,161 @@
+package glacier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// multipartUpload is an in-progress multipart upload that can be resumed by a later run.
+type multipartUpload struct {
+	UploadId string           `json:"uploadId"`
+	Path     string           `json:"path"`
+	Hash     string           `json:"hash"`
+	Size     int64            `json:"size"`
+	PartSize int64            `json:"partSize"`
+	Parts    map[int64]string `json:"parts"`
+	Started  time.Time        `json:"started"`
+}
+
+func (u multipartUpload) matches(path, hash string, size, partSize int64) bool {
+	return u.Path == path && u.Hash == hash && u.Size == size && u.PartSize == partSize
+}
+
+// uploadJournal keeps multipart uploads in a file, so they survive process restarts.
+// A nil journal doesn't persist anything.
+type uploadJournal struct {
+	filePath string
+	mutex    sync.Mutex
+	uploads  map[string]*multipartUpload
+}
+
+func openUploadJournal(filePath string) (*uploadJournal, error) {
+	j := &uploadJournal{filePath: filePath, uploads: map[string]*multipartUpload{}}
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []*multipartUpload
+	if err := json.Unmarshal(data, &uploads); err != nil {
+		return nil, fmt.Errorf("can't unmarshal upload journal %s: %w", filePath, err)
+	}
+	for _, upload := range uploads {
+		if upload.Parts == nil {
+			upload.Parts = map[int64]string{}
+		}
+		j.uploads[upload.UploadId] = upload
+	}
+
+	return j, nil
+}
+
+func (j *uploadJournal) find(path, hash string, size, partSize int64) *multipartUpload {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for _, upload := range j.uploads {
+		if upload.matches(path, hash, size, partSize) {
+			result := *upload
+			return &result
+		}
+	}
+
+	return nil
+}
+
+func (j *uploadJournal) list() []multipartUpload {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	result := make([]multipartUpload, 0, len(j.uploads))
+	for _, upload := range j.uploads {
+		result = append(result, *upload)
+	}
+
+	return result
+}
+
+func (j *uploadJournal) start(upload multipartUpload) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	upload.Parts = map[int64]string{}
+	j.uploads[upload.UploadId] = &upload
+
+	return j.save()
+}
+
+func (j *uploadJournal) recordPart(uploadId string, offset int64, treeHash string) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	upload, ok := j.uploads[uploadId]
+	if !ok {
+		return fmt.Errorf("unknown multipart upload %s", uploadId)
+	}
+	upload.Parts[offset] = treeHash
+
+	return j.save()
+}
+
+func (j *uploadJournal) remove(uploadId string) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if _, ok := j.uploads[uploadId]; !ok {
+		return nil
+	}
+	delete(j.uploads, uploadId)
+
+	return j.save()
+}
+
+func (j *uploadJournal) save() error {
+	uploads := make([]*multipartUpload, 0, len(j.uploads))
+	for _, upload := range j.uploads {
+		uploads = append(uploads, upload)
+	}
+
+	if len(uploads) == 0 {
+		if err := os.Remove(j.filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(uploads)
+	if err != nil {
+		return err
+	}
+
+	temp := filepath.Join(filepath.Dir(j.filePath), "."+filepath.Base(j.filePath)+".tmp")
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(temp, j.filePath)
+}
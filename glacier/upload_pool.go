@@ -0,0 +1,104 @@
+package glacier
+
+import (
+	"sync"
+
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+type uploadResult struct {
+	change    model.FileAdded
+	committed model.HashedFile
+	id        string
+	err       error
+}
+
+// processAdditions uploads additions with a pool of workers. Commits are made by the calling goroutine only,
+// one at a time and only after the archive has been uploaded, so the index never refers to a missing archive.
+// It returns all additions that were taken for upload and the last upload error. err is returned when commit fails.
+func (c *Connection) processAdditions(committer model.ChangeCommitter, additions <-chan model.FileAdded) (wanted model.HashedFiles, uploadErr, err error) {
+	stop := make(chan struct{})
+	results := c.startUploadWorkers(additions, stop)
+	wanted = model.HashedFiles{}
+
+	for result := range results {
+		wanted.Replace(result.change)
+		if result.err != nil {
+			uploadErr = result.err
+			c.logger().WithError(result.err).Errorf("Failed to process change: %v", result.change)
+			continue
+		}
+
+		if err := committer.CommitAdd(result.id, result.committed); err != nil {
+			close(stop)
+			for range results {
+			}
+			return wanted, uploadErr, err
+		}
+	}
+
+	return wanted, uploadErr, nil
+}
+
+func (c *Connection) startUploadWorkers(additions <-chan model.FileAdded, stop <-chan struct{}) <-chan uploadResult {
+	results := make(chan uploadResult)
+	bundler := c.newBundler()
+	wg := sync.WaitGroup{}
+
+	send := func(toSend []uploadResult) bool {
+		for _, result := range toSend {
+			select {
+			case <-stop:
+				return false
+			case results <- result:
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < c.uploadOptions.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var change model.FileAdded
+				var ok bool
+				select {
+				case <-stop:
+					return
+				case change, ok = <-additions:
+					if !ok {
+						return
+					}
+				}
+
+				if bundler.accepts(change) {
+					if !send(c.processBundled(bundler, change)) {
+						return
+					}
+					continue
+				}
+
+				committed, id, err := c.processAdd(change)
+				if !send([]uploadResult{{change: change, committed: committed, id: id, err: err}}) {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		if last := bundler.flush(); last != nil {
+			select {
+			case <-stop:
+				last.close()
+			default:
+				send(c.uploadBundle(last))
+			}
+		}
+		close(results)
+	}()
+
+	return results
+}
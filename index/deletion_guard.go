@@ -0,0 +1,92 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+const reportedDeletions = 10
+
+// ErrTooManyDeletions is returned when deletions exceed DeletionLimits, e.g. because the volume is not mounted.
+var ErrTooManyDeletions = errors.New("too many deletions")
+
+type DeletionLimits struct {
+	MaxDeletions        int  `env:"MAX_DELETIONS" help:"Refuse to delete anything when more than this number of files is deleted in a single run. 0 disables the limit." default:"1000" group:"Deletion guard"`
+	MaxDeletionsPercent int  `env:"MAX_DELETIONS_PERCENT" help:"Refuse to delete anything when more than this percent of indexed files is deleted in a single run. 0 disables the limit." default:"50" group:"Deletion guard"`
+	AllowMassDeletion   bool `env:"ALLOW_MASS_DELETION" help:"Process deletions even when they exceed the limits." optional:"" group:"Deletion guard"`
+}
+
+// Size returns the number of indexed paths, without paths which have only tombstones.
+func (i Index) Size() int {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	size := 0
+	for _, pathEntries := range i.entries {
+		for _, entry := range pathEntries {
+			if !entry.IsTombstone() {
+				size++
+				break
+			}
+		}
+	}
+
+	return size
+}
+
+// GuardDeletions checks deletions against limits. Exceeded limits are reported in logs and ErrTooManyDeletions
+// is returned, unless mass deletion is allowed. Only paths missing in the volume are counted: purges of tombstones
+// were checked when the files were deleted and previous versions of modified files are replaced, not lost.
+func (i Index) GuardDeletions(deletions []model.FileDeleted, limits DeletionLimits) error {
+	var deleted []model.FileDeleted
+	paths := map[string]bool{}
+	for _, deletion := range deletions {
+		if !deletion.Purge && !deletion.Replaced && !paths[deletion.Path()] {
+			paths[deletion.Path()] = true
+			deleted = append(deleted, deletion)
+		}
+	}
+	deletions = deleted
+	indexed := i.Size()
+	if len(deletions) == 0 || indexed == 0 {
+		return nil
+	}
+	percent := float64(len(deletions)) * 100 / float64(indexed)
+
+	var exceeded []string
+	if limits.MaxDeletions > 0 && len(deletions) > limits.MaxDeletions {
+		exceeded = append(exceeded, fmt.Sprintf("more than %d files", limits.MaxDeletions))
+	}
+	if limits.MaxDeletionsPercent > 0 && percent > float64(limits.MaxDeletionsPercent) {
+		exceeded = append(exceeded, fmt.Sprintf("more than %d%% of indexed files", limits.MaxDeletionsPercent))
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	log := logger.WithComponent("index").
+		WithField("deletions", len(deletions)).
+		WithField("indexed", indexed).
+		WithField("percent", fmt.Sprintf("%.1f", percent))
+	for idx, deletion := range deletions {
+		if idx == reportedDeletions {
+			log.Warnf("... and %d more", len(deletions)-reportedDeletions)
+			break
+		}
+		log.Warnf("To be deleted: %s", deletion.Path())
+	}
+
+	if limits.AllowMassDeletion {
+		log.Warnf("Deleting %s as mass deletion is allowed", strings.Join(exceeded, " and "))
+		return nil
+	}
+	log.Errorf("Refusing to delete %d of %d indexed files: deletions exceed %s. "+
+		"Check that the volume is mounted and complete. Run with --allow-mass-deletion (ALLOW_MASS_DELETION=true) if the files were deleted on purpose.",
+		len(deletions), indexed, strings.Join(exceeded, " and "))
+
+	return fmt.Errorf("%w: %d of %d indexed files", ErrTooManyDeletions, len(deletions), indexed)
+}
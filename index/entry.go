@@ -7,6 +7,17 @@ type Entry struct {
 	path       string
 	changeId   string
 	recordDate time.Time
+	encoding   string
+	bundle     *bundleRange
+	// archiveSize is the number of bytes stored in Glacier, 0 when unknown
+	archiveSize int64
+	// deletedAt is set when the file was deleted and the entry is kept as a tombstone
+	deletedAt time.Time
+}
+
+type bundleRange struct {
+	offset int64
+	length int64
 }
 
 func NewEntry(path, hash, changeId string) Entry {
@@ -39,12 +50,51 @@ func (e Entry) ChangeId() string {
 	return e.changeId
 }
 
+// BundleRange returns position of the file when it is stored in a bundle archive.
+func (e Entry) BundleRange() (offset, length int64, ok bool) {
+	if e.bundle == nil {
+		return 0, 0, false
+	}
+
+	return e.bundle.offset, e.bundle.length, true
+}
+
+// Encoding of the archive, empty when content was uploaded as is.
+func (e Entry) Encoding() string {
+	return e.encoding
+}
+
+// ArchiveSize is the size of the archive in Glacier, which is retrieved to restore the file. It is 0 when unknown.
+func (e Entry) ArchiveSize() int64 {
+	return e.archiveSize
+}
+
+// IsTombstone is true when the file was deleted, but its archive is still kept.
+func (e Entry) IsTombstone() bool {
+	return !e.deletedAt.IsZero()
+}
+
+// DeletedAt is the time when the file was marked as deleted.
+func (e Entry) DeletedAt() time.Time {
+	return e.deletedAt
+}
+
 func (e entries) hasEntryWithHash(path, hash string) bool {
 	return e.hasEntryMatching(path, func(e Entry) bool {
-		return e.hash == hash
+		return e.hash == hash && !e.IsTombstone()
 	})
 }
 
+func (e entries) findTombstone(path string, filter func(e Entry) bool) (Entry, bool) {
+	for _, entry := range e[path] {
+		if entry.IsTombstone() && filter(entry) {
+			return entry, true
+		}
+	}
+
+	return Entry{}, false
+}
+
 func (e entries) hasEntryWithChangeId(path, changeId string) bool {
 	return e.hasEntryMatching(path, func(e Entry) bool {
 		return e.changeId == changeId
@@ -83,6 +133,15 @@ func (e entries) deleteEntryByChangeId(path, changeId string) {
 	e[path] = newElements
 }
 
+// markDeleted sets deletedAt of the entry, zero time revives it.
+func (e entries) markDeleted(path, changeId string, deletedAt time.Time) {
+	for idx := range e[path] {
+		if e[path][idx].changeId == changeId {
+			e[path][idx].deletedAt = deletedAt
+		}
+	}
+}
+
 func (e entries) add(entry Entry) {
 	pathEntries, _ := e[entry.path]
 	e[entry.path] = append(pathEntries, entry)
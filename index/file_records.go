@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/mrdunski/accumulation-zone/logger"
 	"github.com/sirupsen/logrus"
+	"io"
 	"os"
 	"time"
 )
@@ -13,8 +14,10 @@ import (
 type changeType string
 
 const (
-	fileAdded   changeType = "added"
-	fileDeleted changeType = "deleted"
+	fileAdded      changeType = "added"
+	fileDeleted    changeType = "deleted"
+	fileTombstoned changeType = "tombstoned"
+	fileRevived    changeType = "revived"
 )
 
 type record struct {
@@ -23,6 +26,14 @@ type record struct {
 	Hash          string     `json:"hash"`
 	ChangeId      string     `json:"id"`
 	Time          time.Time  `json:"time"`
+	Encoding      string     `json:"encoding,omitempty"`
+	Bundle        *bundle    `json:"bundle,omitempty"`
+	Size          int64      `json:"size,omitempty"`
+}
+
+type bundle struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
 }
 
 type fileRecords struct {
@@ -44,6 +55,11 @@ func (f fileRecords) add(entry Entry) error {
 		Hash:          entry.hash,
 		Time:          entry.recordDate,
 		ChangeId:      entry.changeId,
+		Encoding:      entry.encoding,
+		Size:          entry.archiveSize,
+	}
+	if entry.bundle != nil {
+		r.Bundle = &bundle{Offset: entry.bundle.offset, Length: entry.bundle.length}
 	}
 
 	return f.writeRecord(r)
@@ -61,6 +77,26 @@ func (f fileRecords) remove(entry Entry) error {
 	return f.writeRecord(r)
 }
 
+func (f fileRecords) tombstone(entry Entry) error {
+	return f.writeRecord(record{
+		OperationType: fileTombstoned,
+		Path:          entry.path,
+		Hash:          entry.hash,
+		Time:          entry.deletedAt,
+		ChangeId:      entry.changeId,
+	})
+}
+
+func (f fileRecords) revive(entry Entry) error {
+	return f.writeRecord(record{
+		OperationType: fileRevived,
+		Path:          entry.path,
+		Hash:          entry.hash,
+		Time:          time.Now(),
+		ChangeId:      entry.changeId,
+	})
+}
+
 func (f fileRecords) writeRecord(r record) (err error) {
 	data, err := json.Marshal(r)
 	if err != nil {
@@ -72,18 +108,22 @@ func (f fileRecords) writeRecord(r record) (err error) {
 	}
 
 	defer func(file *os.File) {
-		err = file.Close()
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
 	}(file)
 
-	_, err = file.Write(data)
+	// single write of the whole line, so a crash can only leave a torn last line
+	_, err = file.Write(append(data, '\n'))
 	if err != nil {
 		return err
 	}
 
-	_, err = file.Write([]byte("\n"))
-	return err
+	return file.Sync()
 }
 
+// loadEntries replays all records. An incomplete last record, left by a crash during commit, is removed from the file.
 func (f fileRecords) loadEntries() (_ entries, err error) {
 	file, err := f.openOrCreate()
 	if err != nil {
@@ -91,46 +131,112 @@ func (f fileRecords) loadEntries() (_ entries, err error) {
 	}
 
 	defer func(file *os.File) {
-		err = file.Close()
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}(file)
+
+	result, validSize, tornRecordErr, err := replayRecords(file, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if tornRecordErr != nil {
+		logger.WithComponent("index").WithError(tornRecordErr).Warnf("Removing incomplete last record of %s", f.filePath)
+		if err := file.Truncate(validSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// loadEntriesUntil replays records made until the given time without modifying the file. An incomplete last
+// record is skipped.
+func (f fileRecords) loadEntriesUntil(until time.Time) (_ entries, err error) {
+	file, err := os.Open(f.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(file *os.File) {
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
 	}(file)
 
+	result, _, tornRecordErr, err := replayRecords(file, until)
+	if tornRecordErr != nil {
+		logger.WithComponent("index").WithError(tornRecordErr).Debugf("Skipping incomplete last record of %s", f.filePath)
+	}
+
+	return result, err
+}
+
+// replayRecords replays records made until the given time. Zero time replays all records. Only the last record
+// can be torn by a crash during commit: it is skipped and returned as tornRecordErr together with the size
+// of complete records.
+func replayRecords(in io.Reader, until time.Time) (_ entries, validSize int64, tornRecordErr error, err error) {
 	result := entries{}
-	scanner := bufio.NewScanner(file)
-	r := record{}
+	scanner := bufio.NewScanner(in)
 	scanned := 0
 	for scanner.Scan() {
+		if tornRecordErr != nil {
+			return nil, 0, nil, tornRecordErr
+		}
 		scanned++
 		if logger.Get().IsLevelEnabled(logrus.TraceLevel) {
 			logger.WithComponent("index").Tracef("Processing entry: %s", scanner.Text())
 		}
-		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
-			return nil, err
+		r := record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// only the last record can be torn by a crash during commit - it is checked after the loop
+			tornRecordErr = err
+			continue
+		}
+		validSize += int64(len(scanner.Bytes())) + 1
+		if !until.IsZero() && r.Time.After(until) {
+			continue
 		}
 
 		switch r.OperationType {
 		case fileAdded:
-			result.add(Entry{
-				hash:       r.Hash,
-				path:       r.Path,
-				changeId:   r.ChangeId,
-				recordDate: r.Time,
-			})
+			entry := Entry{
+				hash:        r.Hash,
+				path:        r.Path,
+				changeId:    r.ChangeId,
+				recordDate:  r.Time,
+				encoding:    r.Encoding,
+				archiveSize: r.Size,
+			}
+			if r.Bundle != nil {
+				entry.bundle = &bundleRange{offset: r.Bundle.Offset, length: r.Bundle.Length}
+			}
+			result.add(entry)
 		case fileDeleted:
 			result.deleteEntryByChangeId(r.Path, r.ChangeId)
+		case fileTombstoned:
+			result.markDeleted(r.Path, r.ChangeId, r.Time)
+		case fileRevived:
+			result.markDeleted(r.Path, r.ChangeId, time.Time{})
 		default:
-			return nil, errors.New("unsupported record")
+			return nil, 0, nil, errors.New("unsupported record")
 		}
 
 	}
 
 	if scanner.Err() != nil {
-		return nil, scanner.Err()
+		return nil, 0, nil, scanner.Err()
 	}
 
 	if logger.Get().IsLevelEnabled(logrus.DebugLevel) {
 		logger.WithComponent("index").Debugf("Scanned %d entries, loaded %d index items", scanned, len(result.flatten()))
 	}
-	return result, nil
+	return result, validSize, tornRecordErr, nil
 }
 
 func (f fileRecords) openOrCreate() (*os.File, error) {
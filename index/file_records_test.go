@@ -73,4 +73,37 @@ var _ = g.Describe("fileRecords", func() {
 		Expect(err).NotTo(HaveOccurred())
 		Expect(entries.flatten()).To(BeEmpty())
 	})
+
+	g.It("drops incomplete last record", func() {
+		records := fileRecords{
+			filePath: testFile.Name(),
+		}
+		entry := NewEntry("test", "h123", "ch123")
+		Expect(records.add(entry)).To(Succeed())
+		_, err := testFile.WriteString(`{"type":"added","path":"te`)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := records.loadEntries()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries.flatten()).To(HaveLen(1))
+
+		next := NewEntry("test2", "h234", "ch234")
+		Expect(records.add(next)).To(Succeed())
+		entries, err = records.loadEntries()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(haveEntry(entry))
+		Expect(entries).To(haveEntry(next))
+	})
+
+	g.It("fails on broken record in the middle", func() {
+		records := fileRecords{
+			filePath: testFile.Name(),
+		}
+		_, err := testFile.WriteString("{broken\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records.add(NewEntry("test", "h123", "ch123"))).To(Succeed())
+
+		_, err = records.loadEntries()
+		Expect(err).To(HaveOccurred())
+	})
 })
@@ -0,0 +1,56 @@
+package index
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/logger"
+)
+
+// AsOf rebuilds the index as it was at the given time from its records. For each path, the newest file committed
+// before that time is kept. Files whose archives are not stored anymore are skipped. The result is read only.
+func (i Index) AsOf(t time.Time) (Index, error) {
+	records, ok := i.committer.(fileRecords)
+	if !ok {
+		return Index{}, errors.New("history of the index is not available")
+	}
+	past, err := records.loadEntriesUntil(t)
+	if err != nil {
+		return Index{}, err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	result := Index{
+		committer: voidCommitter{},
+		entries:   entries{},
+		mutex:     &sync.RWMutex{},
+	}
+	for path, pathEntries := range past {
+		var newest *Entry
+		for idx, entry := range pathEntries {
+			if entry.IsTombstone() {
+				continue
+			}
+			if newest == nil || newest.recordDate.Before(entry.recordDate) {
+				newest = &pathEntries[idx]
+			}
+		}
+		if newest == nil {
+			continue
+		}
+
+		if newest.changeId == "" || !i.entries.hasEntryWithChangeId(path, newest.changeId) {
+			logger.WithComponent("index").Warnf("Version of %s from %v is not stored anymore", path, t)
+			continue
+		}
+
+		entry := *newest
+		entry.deletedAt = time.Time{}
+		result.entries.add(entry)
+	}
+
+	return result, nil
+}
@@ -1,7 +1,10 @@
 package index
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/mrdunski/accumulation-zone/logger"
 	"github.com/mrdunski/accumulation-zone/model"
@@ -16,21 +19,26 @@ var (
 		Namespace: telemetry.Namespace,
 		Name:      "index_commit_count",
 	}, []string{"type"})
-	addCounter    = commitCounter.With(prometheus.Labels{"type": "add"})
-	deleteCounter = commitCounter.With(prometheus.Labels{"type": "delete"})
+	addCounter       = commitCounter.With(prometheus.Labels{"type": "add"})
+	deleteCounter    = commitCounter.With(prometheus.Labels{"type": "delete"})
+	tombstoneCounter = commitCounter.With(prometheus.Labels{"type": "tombstone"})
+	reviveCounter    = commitCounter.With(prometheus.Labels{"type": "revive"})
 
 	changeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: telemetry.Namespace,
 		Name:      "index_changes_count",
 	}, []string{"type"})
 
-	addChangeGauge    = changeGauge.With(prometheus.Labels{"type": "add"})
-	deleteChangeGauge = changeGauge.With(prometheus.Labels{"type": "delete"})
+	addChangeGauge       = changeGauge.With(prometheus.Labels{"type": "add"})
+	deleteChangeGauge    = changeGauge.With(prometheus.Labels{"type": "delete"})
+	tombstoneChangeGauge = changeGauge.With(prometheus.Labels{"type": "tombstone"})
 )
 
 type committer interface {
 	add(entry Entry) error
 	remove(entry Entry) error
+	tombstone(entry Entry) error
+	revive(entry Entry) error
 	clear() error
 }
 
@@ -48,16 +56,28 @@ func (v voidCommitter) remove(_ Entry) error {
 	return nil
 }
 
+func (v voidCommitter) tombstone(_ Entry) error {
+	return nil
+}
+
+func (v voidCommitter) revive(_ Entry) error {
+	return nil
+}
+
 // Index tracks changes made in files
 type Index struct {
 	committer
 	entries entries
+	mutex   *sync.RWMutex
+	// retention is nil when archives of deleted files are deleted right away
+	retention *RetentionOptions
 }
 
 func New(entryList []Entry) Index {
 	index := Index{
 		entries:   entries{},
 		committer: voidCommitter{},
+		mutex:     &sync.RWMutex{},
 	}
 	for _, entry := range entryList {
 		index.entries.add(entry)
@@ -78,6 +98,7 @@ func LoadIndexFile(filePath string) (Index, error) {
 	return Index{
 		committer: records,
 		entries:   data,
+		mutex:     &sync.RWMutex{},
 	}, nil
 }
 
@@ -90,22 +111,18 @@ func (i Index) CalculateChanges(files []model.FileWithContent) model.Changes {
 		logger.WithComponent("index").Debugf("Calculating changed files for %v files", files)
 	}
 
-	changes := model.Changes{}
-	existing := model.HashedFiles{}
-
+	in := make(chan model.FileWithContent, len(files))
 	for _, file := range files {
-		existing.Replace(file)
-		if i.IsChanged(file) {
-			changes.Additions = append(changes.Additions, model.FileAdded{FileWithContent: file})
-		}
+		in <- file
 	}
+	close(in)
 
-	for _, pathEntries := range i.entries {
-		for _, pathEntry := range pathEntries {
-			if !existing.HasFile(pathEntry.path, pathEntry.hash) {
-				changes.Deletions = append(changes.Deletions, model.FileDeleted{IdentifiableHashedFile: pathEntry})
-			}
-		}
+	additions := make(chan model.FileAdded, len(files))
+	deletions, _ := i.StreamChanges(context.Background(), in, additions)
+
+	changes := model.Changes{Deletions: deletions}
+	for addition := range additions {
+		changes.Additions = append(changes.Additions, addition)
 	}
 
 	switch {
@@ -115,23 +132,149 @@ func (i Index) CalculateChanges(files []model.FileWithContent) model.Changes {
 		logger.WithComponent("index").Debugf("Calculated changes. %v", changes)
 	}
 
-	addChangeGauge.Set(float64(len(changes.Additions)))
-	deleteChangeGauge.Set(float64(len(changes.Deletions)))
 	return changes
 }
 
+// StreamChanges compares files with the Index as they come. Additions are sent as soon as they are found and
+// additions channel is closed when files are exhausted. Deletions are known only after that, so they are returned.
+func (i Index) StreamChanges(ctx context.Context, files <-chan model.FileWithContent, additions chan<- model.FileAdded) ([]model.FileDeleted, error) {
+	defer close(additions)
+	existing := map[string]string{}
+	added := 0
+
+	for file := range files {
+		existing[file.Path()] = file.Hash()
+		if !i.IsChanged(file) {
+			continue
+		}
+
+		addition := model.FileAdded{FileWithContent: file}
+		if tombstone, ok := i.findTombstoneWithHash(file.Path(), file.Hash()); ok {
+			addition.TombstoneId = tombstone.changeId
+		}
+		select {
+		case additions <- addition:
+			added++
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	deletions := i.findDeletions(existing, true)
+	tombstoned := 0
+	for _, deletion := range deletions {
+		if deletion.Tombstone {
+			tombstoned++
+		}
+	}
+
+	addChangeGauge.Set(float64(added))
+	deleteChangeGauge.Set(float64(len(deletions) - tombstoned))
+	tombstoneChangeGauge.Set(float64(tombstoned))
+	return deletions, nil
+}
+
+// Prunable returns versions and deleted files whose retention has passed, so their archives can be deleted.
+func (i Index) Prunable() []model.FileDeleted {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.findDeletions(nil, false)
+}
+
+// findDeletions finds entries which don't match existing files. Entries which still exist are deleted only
+// when the volume was scanned. Tombstones are purged according to retention.
+func (i Index) findDeletions(existing map[string]string, scanned bool) []model.FileDeleted {
+	now := time.Now()
+	var deletions []model.FileDeleted
+	archiveReferences := map[string]int{}
+	for _, pathEntries := range i.entries {
+		var keptVersions map[int]bool
+		if i.retention != nil {
+			keptVersions = i.retention.keptVersions(pathEntries, now)
+		}
+		for idx, pathEntry := range pathEntries {
+			if pathEntry.changeId != "" {
+				archiveReferences[pathEntry.changeId]++
+			}
+			if hash, ok := existing[pathEntry.path]; ok && hash == pathEntry.hash {
+				continue
+			}
+			switch {
+			case !pathEntry.IsTombstone():
+				if !scanned {
+					continue
+				}
+				tombstone := i.retention != nil && !i.retention.ForceDeletion
+				_, replaced := existing[pathEntry.path]
+				deletions = append(deletions, model.FileDeleted{IdentifiableHashedFile: pathEntry, Tombstone: tombstone, Replaced: replaced})
+			case i.retention == nil || (i.retention.expired(pathEntry, now) && !keptVersions[idx]):
+				deletions = append(deletions, model.FileDeleted{IdentifiableHashedFile: pathEntry, Purge: true})
+			}
+		}
+	}
+
+	// an archive shared by many files (a bundle) is deleted together with the last file referring to it
+	for idx := range deletions {
+		if deletions[idx].Tombstone {
+			continue
+		}
+		changeId := deletions[idx].ChangeId()
+		if changeId == "" {
+			continue
+		}
+		archiveReferences[changeId]--
+		deletions[idx].KeepArchive = archiveReferences[changeId] > 0
+	}
+
+	return deletions
+}
+
+func (i Index) findTombstoneWithHash(path, hash string) (Entry, bool) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.entries.findTombstone(path, func(e Entry) bool {
+		return e.hash == hash
+	})
+}
+
 // IsChanged returns true if the file was changed.
 func (i Index) IsChanged(file model.FileWithContent) bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
 	return !i.entries.hasEntryWithHash(file.Path(), file.Hash())
 }
 
-// CommitAdd marks change as complete.
+// CommitAdd marks change as complete. A file matching a tombstone revives it.
 func (i Index) CommitAdd(changeId string, file model.HashedFile) error {
 	logger.WithComponent("index").Debugf("Commiting add %s %s", changeId, file.Path())
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if added, ok := file.(model.FileAdded); ok && added.TombstoneId != "" {
+		return i.reviveTombstone(added)
+	}
 	if i.entries.hasEntryWithChangeId(file.Path(), changeId) && changeId != "" {
 		return errors.New("file already exist")
 	}
 	entry := NewEntry(file.Path(), file.Hash(), changeId)
+	if uploaded, ok := file.(model.UploadTimeHolder); ok && !uploaded.UploadedAt().IsZero() {
+		entry.recordDate = uploaded.UploadedAt()
+	}
+	if encoded, ok := file.(model.EncodingHolder); ok {
+		entry.encoding = encoded.Encoding()
+	}
+	if member, ok := file.(model.BundleMember); ok {
+		if offset, length, bundled := member.BundleRange(); bundled {
+			entry.bundle = &bundleRange{offset: offset, length: length}
+		}
+	}
+	entry.archiveSize = archiveSize(file)
 	if err := i.add(entry); err != nil {
 		return err
 	}
@@ -141,13 +284,56 @@ func (i Index) CommitAdd(changeId string, file model.HashedFile) error {
 	return nil
 }
 
-// CommitDelete marks change as complete.
+// archiveSize of the committed file. Uploaded files which don't know it are stored as they are.
+func archiveSize(file model.HashedFile) int64 {
+	if sized, ok := file.(model.ArchiveSizeHolder); ok {
+		return sized.ArchiveSize()
+	}
+	if content, ok := file.(model.FileWithContent); ok {
+		if size, err := content.Size(); err == nil {
+			return size
+		}
+	}
+
+	return 0
+}
+
+func (i Index) reviveTombstone(file model.FileAdded) error {
+	entry, ok := i.entries.findTombstone(file.Path(), func(e Entry) bool {
+		return e.changeId == file.TombstoneId
+	})
+	if !ok {
+		return errors.New("tombstone doesn't exist")
+	}
+	if err := i.revive(entry); err != nil {
+		return err
+	}
+	i.entries.markDeleted(entry.path, entry.changeId, time.Time{})
+
+	reviveCounter.Inc()
+	return nil
+}
+
+// CommitDelete marks change as complete. Tombstones are kept in the index until they are purged.
 func (i Index) CommitDelete(changeId string, file model.HashedFile) error {
 	logger.WithComponent("index").Debugf("Commiting delete %s %s", changeId, file.Path())
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
 	if !i.entries.hasEntryWithChangeId(file.Path(), changeId) {
 		return errors.New("change doesn't exist")
 	}
 	entry := NewEntry(file.Path(), file.Hash(), changeId)
+	if deleted, ok := file.(model.FileDeleted); ok && deleted.Tombstone {
+		entry.deletedAt = time.Now()
+		if err := i.tombstone(entry); err != nil {
+			return err
+		}
+		i.entries.markDeleted(file.Path(), changeId, entry.deletedAt)
+
+		tombstoneCounter.Inc()
+		return nil
+	}
 	if err := i.remove(entry); err != nil {
 		return err
 	}
@@ -160,6 +346,9 @@ func (i Index) CommitDelete(changeId string, file model.HashedFile) error {
 // Clear removes all files from index.
 func (i Index) Clear() error {
 	logger.WithComponent("index").Debugf("Clearing index")
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
 	for k := range i.entries {
 		delete(i.entries, k)
 	}
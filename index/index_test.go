@@ -1,11 +1,15 @@
 package index_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mrdunski/accumulation-zone/index"
 	"github.com/mrdunski/accumulation-zone/model"
@@ -48,10 +52,48 @@ func (e entryWithContent) Content() (io.ReadCloser, error) {
 	return io.NopCloser(strings.NewReader("")), nil
 }
 
+type encodedFile struct {
+	entryWithContent
+	encoding string
+}
+
+func (e encodedFile) Encoding() string {
+	return e.encoding
+}
+
+type bundledFile struct {
+	entryWithContent
+	offset int64
+	length int64
+	size   int64
+}
+
+func (e bundledFile) ArchiveSize() int64 {
+	return e.size
+}
+
+func (e bundledFile) BundleRange() (int64, int64, bool) {
+	return e.offset, e.length, true
+}
+
 func newEntry(path, hash, changeId string) entryWithContent {
 	return entryWithContent{Entry: index.NewEntry(path, hash, changeId)}
 }
 
+// indexRecord is a line of the index file made age ago.
+func indexRecord(operation, path, changeId string, age time.Duration) string {
+	return fmt.Sprintf(`{"type":"%s","path":"%s","hash":"h-%s","id":"%s","time":"%s"}`,
+		operation, path, path, changeId, time.Now().Add(-age).Format(time.RFC3339Nano))
+}
+
+func loadRecords(indexPath string, records ...string) index.Index {
+	Expect(os.WriteFile(indexPath, []byte(strings.Join(records, "\n")+"\n"), 0600)).To(Succeed())
+	i, err := index.LoadIndexFile(indexPath)
+	Expect(err).NotTo(HaveOccurred())
+
+	return i
+}
+
 func TestIndex(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "index")
@@ -120,7 +162,7 @@ var _ = Describe("Index", func() {
 					i := index.New(entries)
 					changes := i.CalculateChanges(files)
 					Expect(changes.Deletions).To(ConsistOf(
-						model.FileDeleted{IdentifiableHashedFile: entries[0]},
+						model.FileDeleted{IdentifiableHashedFile: entries[0], Replaced: true},
 					))
 					Expect(changes.Additions).To(ConsistOf(
 						model.FileAdded{FileWithContent: files[0]},
@@ -178,8 +220,8 @@ var _ = Describe("Index", func() {
 					i := index.New(entries)
 					changes := i.CalculateChanges(files)
 					Expect(changes.Deletions).To(ConsistOf(
-						model.FileDeleted{IdentifiableHashedFile: entries[0]},
-						model.FileDeleted{IdentifiableHashedFile: entries[1]},
+						model.FileDeleted{IdentifiableHashedFile: entries[0], Replaced: true},
+						model.FileDeleted{IdentifiableHashedFile: entries[1], Replaced: true},
 					))
 					Expect(changes.Additions).To(ConsistOf(
 						model.FileAdded{FileWithContent: files[0]},
@@ -202,7 +244,7 @@ var _ = Describe("Index", func() {
 					i := index.New(entries)
 					changes := i.CalculateChanges(files)
 					Expect(changes.Deletions).To(ConsistOf(
-						model.FileDeleted{IdentifiableHashedFile: entries[0]},
+						model.FileDeleted{IdentifiableHashedFile: entries[0], Replaced: true},
 					))
 					Expect(changes.Additions).To(BeEmpty())
 				})
@@ -210,6 +252,150 @@ var _ = Describe("Index", func() {
 		})
 	})
 
+	Describe("Shared archives", func() {
+		var entries []index.Entry
+
+		BeforeEach(func() {
+			entries = []index.Entry{
+				index.NewEntry("test1", "h1", "bundle"),
+				index.NewEntry("test2", "h2", "bundle"),
+				index.NewEntry("test3", "h3", "single"),
+			}
+		})
+
+		It("keeps archive used by other files", func() {
+			changes := index.New(entries).CalculateChanges([]model.FileWithContent{
+				newEntry("test2", "h2", ""),
+				newEntry("test3", "h3", ""),
+			})
+
+			Expect(changes.Deletions).To(ConsistOf(model.FileDeleted{IdentifiableHashedFile: entries[0], KeepArchive: true}))
+		})
+
+		It("deletes archive with the last file", func() {
+			changes := index.New(entries).CalculateChanges(nil)
+
+			Expect(changes.Deletions).To(HaveLen(3))
+			kept := map[string]int{}
+			for _, deletion := range changes.Deletions {
+				if deletion.KeepArchive {
+					kept[deletion.ChangeId()]++
+				}
+			}
+			Expect(kept).To(Equal(map[string]int{"bundle": 1}))
+		})
+	})
+
+	Describe("GuardDeletions", func() {
+		var idx index.Index
+
+		BeforeEach(func() {
+			var entries []index.Entry
+			for i := 0; i < 10; i++ {
+				entries = append(entries, index.NewEntry(fmt.Sprintf("test%d", i), "h", fmt.Sprintf("%d", i)))
+			}
+			idx = index.New(entries)
+		})
+
+		deleted := func(count int) []model.FileDeleted {
+			return idx.CalculateChanges(nil).Deletions[:count]
+		}
+
+		It("counts indexed files", func() {
+			Expect(idx.Size()).To(Equal(10))
+		})
+
+		DescribeTable("checks limits", func(count int, limits index.DeletionLimits, allowed bool) {
+			err := idx.GuardDeletions(deleted(count), limits)
+
+			if allowed {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(index.ErrTooManyDeletions))
+			}
+		},
+			Entry("within limits", 5, index.DeletionLimits{MaxDeletions: 5, MaxDeletionsPercent: 50}, true),
+			Entry("above count", 6, index.DeletionLimits{MaxDeletions: 5}, false),
+			Entry("above percent", 6, index.DeletionLimits{MaxDeletionsPercent: 50}, false),
+			Entry("everything without limits", 10, index.DeletionLimits{}, true),
+			Entry("everything when allowed", 10, index.DeletionLimits{MaxDeletions: 1, MaxDeletionsPercent: 1, AllowMassDeletion: true}, true),
+			Entry("nothing", 0, index.DeletionLimits{MaxDeletions: 1, MaxDeletionsPercent: 1}, true),
+		)
+
+		It("allows anything when index is empty", func() {
+			Expect(index.New(nil).GuardDeletions(deleted(3), index.DeletionLimits{MaxDeletions: 1})).To(Succeed())
+		})
+
+		It("allows mass modification", func() {
+			var files []model.FileWithContent
+			for i := 0; i < 10; i++ {
+				files = append(files, newEntry(fmt.Sprintf("test%d", i), "h-new", ""))
+			}
+			deletions := idx.CalculateChanges(files).Deletions
+			Expect(deletions).To(HaveLen(10))
+
+			Expect(idx.GuardDeletions(deletions, index.DeletionLimits{MaxDeletions: 1, MaxDeletionsPercent: 1})).To(Succeed())
+		})
+
+		It("counts only files missing in the volume", func() {
+			var files []model.FileWithContent
+			for i := 0; i < 4; i++ {
+				files = append(files, newEntry(fmt.Sprintf("test%d", i), "h-new", ""))
+			}
+			deletions := idx.CalculateChanges(files).Deletions
+
+			Expect(idx.GuardDeletions(deletions, index.DeletionLimits{MaxDeletions: 6})).To(Succeed())
+			Expect(idx.GuardDeletions(deletions, index.DeletionLimits{MaxDeletions: 5})).To(MatchError(index.ErrTooManyDeletions))
+		})
+
+		It("counts percent of indexed paths", func() {
+			entries := []index.Entry{index.NewEntry("test1", "h1a", "1"), index.NewEntry("test1", "h1b", "2"), index.NewEntry("test2", "h2", "3")}
+			idx := index.New(entries)
+			Expect(idx.Size()).To(Equal(2))
+
+			deletions := idx.CalculateChanges([]model.FileWithContent{newEntry("test2", "h2", "")}).Deletions
+
+			Expect(deletions).To(HaveLen(2))
+			Expect(idx.GuardDeletions(deletions, index.DeletionLimits{MaxDeletionsPercent: 50})).To(Succeed())
+			Expect(idx.GuardDeletions(deletions, index.DeletionLimits{MaxDeletionsPercent: 49})).To(MatchError(index.ErrTooManyDeletions))
+		})
+	})
+
+	Describe("StreamChanges", func() {
+		It("sends additions before files are exhausted", func() {
+			i := index.New([]index.Entry{index.NewEntry("test1", "h1", "1"), index.NewEntry("test2", "h2", "2")})
+			files := make(chan model.FileWithContent)
+			additions := make(chan model.FileAdded)
+			var deletions []model.FileDeleted
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				deletions, _ = i.StreamChanges(context.Background(), files, additions)
+			}()
+
+			added := newEntry("test3", "h3", "")
+			files <- added
+			Eventually(additions).Should(Receive(Equal(model.FileAdded{FileWithContent: added})))
+			files <- newEntry("test1", "h1", "")
+			close(files)
+
+			Eventually(done).Should(BeClosed())
+			Expect(deletions).To(ConsistOf(matchingFile{file: index.NewEntry("test2", "h2", "2")}))
+		})
+
+		It("stops when context is cancelled", func() {
+			i := index.New(nil)
+			files := make(chan model.FileWithContent, 1)
+			files <- newEntry("test1", "h1", "")
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := i.StreamChanges(ctx, files, make(chan model.FileAdded))
+
+			Expect(err).To(MatchError(context.Canceled))
+		})
+	})
+
 	Describe("CommitChange", func() {
 		Context("with test entry in index", func() {
 			var i index.Index
@@ -262,6 +448,209 @@ var _ = Describe("Index", func() {
 		})
 	})
 
+	Describe("Tombstones", func() {
+		var i index.Index
+		var indexPath string
+		retention := index.RetentionOptions{DeletionRetention: 30 * 24 * time.Hour}
+
+		writeRecords := func(records ...string) {
+			i = loadRecords(indexPath, records...)
+		}
+		record := indexRecord
+
+		BeforeEach(func() {
+			indexPath = filepath.Join(GinkgoT().TempDir(), "index.log")
+			writeRecords(record("added", "test1", "1", time.Hour))
+			i = i.WithRetention(retention)
+		})
+
+		It("keeps deleted file as a tombstone", func() {
+			deletions := i.CalculateChanges(nil).Deletions
+			Expect(deletions).To(HaveLen(1))
+			Expect(deletions[0].Tombstone).To(BeTrue())
+
+			Expect(i.CommitDelete("1", deletions[0])).To(Succeed())
+
+			Expect(i.Size()).To(BeZero())
+			Expect(i.Tombstones()).To(ConsistOf(matchingFile{file: index.NewEntry("test1", "h-test1", "1")}))
+			Expect(i.CalculateChanges(nil).Deletions).To(BeEmpty())
+
+			reloaded, err := index.LoadIndexFile(indexPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded.Tombstones()).To(HaveLen(1))
+			Expect(reloaded.Tombstones()[0].(index.Entry).DeletedAt()).NotTo(BeZero())
+		})
+
+		It("deletes right away when forced", func() {
+			deletions := i.WithRetention(index.RetentionOptions{ForceDeletion: true}).CalculateChanges(nil).Deletions
+
+			Expect(deletions).To(ConsistOf(model.FileDeleted{IdentifiableHashedFile: deletions[0].IdentifiableHashedFile}))
+		})
+
+		It("revives file which is back", func() {
+			writeRecords(record("added", "test1", "1", time.Hour), record("tombstoned", "test1", "1", time.Minute))
+			file := newEntry("test1", "h-test1", "")
+
+			additions := i.WithRetention(retention).CalculateChanges([]model.FileWithContent{file}).Additions
+			Expect(additions).To(Equal([]model.FileAdded{{FileWithContent: file, TombstoneId: "1"}}))
+
+			Expect(i.CommitAdd("1", additions[0])).To(Succeed())
+
+			Expect(i.Tombstones()).To(BeEmpty())
+			reloaded, err := index.LoadIndexFile(indexPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded.IsChanged(file)).To(BeFalse())
+		})
+
+		It("uploads changed file at path of a tombstone", func() {
+			writeRecords(record("added", "test1", "1", time.Hour), record("tombstoned", "test1", "1", time.Minute))
+			file := newEntry("test1", "other", "")
+
+			additions := i.WithRetention(retention).CalculateChanges([]model.FileWithContent{file}).Additions
+
+			Expect(additions).To(Equal([]model.FileAdded{{FileWithContent: file}}))
+		})
+
+		DescribeTable("purges tombstones", func(addedAgo, deletedAgo time.Duration, options index.RetentionOptions, purged bool) {
+			writeRecords(record("added", "test1", "1", addedAgo), record("tombstoned", "test1", "1", deletedAgo))
+
+			deletions := i.WithRetention(options).CalculateChanges(nil).Deletions
+
+			if purged {
+				Expect(deletions).To(HaveLen(1))
+				Expect(deletions[0].Purge).To(BeTrue())
+			} else {
+				Expect(deletions).To(BeEmpty())
+			}
+		},
+			Entry("within retention", 100*24*time.Hour, 29*24*time.Hour, retention, false),
+			Entry("after retention", 100*24*time.Hour, 31*24*time.Hour, retention, true),
+			Entry("before minimal storage duration", 60*24*time.Hour, 31*24*time.Hour, retention, false),
+			Entry("before minimal storage duration when forced", 60*24*time.Hour, time.Hour, index.RetentionOptions{ForceDeletion: true}, true),
+		)
+
+		It("removes purged file", func() {
+			writeRecords(record("added", "test1", "1", 100*24*time.Hour), record("tombstoned", "test1", "1", 31*24*time.Hour))
+			deletions := i.WithRetention(retention).CalculateChanges(nil).Deletions
+			Expect(deletions).To(HaveLen(1))
+
+			Expect(i.CommitDelete("1", deletions[0])).To(Succeed())
+
+			Expect(i.Tombstones()).To(BeEmpty())
+		})
+
+		Context("with version history", func() {
+			day := 24 * time.Hour
+
+			BeforeEach(func() {
+				writeRecords(
+					record("added", "test1", "1", 200*day), record("tombstoned", "test1", "1", 150*day),
+					record("added", "test1", "2", 150*day), record("tombstoned", "test1", "2", 100*day),
+					record("added", "test1", "3", 100*day), record("tombstoned", "test1", "3", 40*day),
+					record("added", "test1", "4", 40*day),
+					record("added", "test2", "5", 200*day), record("tombstoned", "test2", "5", 100*day),
+				)
+			})
+
+			prunedIds := func(options index.RetentionOptions) []string {
+				var ids []string
+				for _, deletion := range i.WithRetention(options).Prunable() {
+					Expect(deletion.Purge).To(BeTrue())
+					ids = append(ids, deletion.ChangeId())
+				}
+				return ids
+			}
+
+			DescribeTable("prunes versions", func(options index.RetentionOptions, expectedIds ...string) {
+				options.DeletionRetention = 30 * day
+
+				Expect(prunedIds(options)).To(ConsistOf(expectedIds))
+			},
+				Entry("without policy", index.RetentionOptions{}, "1", "2", "3", "5"),
+				Entry("keeping last versions", index.RetentionOptions{KeepVersions: 2}, "1", "2", "5"),
+				Entry("keeping recent versions", index.RetentionOptions{KeepVersionsWithin: 120 * day}, "1", "5"),
+				Entry("keeping monthly versions", index.RetentionOptions{KeepMonthly: 2}, "1", "2", "5"),
+				Entry("keeping daily and monthly versions", index.RetentionOptions{KeepDaily: 1, KeepMonthly: 3}, "1", "5"),
+			)
+
+			It("never prunes the current version", func() {
+				Expect(prunedIds(index.RetentionOptions{ForceDeletion: true})).NotTo(ContainElement("4"))
+			})
+		})
+
+		It("doesn't guard purges", func() {
+			writeRecords(
+				record("added", "test1", "1", 100*24*time.Hour),
+				record("tombstoned", "test1", "1", 31*24*time.Hour),
+				record("added", "test2", "2", time.Hour),
+			)
+			deletions := i.WithRetention(retention).CalculateChanges([]model.FileWithContent{newEntry("test2", "h-test2", "")}).Deletions
+			Expect(deletions).To(HaveLen(1))
+
+			Expect(i.GuardDeletions(deletions, index.DeletionLimits{MaxDeletions: 0, MaxDeletionsPercent: 1})).To(Succeed())
+		})
+	})
+
+	Describe("AsOf", func() {
+		var i index.Index
+		day := 24 * time.Hour
+
+		BeforeEach(func() {
+			i = loadRecords(filepath.Join(GinkgoT().TempDir(), "index.log"),
+				indexRecord("added", "test1", "1", 10*day), indexRecord("tombstoned", "test1", "1", 5*day),
+				indexRecord("added", "test1", "2", 5*day),
+				indexRecord("added", "test2", "3", 8*day), indexRecord("tombstoned", "test2", "3", 2*day),
+				indexRecord("added", "test3", "4", day),
+				indexRecord("added", "test4", "5", 9*day), indexRecord("deleted", "test4", "5", 3*day),
+			)
+		})
+
+		It("restores state at the given time", func() {
+			past, err := i.AsOf(time.Now().Add(-6 * day))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(past.CalculateChanges(nil).Deletions).To(ConsistOf(
+				matchingFile{file: index.NewEntry("test1", "h-test1", "1")},
+				matchingFile{file: index.NewEntry("test2", "h-test2", "3")},
+			))
+		})
+
+		It("restores the newest version before the time", func() {
+			past, err := i.AsOf(time.Now().Add(-4 * day))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(past.CalculateChanges(nil).Deletions).To(ConsistOf(
+				matchingFile{file: index.NewEntry("test1", "h-test1", "2")},
+				matchingFile{file: index.NewEntry("test2", "h-test2", "3")},
+			))
+		})
+
+		It("requires index file", func() {
+			_, err := index.New(nil).AsOf(time.Now())
+
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("doesn't modify index file with incomplete last record", func() {
+			indexPath := filepath.Join(GinkgoT().TempDir(), "torn.log")
+			i := loadRecords(indexPath, indexRecord("added", "test1", "1", 2*day))
+			torn := indexRecord("added", "test2", "2", day)[:20]
+			file, err := os.OpenFile(indexPath, os.O_APPEND|os.O_WRONLY, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteString(torn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			before, err := os.ReadFile(indexPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			past, err := i.AsOf(time.Now())
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(past.CalculateChanges(nil).Deletions).To(ConsistOf(matchingFile{file: index.NewEntry("test1", "h-test1", "1")}))
+			Expect(os.ReadFile(indexPath)).To(Equal(before))
+		})
+	})
+
 	Describe("File access", func() {
 		var i index.Index
 		var temp *os.File
@@ -308,5 +697,43 @@ var _ = Describe("Index", func() {
 			Expect(changesAfterAddition.Additions).To(BeEmpty())
 			Expect(changesAfterAddition.Deletions).To(BeEmpty())
 		})
+
+		It("should keep encoding of archives", func() {
+			err := i.CommitAdd("123", encodedFile{entryWithContent: newEntry("test1", "h1", "123"), encoding: "aes-256-gcm"})
+			Expect(err).NotTo(HaveOccurred())
+
+			i, err = index.LoadIndexFile(temp.Name())
+			Expect(err).NotTo(HaveOccurred())
+			deletions := i.CalculateChanges(nil).Deletions
+			Expect(deletions).To(HaveLen(1))
+			Expect(deletions[0].IdentifiableHashedFile.(index.Entry).Encoding()).To(Equal("aes-256-gcm"))
+		})
+
+		It("should keep position of bundled files", func() {
+			err := i.CommitAdd("bundle", bundledFile{entryWithContent: newEntry("test1", "h1", "bundle"), offset: 512, length: 10})
+			Expect(err).NotTo(HaveOccurred())
+
+			i, err = index.LoadIndexFile(temp.Name())
+			Expect(err).NotTo(HaveOccurred())
+			deletions := i.CalculateChanges(nil).Deletions
+			Expect(deletions).To(HaveLen(1))
+			offset, length, ok := deletions[0].IdentifiableHashedFile.(index.Entry).BundleRange()
+			Expect(ok).To(BeTrue())
+			Expect(offset).To(Equal(int64(512)))
+			Expect(length).To(Equal(int64(10)))
+		})
+
+		It("should keep size of archives", func() {
+			Expect(i.CommitAdd("bundle", bundledFile{entryWithContent: newEntry("test1", "h1", "bundle"), offset: 512, length: 10, size: 2048})).To(Succeed())
+			Expect(i.CommitAdd("archive", newEntry("test2", "h2", "archive"))).To(Succeed())
+
+			i, err := index.LoadIndexFile(temp.Name())
+			Expect(err).NotTo(HaveOccurred())
+			sizes := map[string]int64{}
+			for _, deletion := range i.CalculateChanges(nil).Deletions {
+				sizes[deletion.Path()] = deletion.IdentifiableHashedFile.(index.Entry).ArchiveSize()
+			}
+			Expect(sizes).To(Equal(map[string]int64{"test1": 2048, "test2": 0}))
+		})
 	})
 })
@@ -0,0 +1,126 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mrdunski/accumulation-zone/model"
+)
+
+// MinimalStorageDuration of Glacier. Archives deleted earlier are charged as if they were stored that long.
+const MinimalStorageDuration = 90 * 24 * time.Hour
+
+type RetentionOptions struct {
+	DeletionRetention  time.Duration `env:"DELETION_RETENTION" help:"Archives of deleted files are kept for this long, so the files can be recovered. Archives are never deleted before 90 days of minimal storage duration of Glacier." default:"720h" group:"Retention"`
+	ForceDeletion      bool          `env:"FORCE_DELETION" help:"Delete archives of deleted files right away, also before 90 days of minimal storage duration (early deletion fee applies). Version history is not kept." optional:"" group:"Retention"`
+	KeepVersions       int           `env:"KEEP_VERSIONS" help:"Number of the most recent versions of a file kept, including the current one." optional:"" group:"Retention"`
+	KeepVersionsWithin time.Duration `env:"KEEP_VERSIONS_WITHIN" help:"Versions of a file replaced within this duration are kept, e.g. 2160h." optional:"" group:"Retention"`
+	KeepDaily          int           `env:"KEEP_DAILY" help:"Number of days for which the last version of a file is kept." optional:"" group:"Retention"`
+	KeepWeekly         int           `env:"KEEP_WEEKLY" help:"Number of weeks for which the last version of a file is kept." optional:"" group:"Retention"`
+	KeepMonthly        int           `env:"KEEP_MONTHLY" help:"Number of months for which the last version of a file is kept." optional:"" group:"Retention"`
+}
+
+// expired returns true when the archive of the tombstone can be deleted.
+func (o RetentionOptions) expired(entry Entry, now time.Time) bool {
+	if o.ForceDeletion {
+		return true
+	}
+
+	return !now.Before(entry.deletedAt.Add(o.DeletionRetention)) && !now.Before(entry.recordDate.Add(MinimalStorageDuration))
+}
+
+// keptVersions returns indexes of versions kept by the version policy. versions are all entries of a single path.
+// The policy applies only to files which still exist, deleted files are kept for DeletionRetention only.
+// Age of a version is counted from the time it was replaced.
+func (o RetentionOptions) keptVersions(versions []Entry, now time.Time) map[int]bool {
+	kept := map[int]bool{}
+	replacedAt := func(entry Entry) time.Time {
+		if entry.IsTombstone() {
+			return entry.deletedAt
+		}
+		return now
+	}
+
+	order := make([]int, 0, len(versions))
+	exists := false
+	for idx, entry := range versions {
+		order = append(order, idx)
+		exists = exists || !entry.IsTombstone()
+	}
+	if !exists {
+		return kept
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return replacedAt(versions[order[a]]).After(replacedAt(versions[order[b]]))
+	})
+
+	for rank, idx := range order {
+		if rank < o.KeepVersions || (o.KeepVersionsWithin > 0 && now.Sub(replacedAt(versions[idx])) <= o.KeepVersionsWithin) {
+			kept[idx] = true
+		}
+	}
+
+	tiers := []struct {
+		count  int
+		bucket func(t time.Time) string
+	}{
+		{o.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{o.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{o.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, tier := range tiers {
+		last := ""
+		buckets := 0
+		for _, idx := range order {
+			if buckets == tier.count {
+				break
+			}
+			// the newest version in a bucket is the one which was current at its end
+			if bucket := tier.bucket(replacedAt(versions[idx]).UTC()); bucket != last {
+				last = bucket
+				buckets++
+				kept[idx] = true
+			}
+		}
+	}
+
+	return kept
+}
+
+// WithRetention keeps deleted files as tombstones until the retention period passes.
+// Without retention, archives of deleted files are deleted right away.
+func (i Index) WithRetention(options RetentionOptions) Index {
+	i.retention = &options
+
+	return i
+}
+
+// Tombstones returns files marked as deleted, which can still be recovered. Only the most recently deleted version
+// of a file is returned and only when the file doesn't exist anymore.
+func (i Index) Tombstones() []model.IdentifiableHashedFile {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	var result []model.IdentifiableHashedFile
+	for _, pathEntries := range i.entries {
+		var newest *Entry
+		for idx, entry := range pathEntries {
+			if !entry.IsTombstone() {
+				newest = nil
+				break
+			}
+			if newest == nil || newest.deletedAt.Before(entry.deletedAt) {
+				newest = &pathEntries[idx]
+			}
+		}
+		if newest != nil {
+			result = append(result, *newest)
+		}
+	}
+
+	return result
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/alecthomas/kong"
 	"github.com/mrdunski/accumulation-zone/cmd/changes/commit"
 	"github.com/mrdunski/accumulation-zone/cmd/changes/ls"
+	"github.com/mrdunski/accumulation-zone/cmd/changes/prune"
 	"github.com/mrdunski/accumulation-zone/cmd/changes/upload"
 	"github.com/mrdunski/accumulation-zone/cmd/inventory"
 	"github.com/mrdunski/accumulation-zone/cmd/restore"
@@ -59,6 +60,7 @@ type CommandInput struct {
 		Upload upload.Cmd `cmd:"" help:"Uploads all changes to AWS vault and commits them as processed." group:"Backup"`
 		Ls     ls.Cmd     `cmd:"" help:"List changes in the directory."`
 		Commit commit.Cmd `cmd:"" help:"DANGER: marks all detected changes as processed and it won't be processed in the future."`
+		Prune  prune.Cmd  `cmd:"" help:"Deletes archives of versions and deleted files whose retention has passed." group:"Backup"`
 	} `cmd:"" help:"Changes management." group:"Manage Changes"`
 
 	Inventory struct {
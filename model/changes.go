@@ -2,28 +2,93 @@ package model
 
 import (
 	"fmt"
+	"os"
+	"time"
 )
 
 type FileAdded struct {
 	FileWithContent
+	// TombstoneId is set when the file matches a file marked as deleted in the index. Its archive is still stored,
+	// so nothing has to be uploaded.
+	TombstoneId string
 }
 
 func (f FileAdded) String() string {
 	if f.FileWithContent == nil {
 		return "{added: ?}"
 	}
+	if f.TombstoneId != "" {
+		return fmt.Sprintf("{revived: {%s %s | %s}}", f.Path(), f.Hash(), f.TombstoneId)
+	}
 	return fmt.Sprintf("{added: {%s %s}}", f.Path(), f.Hash())
 }
 
+func (f FileAdded) Stat() (os.FileInfo, error) {
+	if file, ok := f.FileWithContent.(StatHolder); ok {
+		return file.Stat()
+	}
+
+	return nil, ErrStatUnknown
+}
+
 type FileDeleted struct {
 	IdentifiableHashedFile
+	// KeepArchive is set when the archive stores also files which are not deleted, e.g. other files of a bundle.
+	KeepArchive bool
+	// Tombstone is set when the file is only marked as deleted. Its archive is kept until the retention period passes.
+	Tombstone bool
+	// Purge is set for files marked as deleted before, when their retention period has passed.
+	Purge bool
+	// Replaced is set when only a previous version is deleted, as the file still exists with other content.
+	Replaced bool
 }
 
 func (f FileDeleted) String() string {
 	if f.IdentifiableHashedFile == nil {
 		return "{deleted: ?}"
 	}
-	return fmt.Sprintf("{deleted: {%s %s | %s}}", f.Path(), f.Hash(), f.ChangeId())
+	kind := "deleted"
+	switch {
+	case f.Tombstone:
+		kind = "tombstoned"
+	case f.Purge:
+		kind = "purged"
+	}
+	return fmt.Sprintf("{%s: {%s %s | %s}}", kind, f.Path(), f.Hash(), f.ChangeId())
+}
+
+// Encoding, BundleRange, ArchiveSize and UploadedAt tell what the deleted file knows about its archive,
+// so the file can be restored from it.
+func (f FileDeleted) Encoding() string {
+	if file, ok := f.IdentifiableHashedFile.(EncodingHolder); ok {
+		return file.Encoding()
+	}
+
+	return ""
+}
+
+func (f FileDeleted) BundleRange() (offset, length int64, ok bool) {
+	if file, isMember := f.IdentifiableHashedFile.(BundleMember); isMember {
+		return file.BundleRange()
+	}
+
+	return 0, 0, false
+}
+
+func (f FileDeleted) ArchiveSize() int64 {
+	if file, ok := f.IdentifiableHashedFile.(ArchiveSizeHolder); ok {
+		return file.ArchiveSize()
+	}
+
+	return 0
+}
+
+func (f FileDeleted) UploadedAt() time.Time {
+	if file, ok := f.IdentifiableHashedFile.(UploadTimeHolder); ok {
+		return file.UploadedAt()
+	}
+
+	return time.Time{}
 }
 
 type Changes struct {
@@ -43,3 +108,27 @@ func (c *Changes) String() string {
 func (c *Changes) Len() int {
 	return len(c.Additions) + len(c.Deletions)
 }
+
+// ChangeStream delivers additions while files are still being scanned.
+// Deletions are known only when the scan is complete, so Deletions blocks until then.
+type ChangeStream struct {
+	Additions <-chan FileAdded
+	Deletions func() ([]FileDeleted, error)
+}
+
+// Stream returns already calculated changes as a ChangeStream.
+func (c *Changes) Stream() ChangeStream {
+	additions := make(chan FileAdded, len(c.Additions))
+	for _, addition := range c.Additions {
+		additions <- addition
+	}
+	close(additions)
+
+	deletions := c.Deletions
+	return ChangeStream{
+		Additions: additions,
+		Deletions: func() ([]FileDeleted, error) {
+			return deletions, nil
+		},
+	}
+}
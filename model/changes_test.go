@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -40,8 +41,11 @@ var _ = DescribeTable("Format message", func(stringer fmt.Stringer, expectedResu
 },
 	Entry("FileAdded", FileAdded{FileWithContent: file{path: "abc", hash: "h"}}, "{added: {abc h}}"),
 	Entry("FileAdded with nil", FileAdded{}, "{added: ?}"),
+	Entry("FileAdded with tombstone", FileAdded{FileWithContent: file{path: "abc", hash: "h"}, TombstoneId: "id"}, "{revived: {abc h | id}}"),
 	Entry("FileDeleted", FileDeleted{IdentifiableHashedFile: file{path: "abc", hash: "h"}}, "{deleted: {abc h | abc,h}}"),
 	Entry("FileDeleted with nil", FileDeleted{}, "{deleted: ?}"),
+	Entry("FileDeleted as tombstone", FileDeleted{IdentifiableHashedFile: file{path: "abc", hash: "h"}, Tombstone: true}, "{tombstoned: {abc h | abc,h}}"),
+	Entry("FileDeleted purge", FileDeleted{IdentifiableHashedFile: file{path: "abc", hash: "h"}, Purge: true}, "{purged: {abc h | abc,h}}"),
 	Entry("Changes", &Changes{}, "{added: [], deleted: []}"),
 	Entry("Changes", &Changes{Additions: []FileAdded{{}}, Deletions: []FileDeleted{{}}}, "{added: [{added: ?}], deleted: [{deleted: ?}]}"),
 )
@@ -63,3 +67,45 @@ var _ = Describe("Changes", func() {
 		Expect(changes1.Deletions).To(ConsistOf(FileDeleted{IdentifiableHashedFile: file{path: "2"}}, FileDeleted{IdentifiableHashedFile: file{path: "4"}}, FileDeleted{IdentifiableHashedFile: file{path: "5"}}))
 	})
 })
+
+type archivedFile struct {
+	file
+}
+
+func (f archivedFile) Encoding() string {
+	return "gzip"
+}
+
+func (f archivedFile) BundleRange() (int64, int64, bool) {
+	return 512, 10, true
+}
+
+func (f archivedFile) ArchiveSize() int64 {
+	return 2048
+}
+
+func (f archivedFile) UploadedAt() time.Time {
+	return time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+}
+
+var _ = Describe("FileDeleted", func() {
+	It("tells about archive of the deleted file", func() {
+		deleted := FileDeleted{IdentifiableHashedFile: archivedFile{file{path: "abc", hash: "h"}}}
+
+		offset, length, bundled := deleted.BundleRange()
+		Expect([]any{offset, length, bundled}).To(Equal([]any{int64(512), int64(10), true}))
+		Expect(deleted.Encoding()).To(Equal("gzip"))
+		Expect(deleted.ArchiveSize()).To(Equal(int64(2048)))
+		Expect(deleted.UploadedAt()).To(Equal(time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)))
+	})
+
+	It("knows nothing about archive of file which doesn't tell about it", func() {
+		deleted := FileDeleted{IdentifiableHashedFile: file{path: "abc", hash: "h"}}
+
+		_, _, bundled := deleted.BundleRange()
+		Expect(bundled).To(BeFalse())
+		Expect(deleted.Encoding()).To(BeEmpty())
+		Expect(deleted.ArchiveSize()).To(BeZero())
+		Expect(deleted.UploadedAt()).To(BeZero())
+	})
+})
@@ -1,7 +1,12 @@
 //go:generate mockgen -destination=mock_model/hash_file.go . HashedFile,FileWithContent,ChangeIdHolder,IdentifiableHashedFile
 package model
 
-import "io"
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
 
 type HashedFile interface {
 	Path() string
@@ -23,6 +28,48 @@ type IdentifiableHashedFile interface {
 	ChangeIdHolder
 }
 
+// EncodingHolder is implemented by files stored in Glacier in an encoded form, e.g. encrypted.
+type EncodingHolder interface {
+	Encoding() string
+}
+
+// EncodedFile is a file with content encoded for upload. Hash stays the hash of the original content,
+// ArchiveHash is the tree hash of the encoded content.
+type EncodedFile interface {
+	FileWithContent
+	EncodingHolder
+	ArchiveHash() string
+}
+
+// BundleMember is implemented by files which can be stored in a bundle archive together with other files.
+type BundleMember interface {
+	// BundleRange is a position of the file in its bundle archive. ok is false when the file has its own archive.
+	BundleRange() (offset, length int64, ok bool)
+}
+
+// ArchiveSizeHolder is implemented by files which know the size of their archive in Glacier. It differs from
+// the size of the file for encoded files and files stored in bundles.
+type ArchiveSizeHolder interface {
+	ArchiveSize() int64
+}
+
+// UploadTimeHolder is implemented by files which know when their archive was uploaded, e.g. archives listed
+// in the inventory.
+type UploadTimeHolder interface {
+	UploadedAt() time.Time
+}
+
+// ErrTreeHashMismatch is returned when content doesn't match its tree hash, e.g. because it is corrupted.
+var ErrTreeHashMismatch = errors.New("tree hash mismatch")
+
+// ErrStatUnknown is returned by Stat of files which wrap a file without attributes.
+var ErrStatUnknown = errors.New("file attributes are unknown")
+
+// StatHolder is implemented by files which can tell their attributes, e.g. modification time.
+type StatHolder interface {
+	Stat() (os.FileInfo, error)
+}
+
 type HashedFiles map[string]HashedFile
 type IdentifiableHashedFiles map[string]IdentifiableHashedFile
 
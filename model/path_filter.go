@@ -0,0 +1,90 @@
+package model
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PathFilter selects files by their paths with glob patterns. `*`, `?` and `[...]` match within a single
+// directory, `**` matches any number of directories. A pattern matching a directory selects everything inside it.
+// Patterns without a slash match names of files and directories at any depth, e.g. `*.xlsx`.
+type PathFilter struct {
+	Includes []string
+	Excludes []string
+}
+
+// Validate checks syntax of the patterns.
+func (f PathFilter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Includes...), f.Excludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// IsEmpty returns true when the filter selects every file.
+func (f PathFilter) IsEmpty() bool {
+	return len(f.Includes) == 0 && len(f.Excludes) == 0
+}
+
+// Matches returns true when p matches any of includes, or there are no includes, and none of excludes.
+func (f PathFilter) Matches(p string) bool {
+	segments := splitPath(p)
+	included := len(f.Includes) == 0
+	for _, pattern := range f.Includes {
+		included = included || matchesPattern(pattern, segments)
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range f.Excludes {
+		if matchesPattern(pattern, segments) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+func matchesPattern(pattern string, segments []string) bool {
+	if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+		pattern = "**/" + pattern
+	}
+
+	return matchesSegments(splitPath(pattern), segments)
+}
+
+// matchesSegments returns true when pattern matches path or any of its parent directories.
+func matchesSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if pattern[0] == "**" {
+		for skipped := 0; skipped <= len(segments); skipped++ {
+			if matchesSegments(pattern[1:], segments[skipped:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+
+	return matchesSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PathFilter", func() {
+	DescribeTable("matches paths",
+		func(filter PathFilter, path string, expected bool) {
+			Expect(filter.Matches(path)).To(Equal(expected))
+		},
+		Entry("everything without patterns", PathFilter{}, "a/b.txt", true),
+		Entry("directory prefix", PathFilter{Includes: []string{"projects/acme"}}, "projects/acme/docs/a.txt", true),
+		Entry("directory prefix with slashes", PathFilter{Includes: []string{"/projects/acme/"}}, "projects/acme/a.txt", true),
+		Entry("not a partial name", PathFilter{Includes: []string{"projects/acme"}}, "projects/acme2/a.txt", false),
+		Entry("other directory", PathFilter{Includes: []string{"projects/acme"}}, "projects/other/a.txt", false),
+		Entry("name at any depth", PathFilter{Includes: []string{"*.xlsx"}}, "finance/2023/q1.xlsx", true),
+		Entry("star within directory", PathFilter{Includes: []string{"finance/*.xlsx"}}, "finance/2023/q1.xlsx", false),
+		Entry("double star", PathFilter{Includes: []string{"finance/**/*.xlsx"}}, "finance/2023/q1.xlsx", true),
+		Entry("double star without directories", PathFilter{Includes: []string{"finance/**/*.xlsx"}}, "finance/q1.xlsx", true),
+		Entry("any of includes", PathFilter{Includes: []string{"a", "b"}}, "b/c.txt", true),
+		Entry("excluded", PathFilter{Excludes: []string{"*.tmp"}}, "a/b.tmp", false),
+		Entry("excluded directory", PathFilter{Includes: []string{"a"}, Excludes: []string{"a/cache"}}, "a/cache/b.txt", false),
+		Entry("not excluded", PathFilter{Includes: []string{"a"}, Excludes: []string{"a/cache"}}, "a/b.txt", true),
+	)
+
+	It("validates patterns", func() {
+		Expect(PathFilter{Includes: []string{"a/**/*.txt"}}.Validate()).To(Succeed())
+		Expect(PathFilter{Excludes: []string{"[a"}}.Validate()).NotTo(Succeed())
+	})
+})
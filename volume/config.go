@@ -1,17 +1,22 @@
 package volume
 
 import (
+	"context"
 	"fmt"
 	"github.com/mrdunski/accumulation-zone/files"
 	"github.com/mrdunski/accumulation-zone/index"
+	"github.com/mrdunski/accumulation-zone/logger"
 	"github.com/mrdunski/accumulation-zone/model"
 	"path"
 )
 
 type Volume struct {
-	Path      string   `arg:"" env:"PATH_TO_BACKUP" help:"Path to synchronize." type:"path" group:"Volume"`
-	IndexFile string   `help:"File where synchronisation data will be kept." optional:"" default:".changes.log" group:"Volume"`
-	Excludes  []string `name:"exclude" env:"BACKUP_EXCLUDES" help:"Exclude some files and directories by name" optional:"" sep:"," group:"Volume"`
+	Path        string   `arg:"" env:"PATH_TO_BACKUP" help:"Path to synchronize." type:"path" group:"Volume"`
+	IndexFile   string   `help:"File where synchronisation data will be kept." optional:"" default:".changes.log" group:"Volume"`
+	Excludes    []string `name:"exclude" env:"BACKUP_EXCLUDES" help:"Exclude some files and directories by name" optional:"" sep:"," group:"Volume"`
+	HashWorkers int      `env:"HASH_WORKERS" help:"Number of files hashed concurrently." default:"4" group:"Volume"`
+	Paranoid    bool     `env:"PARANOID" help:"Ignores cached hashes and reads every file to detect changes." optional:"" group:"Volume"`
+	index.RetentionOptions
 }
 
 func (c Volume) allExcludes() []string {
@@ -24,18 +29,97 @@ func (c Volume) allExcludes() []string {
 	return excludes
 }
 
+func (c Volume) filesVolume() files.Volume {
+	return files.NewVolume(c.Path, c.allExcludes()...).WithHashWorkers(c.HashWorkers)
+}
+
+// LoadFile loads a file of the volume together with its hash.
+func (c Volume) LoadFile(subPath string) (model.HashedFile, error) {
+	return c.filesVolume().LoadFile(subPath)
+}
+
+// HashCacheFile is a file next to the index where hashes of unchanged files are cached.
+func (c Volume) HashCacheFile() string {
+	return path.Join(c.Path, c.IndexFile+".hashes")
+}
+
 func (c Volume) GetChanges() (model.Changes, index.Index, error) {
-	tree, err := files.NewVolume(c.Path, c.allExcludes()...).LoadTree()
+	idx, err := c.CreateIndex()
 	if err != nil {
-		return model.Changes{}, index.Index{}, fmt.Errorf("failed to load tree {%s}: %w", c.Path, err)
+		return model.Changes{}, idx, err
 	}
 
-	idx, err := c.CreateIndex()
+	changes, err := c.CalculateChanges(idx)
 	if err != nil {
 		return model.Changes{}, idx, err
 	}
 
-	return idx.CalculateChanges(tree), idx, nil
+	return changes, idx, nil
+}
+
+// CalculateChanges compares files of the volume with idx.
+func (c Volume) CalculateChanges(idx index.Index) (model.Changes, error) {
+	cache, err := files.LoadHashCache(c.HashCacheFile(), c.Paranoid)
+	if err != nil {
+		return model.Changes{}, fmt.Errorf("failed to load hash cache: %w", err)
+	}
+
+	tree, err := c.filesVolume().WithHashCache(cache).LoadTree()
+	if err != nil {
+		return model.Changes{}, fmt.Errorf("failed to load tree {%s}: %w", c.Path, err)
+	}
+
+	return idx.CalculateChanges(tree), nil
+}
+
+// LoadTree loads files of the volume without the hash cache, so nothing is written to the volume.
+func (c Volume) LoadTree() ([]model.FileWithContent, error) {
+	tree, err := c.filesVolume().LoadTree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tree {%s}: %w", c.Path, err)
+	}
+
+	return tree, nil
+}
+
+// StreamChanges starts scanning the volume and returns changes as they are detected.
+// Scanning stops when ctx is cancelled.
+func (c Volume) StreamChanges(ctx context.Context) (model.ChangeStream, index.Index, error) {
+	cache, err := files.LoadHashCache(c.HashCacheFile(), c.Paranoid)
+	if err != nil {
+		return model.ChangeStream{}, index.Index{}, fmt.Errorf("failed to load hash cache: %w", err)
+	}
+
+	idx, err := c.CreateIndex()
+	if err != nil {
+		return model.ChangeStream{}, idx, err
+	}
+
+	tree := make(chan model.FileWithContent)
+	treeErr := make(chan error, 1)
+	go func() {
+		treeErr <- c.filesVolume().WithHashCache(cache).StreamTree(ctx, tree)
+	}()
+
+	additions := make(chan model.FileAdded)
+	var deletions []model.FileDeleted
+	var streamErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		deletions, streamErr = idx.StreamChanges(ctx, tree, additions)
+		if loadErr := <-treeErr; loadErr != nil {
+			deletions, streamErr = nil, fmt.Errorf("failed to load tree {%s}: %w", c.Path, loadErr)
+		}
+	}()
+
+	return model.ChangeStream{
+		Additions: additions,
+		Deletions: func() ([]model.FileDeleted, error) {
+			<-done
+			return deletions, streamErr
+		},
+	}, idx, nil
 }
 
 func (c Volume) CreateIndex() (index.Index, error) {
@@ -44,9 +128,42 @@ func (c Volume) CreateIndex() (index.Index, error) {
 		return index.Index{}, fmt.Errorf("failed to load changes file {%s/%s}: %w", c.Path, c.IndexFile, err)
 	}
 
-	return idx, nil
+	return idx.WithRetention(c.RetentionOptions), nil
+}
+
+// UploadJournalFile is a file next to the index where progress of multipart uploads is kept.
+// Its name starts with IndexFile, so it is excluded from synchronization together with the index.
+func (c Volume) UploadJournalFile() string {
+	return path.Join(c.Path, c.IndexFile+".uploads")
+}
+
+// DownloadDir is a directory next to the index where partial downloads of job outputs are kept until they are
+// complete. Its name starts with IndexFile, so it is excluded from synchronization together with the index.
+func (c Volume) DownloadDir() string {
+	return path.Join(c.Path, c.IndexFile+".downloads")
+}
+
+// RestoreJournalFile is a file next to the index where state of an unfinished restore is kept.
+// Its name starts with IndexFile, so it is excluded from synchronization together with the index.
+func (c Volume) RestoreJournalFile() string {
+	return path.Join(c.Path, c.IndexFile+".restore")
+}
+
+// RemoveRestoreLeftovers removes temporary files of restores which were interrupted.
+func (c Volume) RemoveRestoreLeftovers() error {
+	removed, err := c.filesVolume().RemoveRestoreLeftovers()
+	if err != nil {
+		return fmt.Errorf("failed to remove leftovers of interrupted restore {%s}: %w", c.Path, err)
+	}
+	if removed > 0 {
+		logger.WithComponent("volume").Warnf("Removed %d leftovers of interrupted restore", removed)
+	}
+
+	return nil
 }
 
-func (c Volume) SaveFile(file model.FileWithContent) error {
-	return files.NewVolume(c.Path, c.allExcludes()...).Save(file)
+// SaveFile stores file in the volume. Content which doesn't match its hash is moved to quarantineDir,
+// or removed when quarantineDir is empty.
+func (c Volume) SaveFile(file model.FileWithContent, quarantineDir string) error {
+	return c.filesVolume().WithQuarantine(quarantineDir).Save(file)
 }